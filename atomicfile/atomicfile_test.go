@@ -0,0 +1,28 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomicfile")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	assert.NoError(t, WriteFile(path, []byte("{}")))
+	// replaced, without temporary files left
+	assert.NoError(t, WriteFile(path, []byte(`{"a": 1}`)))
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"a": 1}`, string(content))
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+	// the file is kept when the directory is missing
+	assert.Error(t, WriteFile(filepath.Join(dir, "missing", "state.json"), []byte("{}")))
+}
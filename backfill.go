@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/collector"
+	"github.com/fernhtls/stackdriverExporter/config"
+	"github.com/fernhtls/stackdriverExporter/jsonoutput"
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+	"github.com/fernhtls/stackdriverExporter/utils"
+)
+
+// parses the time of the backfill, as RFC3339 or as a duration before now like "1008h"
+func parseBackfillTime(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("time %q should be RFC3339 like 2020-10-01T00:00:00Z or a duration before now like 1008h", value)
+	}
+	return now.Add(-d), nil
+}
+
+// gets the metrics of the backfill from the --metric_type flags, expanding the patterns in the project
+func getBackfillMetrics(ctx context.Context, client *stackdriverClient.StackDriverClient,
+	metrics []string) ([]utils.MetricsAndIntervalType, error) {
+	c := config.Default()
+	if err := c.SetMetricFlags(metrics); err != nil {
+		return nil, err
+	}
+	metricsAndIntervals, err := c.MetricsAndIntervals()
+	if err != nil {
+		return nil, err
+	}
+	discovery := &utils.MetricsDiscovery{
+		Client:  client,
+		Metrics: metricsAndIntervals,
+	}
+	return discovery.Expand(ctx)
+}
+
+// runs the backfill subcommand, exporting a time range of the metrics of a project in json files
+func runBackfill(args []string) error {
+	var projectID, outputPath, progressFile, start, end string
+	var backfillMetrics metricsListType
+	var chunk, retention time.Duration
+	var concurrency int
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	fs.StringVar(&projectID, "project_id", "", "gcp project id to backfill")
+	fs.Var(&backfillMetrics, "metric_type",
+		"metric type to backfill, with optional filter and aggregation as in --metric_type of the exporter (pass --metric_type multiple times for multiple metrics)")
+	fs.StringVar(&start, "start", "", "start of the backfill, RFC3339 or a duration before now like 1008h")
+	fs.StringVar(&end, "end", "0s", "end of the backfill, RFC3339 or a duration before now")
+	fs.DurationVar(&chunk, "chunk", time.Hour, "longest window written in a json file")
+	fs.IntVar(&concurrency, "concurrency", 4, "chunks queried and written at the same time")
+	fs.DurationVar(&retention, "retention", collector.DefaultRetention,
+		"time cloud monitoring keeps the points, the backfill starting from the oldest point kept")
+	fs.StringVar(&outputPath, "output_path", "", "directory where the json files are written")
+	fs.StringVar(&progressFile, "progress_file", "",
+		"file with the chunks already written, resuming the backfill (.stackdriver_exporter_backfill.json in the output path when empty)")
+	fs.Parse(args)
+	if len(backfillMetrics) == 0 {
+		return errors.New("at least one metric_type is mandatory")
+	}
+	now := time.Now()
+	startTime, err := parseBackfillTime(start, now)
+	if err != nil {
+		return err
+	}
+	endTime, err := parseBackfillTime(end, now)
+	if err != nil {
+		return err
+	}
+	logger := log.New(os.Stdout, "backfill: ", log.LstdFlags)
+	j := &jsonoutput.JSONOutput{
+		OutputPath: outputPath,
+		Logger:     logger,
+	}
+	if err = j.ValidateOutputPath(); err != nil {
+		return err
+	}
+	if progressFile == "" {
+		progressFile = filepath.Join(outputPath, ".stackdriver_exporter_backfill.json")
+	}
+	client, err := newProjectClient(projectID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	// SIGINT and SIGTERM stop sending chunks, the chunks in flight being written and saved in the progress file
+	// a second signal stops the backfill right away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	metrics, err := getBackfillMetrics(ctx, client, backfillMetrics)
+	if err != nil {
+		return err
+	}
+	b := collector.Backfill{
+		Logger:       logger,
+		Sink:         j,
+		Client:       client,
+		Metrics:      metrics,
+		Start:        startTime,
+		End:          endTime,
+		Chunk:        chunk,
+		Concurrency:  concurrency,
+		Retention:    retention,
+		ProgressFile: progressFile,
+	}
+	return b.Run(ctx)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/fernhtls/stackdriverExporter/catalog"
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+)
+
+// creates the client of the project for the subcommands, to be closed once done
+func newProjectClient(projectID string) (*stackdriverClient.StackDriverClient, error) {
+	if projectID == "" {
+		return nil, errors.New("project_id is mandatory")
+	}
+	client := &stackdriverClient.StackDriverClient{ProjectID: projectID}
+	if err := client.InitClient(); err != nil {
+		return nil, fmt.Errorf("error on creating client for project %s: %v", projectID, err)
+	}
+	return client, nil
+}
+
+// runs the list-metrics subcommand, listing the metric descriptors of a project
+func runListMetrics(args []string) error {
+	var projectID, prefix, regex, format string
+	fs := flag.NewFlagSet("list-metrics", flag.ExitOnError)
+	fs.StringVar(&projectID, "project_id", "", "gcp project id to list the metrics")
+	fs.StringVar(&prefix, "prefix", "", "lists only the metric types starting with the prefix, like storage.googleapis.com/")
+	fs.StringVar(&regex, "regex", "", "lists only the metric types matching the regular expression")
+	fs.StringVar(&format, "format", catalog.TableFormat,
+		"output format: table, json, yaml or config (a starter config file with the metrics)")
+	fs.Parse(args)
+	if err := catalog.ValidateFormat(format, true); err != nil {
+		return err
+	}
+	var re *regexp.Regexp
+	if regex != "" {
+		var err error
+		if re, err = regexp.Compile(regex); err != nil {
+			return fmt.Errorf("regex %q is not valid: %v", regex, err)
+		}
+	}
+	client, err := newProjectClient(projectID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	entries, err := catalog.ListEntries(context.Background(), client, prefix, re)
+	if err != nil {
+		return err
+	}
+	return catalog.WriteEntries(os.Stdout, entries, format, projectID)
+}
+
+// runs the describe-metric subcommand, describing a metric with its monitored resources
+func runDescribeMetric(args []string) error {
+	var projectID, metricType, format string
+	fs := flag.NewFlagSet("describe-metric", flag.ExitOnError)
+	fs.StringVar(&projectID, "project_id", "", "gcp project id of the metric")
+	fs.StringVar(&metricType, "metric_type", "", "metric type to describe")
+	fs.StringVar(&format, "format", catalog.TableFormat, "output format: table, json or yaml")
+	fs.Parse(args)
+	if err := catalog.ValidateFormat(format, false); err != nil {
+		return err
+	}
+	if metricType == "" {
+		return errors.New("metric_type is mandatory")
+	}
+	client, err := newProjectClient(projectID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	entry, err := catalog.DescribeEntry(context.Background(), client, metricType)
+	if err != nil {
+		return err
+	}
+	return catalog.WriteEntry(os.Stdout, entry, format)
+}
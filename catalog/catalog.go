@@ -0,0 +1,242 @@
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/fernhtls/stackdriverExporter/config"
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+	"google.golang.org/genproto/googleapis/api/label"
+	"google.golang.org/genproto/googleapis/api/metric"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	"gopkg.in/yaml.v3"
+)
+
+// formats of the catalog output
+const (
+	TableFormat  = "table"
+	JSONFormat   = "json"
+	YAMLFormat   = "yaml"
+	ConfigFormat = "config"
+)
+
+// Entry : metric of the catalog, from its metric descriptor
+// Resources	- monitored resources of the metric with their labels, only when described
+type Entry struct {
+	Type          string     `json:"type" yaml:"type"`
+	Kind          string     `json:"kind" yaml:"kind"`
+	ValueType     string     `json:"value_type" yaml:"value_type"`
+	Unit          string     `json:"unit" yaml:"unit"`
+	Labels        []string   `json:"labels" yaml:"labels"`
+	ResourceTypes []string   `json:"resource_types" yaml:"resource_types"`
+	LaunchStage   string     `json:"launch_stage" yaml:"launch_stage"`
+	Description   string     `json:"description,omitempty" yaml:"description,omitempty"`
+	Resources     []Resource `json:"resources,omitempty" yaml:"resources,omitempty"`
+}
+
+// Resource : monitored resource of a metric, from its monitored resource descriptor
+type Resource struct {
+	Type        string   `json:"type" yaml:"type"`
+	DisplayName string   `json:"display_name" yaml:"display_name"`
+	Labels      []string `json:"labels" yaml:"labels"`
+}
+
+// starter config written from the catalog, loaded with the default settings
+// the prometheus output is set as it needs no other setting
+type starterConfig struct {
+	Version  int             `yaml:"version"`
+	Projects []string        `yaml:"projects"`
+	Output   starterOutput   `yaml:"output"`
+	Metrics  []starterMetric `yaml:"metrics"`
+}
+
+type starterOutput struct {
+	Type string `yaml:"type"`
+}
+
+type starterMetric struct {
+	Type string `yaml:"type"`
+}
+
+// ValidateFormat : validates the format of the catalog output, config being only for lists
+func ValidateFormat(format string, list bool) error {
+	switch format {
+	case TableFormat, JSONFormat, YAMLFormat:
+		return nil
+	case ConfigFormat:
+		if list {
+			return nil
+		}
+	}
+	return fmt.Errorf("format %q is not valid, should be table, json or yaml (or config for lists)", format)
+}
+
+// gets the keys of the labels
+func getLabelKeys(labels []*label.LabelDescriptor) []string {
+	keys := make([]string, 0, len(labels))
+	for _, l := range labels {
+		keys = append(keys, l.Key)
+	}
+	return keys
+}
+
+// NewEntry : builds the catalog entry of the metric descriptor
+func NewEntry(descriptor *metric.MetricDescriptor) Entry {
+	resourceTypes := descriptor.GetMonitoredResourceTypes()
+	if resourceTypes == nil {
+		resourceTypes = make([]string, 0)
+	}
+	return Entry{
+		Type:          descriptor.GetType(),
+		Kind:          descriptor.GetMetricKind().String(),
+		ValueType:     descriptor.GetValueType().String(),
+		Unit:          descriptor.GetUnit(),
+		Labels:        getLabelKeys(descriptor.GetLabels()),
+		ResourceTypes: resourceTypes,
+		LaunchStage:   descriptor.GetLaunchStage().String(),
+		Description:   descriptor.GetDescription(),
+	}
+}
+
+// NewResource : builds the monitored resource of the catalog from its descriptor
+func NewResource(descriptor *monitoredrespb.MonitoredResourceDescriptor) Resource {
+	return Resource{
+		Type:        descriptor.GetType(),
+		DisplayName: descriptor.GetDisplayName(),
+		Labels:      getLabelKeys(descriptor.GetLabels()),
+	}
+}
+
+// PrefixFilter : cloud monitoring filter of the metric types starting with the prefix, empty for all the metrics
+func PrefixFilter(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	return "metric.type = starts_with(\"" + prefix + "\")"
+}
+
+// ListEntries : lists the metrics of the project starting with the prefix and matching the regular expression
+// sorted by metric type, regex can be nil for all the metrics, the listing being cancelled with the context
+func ListEntries(ctx context.Context, client *stackdriverClient.StackDriverClient, prefix string,
+	regex *regexp.Regexp) ([]Entry, error) {
+	descriptors, err := client.ListMetricDescriptors(ctx, PrefixFilter(prefix))
+	if err != nil {
+		return nil, fmt.Errorf("error on listing metrics: %v", err)
+	}
+	return filterEntries(descriptors, regex), nil
+}
+
+// builds the entries of the descriptors matching the regular expression, sorted by metric type
+func filterEntries(descriptors []*metric.MetricDescriptor, regex *regexp.Regexp) []Entry {
+	entries := make([]Entry, 0, len(descriptors))
+	for _, descriptor := range descriptors {
+		if regex != nil && !regex.MatchString(descriptor.GetType()) {
+			continue
+		}
+		entries = append(entries, NewEntry(descriptor))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Type < entries[j].Type
+	})
+	return entries
+}
+
+// DescribeEntry : describes the metric with its monitored resources, the calls being cancelled with the context
+func DescribeEntry(ctx context.Context, client *stackdriverClient.StackDriverClient, metricType string) (Entry, error) {
+	descriptor, err := client.GetMetricDescriptorContext(ctx, metricType)
+	if err != nil {
+		return Entry{}, fmt.Errorf("error on getting metric %s: %v", metricType, err)
+	}
+	entry := NewEntry(descriptor)
+	for _, resourceType := range entry.ResourceTypes {
+		resourceDescriptor, err := client.GetMonitoredResourceDescriptorContext(ctx, resourceType)
+		if err != nil {
+			return Entry{}, fmt.Errorf("error on getting monitored resource %s: %v", resourceType, err)
+		}
+		entry.Resources = append(entry.Resources, NewResource(resourceDescriptor))
+	}
+	return entry, nil
+}
+
+// WriteEntries : writes the list of metrics in the format
+// the config format writes a starter config file with the metrics for the project
+func WriteEntries(w io.Writer, entries []Entry, format, projectID string) error {
+	switch format {
+	case TableFormat:
+		return writeTable(w, entries)
+	case ConfigFormat:
+		return writeConfig(w, entries, projectID)
+	default:
+		return write(w, entries, format)
+	}
+}
+
+// WriteEntry : writes the description of the metric in the format
+func WriteEntry(w io.Writer, entry Entry, format string) error {
+	if format != TableFormat {
+		return write(w, entry, format)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "TYPE\t%s\n", entry.Type)
+	fmt.Fprintf(tw, "KIND\t%s\n", entry.Kind)
+	fmt.Fprintf(tw, "VALUE TYPE\t%s\n", entry.ValueType)
+	fmt.Fprintf(tw, "UNIT\t%s\n", entry.Unit)
+	fmt.Fprintf(tw, "LABELS\t%s\n", strings.Join(entry.Labels, ","))
+	fmt.Fprintf(tw, "LAUNCH STAGE\t%s\n", entry.LaunchStage)
+	fmt.Fprintf(tw, "DESCRIPTION\t%s\n", entry.Description)
+	fmt.Fprintln(tw, "")
+	fmt.Fprintln(tw, "RESOURCE TYPE\tNAME\tLABELS")
+	for _, r := range entry.Resources {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Type, r.DisplayName, strings.Join(r.Labels, ","))
+	}
+	return tw.Flush()
+}
+
+// writes the value as json or yaml
+func write(w io.Writer, v interface{}, format string) error {
+	switch format {
+	case JSONFormat:
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		return e.Encode(v)
+	case YAMLFormat:
+		e := yaml.NewEncoder(w)
+		e.SetIndent(2)
+		if err := e.Encode(v); err != nil {
+			return err
+		}
+		return e.Close()
+	}
+	return ValidateFormat(format, false)
+}
+
+// writes the metrics as a table, one line by metric
+func writeTable(w io.Writer, entries []Entry) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tKIND\tVALUE TYPE\tUNIT\tLABELS\tRESOURCE TYPES\tLAUNCH STAGE")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", e.Type, e.Kind, e.ValueType, e.Unit,
+			strings.Join(e.Labels, ","), strings.Join(e.ResourceTypes, ","), e.LaunchStage)
+	}
+	return tw.Flush()
+}
+
+// writes a starter config file with the metrics, the other settings being the defaults
+func writeConfig(w io.Writer, entries []Entry, projectID string) error {
+	c := starterConfig{
+		Version:  config.CurrentVersion,
+		Projects: []string{projectID},
+		Output:   starterOutput{Type: config.PrometheusOutputType},
+		Metrics:  make([]starterMetric, 0, len(entries)),
+	}
+	for _, e := range entries {
+		c.Metrics = append(c.Metrics, starterMetric{Type: e.Type})
+	}
+	return write(w, c, YAMLFormat)
+}
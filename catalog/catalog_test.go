@@ -0,0 +1,109 @@
+package catalog
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/fernhtls/stackdriverExporter/config"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/api"
+	"google.golang.org/genproto/googleapis/api/label"
+	"google.golang.org/genproto/googleapis/api/metric"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	"gopkg.in/yaml.v3"
+)
+
+func getTestDescriptors() []*metric.MetricDescriptor {
+	return []*metric.MetricDescriptor{
+		{
+			Type:                   "storage.googleapis.com/storage/total_bytes",
+			MetricKind:             metric.MetricDescriptor_GAUGE,
+			ValueType:              metric.MetricDescriptor_DOUBLE,
+			Unit:                   "By",
+			Labels:                 []*label.LabelDescriptor{{Key: "storage_class"}},
+			MonitoredResourceTypes: []string{"gcs_bucket"},
+			LaunchStage:            api.LaunchStage_GA,
+		},
+		{
+			Type:       "bigquery.googleapis.com/query/count",
+			MetricKind: metric.MetricDescriptor_GAUGE,
+			ValueType:  metric.MetricDescriptor_INT64,
+			Unit:       "1",
+		},
+		{
+			Type:       "storage.googleapis.com/api/request_count",
+			MetricKind: metric.MetricDescriptor_DELTA,
+			ValueType:  metric.MetricDescriptor_INT64,
+		},
+	}
+}
+
+func TestNewEntry(t *testing.T) {
+	e := NewEntry(getTestDescriptors()[0])
+	assert.Equal(t, "storage.googleapis.com/storage/total_bytes", e.Type)
+	assert.Equal(t, "GAUGE", e.Kind)
+	assert.Equal(t, "DOUBLE", e.ValueType)
+	assert.Equal(t, "By", e.Unit)
+	assert.Equal(t, []string{"storage_class"}, e.Labels)
+	assert.Equal(t, []string{"gcs_bucket"}, e.ResourceTypes)
+	assert.Equal(t, "GA", e.LaunchStage)
+	r := NewResource(&monitoredrespb.MonitoredResourceDescriptor{
+		Type:   "gcs_bucket",
+		Labels: []*label.LabelDescriptor{{Key: "project_id"}, {Key: "bucket_name"}},
+	})
+	assert.Equal(t, []string{"project_id", "bucket_name"}, r.Labels)
+}
+
+func TestFilterEntries(t *testing.T) {
+	entries := filterEntries(getTestDescriptors(), nil)
+	assert.Equal(t, 3, len(entries))
+	// sorted by metric type
+	assert.Equal(t, "bigquery.googleapis.com/query/count", entries[0].Type)
+	entries = filterEntries(getTestDescriptors(), regexp.MustCompile(`^storage\.googleapis\.com/storage/`))
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "storage.googleapis.com/storage/total_bytes", entries[0].Type)
+	assert.Equal(t, "", PrefixFilter(""))
+	assert.Equal(t, `metric.type = starts_with("storage.googleapis.com/")`, PrefixFilter("storage.googleapis.com/"))
+}
+
+func TestWriteEntries(t *testing.T) {
+	entries := filterEntries(getTestDescriptors(), nil)
+	var b bytes.Buffer
+	assert.NoError(t, WriteEntries(&b, entries, TableFormat, "test"))
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	assert.Equal(t, 4, len(lines))
+	assert.True(t, strings.HasPrefix(lines[0], "TYPE"))
+	b.Reset()
+	assert.NoError(t, WriteEntries(&b, entries, JSONFormat, "test"))
+	var fromJSON []Entry
+	assert.NoError(t, json.Unmarshal(b.Bytes(), &fromJSON))
+	assert.Equal(t, entries, fromJSON)
+	b.Reset()
+	assert.NoError(t, WriteEntries(&b, entries, YAMLFormat, "test"))
+	var fromYAML []Entry
+	assert.NoError(t, yaml.Unmarshal(b.Bytes(), &fromYAML))
+	assert.Equal(t, entries, fromYAML)
+	assert.Error(t, WriteEntries(&b, entries, "csv", "test"))
+}
+
+func TestWriteEntriesConfig(t *testing.T) {
+	var b bytes.Buffer
+	assert.NoError(t, WriteEntries(&b, filterEntries(getTestDescriptors(), nil), ConfigFormat, "test"))
+	// the starter config is a valid config file
+	c, err := config.Parse(b.Bytes())
+	assert.NoError(t, err)
+	assert.NoError(t, c.Validate())
+	assert.Equal(t, []string{"test"}, c.Projects)
+	assert.Equal(t, 3, len(c.Metrics))
+	assert.Equal(t, "bigquery.googleapis.com/query/count", c.Metrics[0].Type)
+}
+
+func TestValidateFormat(t *testing.T) {
+	assert.NoError(t, ValidateFormat(TableFormat, false))
+	assert.NoError(t, ValidateFormat(ConfigFormat, true))
+	assert.Error(t, ValidateFormat(ConfigFormat, false))
+	assert.Error(t, ValidateFormat("csv", true))
+}
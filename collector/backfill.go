@@ -0,0 +1,255 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/atomicfile"
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+	"github.com/fernhtls/stackdriverExporter/utils"
+)
+
+// DefaultRetention : time cloud monitoring keeps the points, older points can't be backfilled
+const DefaultRetention = 6 * 7 * 24 * time.Hour
+
+// Backfill : exports the metrics of a project from Start to End to the sink, in windows of Chunk at most
+// the windows end on the multiples of Chunk, so they stay the same on every run whatever the start and end
+// Sink	- sink receiving the windows, like the json output writing the files with the same names as the jobs
+// ProgressFile	- file with the chunks already written, so a backfill stopped is resumed from where it stopped
+// Concurrency	- chunks written at the same time
+// Retention	- time cloud monitoring keeps the points, the start is moved to the oldest point kept
+type Backfill struct {
+	Logger       *log.Logger
+	Sink         utils.Sink
+	Client       *stackdriverClient.StackDriverClient
+	Metrics      []utils.MetricsAndIntervalType
+	Start        time.Time
+	End          time.Time
+	Chunk        time.Duration
+	Concurrency  int
+	Retention    time.Duration
+	ProgressFile string
+}
+
+// chunk of a metric to backfill
+type backfillChunk struct {
+	metric utils.MetricsAndIntervalType
+	window Window
+}
+
+// backfillProgress : chunks already written of every project and metric, persisted in the progress file
+// the chunks are kept as time ranges covered, as the first and last chunks change with a relative start or end
+// projects are kept apart, as backfills of several projects can share the output path and its progress file
+type backfillProgress struct {
+	path   string
+	mu     sync.Mutex
+	chunks map[string]map[string][]Window
+}
+
+// loads the progress of the backfill, a missing file has no chunk written
+func loadBackfillProgress(path string) (*backfillProgress, error) {
+	p := &backfillProgress{
+		path:   path,
+		chunks: make(map[string]map[string][]Window),
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error on reading progress file: %v", err)
+	}
+	if err = json.Unmarshal(content, &p.chunks); err != nil {
+		return nil, fmt.Errorf("error on parsing progress file %s: %v", path, err)
+	}
+	return p, nil
+}
+
+// gets the parts of the window of the metric in the project not covered by the chunks already written, oldest first
+func (p *backfillProgress) remaining(projectID, metricType string, w Window) []Window {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	remaining := []Window{w}
+	for _, chunk := range p.chunks[projectID][metricType] {
+		next := make([]Window, 0, len(remaining)+1)
+		for _, r := range remaining {
+			if !chunk.Start.Before(r.End) || !chunk.End.After(r.Start) {
+				next = append(next, r)
+				continue
+			}
+			if chunk.Start.After(r.Start) {
+				next = append(next, Window{Start: r.Start, End: chunk.Start})
+			}
+			if chunk.End.Before(r.End) {
+				next = append(next, Window{Start: chunk.End, End: r.End})
+			}
+		}
+		remaining = next
+	}
+	return remaining
+}
+
+// marks the chunk of the metric in the project as written, writing the progress file
+func (p *backfillProgress) add(projectID, metricType string, w Window) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.chunks[projectID]; !ok {
+		p.chunks[projectID] = make(map[string][]Window)
+	}
+	p.chunks[projectID][metricType] = append(p.chunks[projectID][metricType], w)
+	content, err := json.MarshalIndent(p.chunks, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(p.path, content)
+}
+
+// Validate : validates the range and the settings of the backfill
+func (b *Backfill) Validate() error {
+	if b.Sink == nil || b.Client == nil {
+		return errors.New("sink and client are mandatory")
+	}
+	if len(b.Metrics) == 0 {
+		return errors.New("at least one metric is mandatory")
+	}
+	if !b.Start.Before(b.End) {
+		return fmt.Errorf("start %s should be before end %s", b.Start, b.End)
+	}
+	if b.Chunk < time.Minute {
+		return errors.New("chunk should be at least 1m")
+	}
+	if b.Concurrency < 1 {
+		return errors.New("concurrency should be at least 1")
+	}
+	if b.ProgressFile == "" {
+		return errors.New("progress file is mandatory")
+	}
+	return nil
+}
+
+// gets the start of the backfill, moved to the oldest point kept by cloud monitoring
+func (b *Backfill) getStartTime(now time.Time) time.Time {
+	retention := b.Retention
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	// a minute of margin, as the oldest points are removed while the backfill runs
+	oldest := now.Add(-retention).Add(time.Minute).Truncate(time.Minute)
+	if b.Start.Before(oldest) {
+		return oldest
+	}
+	return b.Start.Truncate(time.Minute)
+}
+
+// splits the time from start to end in windows ending on the multiples of chunk, only the first and last windows
+// being cut by the start and end
+func getAlignedWindows(start, end time.Time, chunk time.Duration) []Window {
+	windows := make([]Window, 0)
+	for start.Before(end) {
+		windowEnd := start.Truncate(chunk).Add(chunk)
+		if windowEnd.After(end) {
+			windowEnd = end
+		}
+		windows = append(windows, Window{Start: start, End: windowEnd})
+		start = windowEnd
+	}
+	return windows
+}
+
+// gets the chunks of all the metrics not written yet, the parts of the windows already written being skipped
+func (b *Backfill) getChunks(progress *backfillProgress, start time.Time) []backfillChunk {
+	chunks := make([]backfillChunk, 0)
+	for _, m := range b.Metrics {
+		for _, w := range getAlignedWindows(start, b.End.Truncate(time.Minute), b.Chunk) {
+			for _, r := range progress.remaining(b.Client.ProjectID, m.MetricType, w) {
+				chunks = append(chunks, backfillChunk{metric: m, window: r})
+			}
+		}
+	}
+	return chunks
+}
+
+// fetches the chunk, writing it in the sink
+func (b *Backfill) writeChunk(ctx context.Context, chunk backfillChunk) error {
+	b.Logger.Println("getting metrics for project", b.Client.ProjectID, "type metric", chunk.metric.MetricType,
+		"start:", chunk.window.Start, "end:", chunk.window.End)
+	series, err := utils.FetchSeries(ctx, b.Client, chunk.metric, chunk.window.Start, chunk.window.End)
+	if err != nil {
+		return err
+	}
+	return writeBatch(ctx, b.Sink, utils.Batch{
+		ProjectID: b.Client.ProjectID,
+		Metric:    chunk.metric,
+		Start:     chunk.window.Start,
+		End:       chunk.window.End,
+		Series:    series,
+	})
+}
+
+// Run : writes the chunks not written yet, Concurrency at a time
+// chunks failing are logged and left for the next run, returning an error with the number of chunks failed
+// once the context is done no more chunks are started, the chunks in flight being written and saved
+func (b *Backfill) Run(ctx context.Context) error {
+	if err := b.Validate(); err != nil {
+		return err
+	}
+	progress, err := loadBackfillProgress(b.ProgressFile)
+	if err != nil {
+		return err
+	}
+	start := b.getStartTime(time.Now())
+	if start.After(b.Start) {
+		b.Logger.Printf("points before %s are not kept by cloud monitoring, starting the backfill from there\n", start)
+	}
+	chunks := b.getChunks(progress, start)
+	b.Logger.Printf("backfilling %d chunks for project %s\n", len(chunks), b.Client.ProjectID)
+	// the chunks in flight are not cancelled with the context, so they are saved in the progress file
+	writeCtx := context.WithoutCancel(ctx)
+	jobs := make(chan backfillChunk)
+	var failed int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < b.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range jobs {
+				err := b.writeChunk(writeCtx, chunk)
+				if err == nil {
+					err = progress.add(b.Client.ProjectID, chunk.metric.MetricType, chunk.window)
+				}
+				if err != nil {
+					b.Logger.Println(err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	// chunks are not sent anymore once the context is done, the chunks left being written on the next run
+dispatch:
+	for _, chunk := range chunks {
+		select {
+		case <-ctx.Done():
+			break dispatch
+		case jobs <- chunk:
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("backfill stopped, run it again to write the chunks left: %v", err)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d chunks failed, run the backfill again to retry them", failed, len(chunks))
+	}
+	return nil
+}
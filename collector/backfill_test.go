@@ -0,0 +1,180 @@
+package collector
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/fakemonitoring"
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+	"github.com/fernhtls/stackdriverExporter/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackfillValidate(t *testing.T) {
+	start := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+	b := Backfill{
+		Sink:         &testSink{},
+		Client:       &stackdriverClient.StackDriverClient{ProjectID: "deployments-metrics"},
+		Metrics:      []utils.MetricsAndIntervalType{{MetricType: "storage.googleapis.com/storage/object_count"}},
+		Start:        start,
+		End:          start.Add(24 * time.Hour),
+		Chunk:        time.Hour,
+		Concurrency:  4,
+		ProgressFile: "/tmp/progress.json",
+	}
+	assert.NoError(t, b.Validate())
+	b.End = start
+	assert.Error(t, b.Validate())
+	b.End = start.Add(24 * time.Hour)
+	b.Chunk = time.Second
+	assert.Error(t, b.Validate())
+	b.Chunk = time.Hour
+	b.Concurrency = 0
+	assert.Error(t, b.Validate())
+	b.Concurrency = 1
+	b.Metrics = nil
+	assert.Error(t, b.Validate())
+}
+
+func TestBackfillStartTime(t *testing.T) {
+	now := time.Date(2020, 10, 1, 10, 30, 0, 0, time.UTC)
+	b := Backfill{Start: now.Add(-24 * time.Hour)}
+	assert.Equal(t, now.Add(-24*time.Hour), b.getStartTime(now))
+	// moved to the oldest point kept
+	b.Start = now.Add(-60 * 24 * time.Hour)
+	assert.Equal(t, now.Add(-DefaultRetention).Add(time.Minute), b.getStartTime(now))
+	b.Retention = 7 * 24 * time.Hour
+	assert.Equal(t, now.Add(-7*24*time.Hour).Add(time.Minute), b.getStartTime(now))
+}
+
+func TestBackfillChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backfill")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "progress.json")
+	start := time.Date(2020, 10, 1, 0, 0, 0, 0, time.UTC)
+	b := Backfill{
+		Client: &stackdriverClient.StackDriverClient{ProjectID: "deployments-metrics"},
+		Metrics: []utils.MetricsAndIntervalType{
+			{MetricType: "storage.googleapis.com/storage/object_count"},
+			{MetricType: "storage.googleapis.com/storage/total_bytes"},
+		},
+		End:   start.Add(3 * time.Hour),
+		Chunk: time.Hour,
+	}
+	progress, err := loadBackfillProgress(path)
+	assert.NoError(t, err)
+	assert.Len(t, b.getChunks(progress, start), 6)
+	// chunks written are skipped when resuming
+	assert.NoError(t, progress.add("deployments-metrics", "storage.googleapis.com/storage/total_bytes",
+		Window{Start: start, End: start.Add(time.Hour)}))
+	progress, err = loadBackfillProgress(path)
+	assert.NoError(t, err)
+	chunks := b.getChunks(progress, start)
+	assert.Len(t, chunks, 5)
+	for _, chunk := range chunks {
+		assert.False(t, chunk.metric.MetricType == "storage.googleapis.com/storage/total_bytes" && chunk.window.Start.Equal(start))
+	}
+	// the chunks of another project in the same progress file are all left
+	b.Client = &stackdriverClient.StackDriverClient{ProjectID: "billing-metrics"}
+	assert.Len(t, b.getChunks(progress, start), 6)
+}
+
+func TestGetAlignedWindows(t *testing.T) {
+	start := time.Date(2020, 10, 1, 7, 17, 0, 0, time.UTC)
+	// only the first and last windows are cut
+	assert.Equal(t, []Window{
+		{Start: start, End: start.Add(43 * time.Minute)},
+		{Start: start.Add(43 * time.Minute), End: start.Add(103 * time.Minute)},
+		{Start: start.Add(103 * time.Minute), End: start.Add(2 * time.Hour)},
+	}, getAlignedWindows(start, start.Add(2*time.Hour), time.Hour))
+	assert.Empty(t, getAlignedWindows(start, start, time.Hour))
+}
+
+func TestBackfillResumeRelativeStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backfill")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	progress, err := loadBackfillProgress(filepath.Join(dir, "progress.json"))
+	assert.NoError(t, err)
+	metricType := "storage.googleapis.com/storage/object_count"
+	// a start of "3h" and an end of "0s", resolved from now on every run
+	now := time.Date(2020, 10, 1, 10, 17, 0, 0, time.UTC)
+	b := Backfill{
+		Client:  &stackdriverClient.StackDriverClient{ProjectID: "deployments-metrics"},
+		Metrics: []utils.MetricsAndIntervalType{{MetricType: metricType}},
+		End:     now,
+		Chunk:   time.Hour,
+	}
+	chunks := b.getChunks(progress, now.Add(-3*time.Hour))
+	assert.Len(t, chunks, 4)
+	for _, chunk := range chunks {
+		assert.NoError(t, progress.add("deployments-metrics", metricType, chunk.window))
+	}
+	// resumed later, only the time after the last chunk written is left
+	later := now.Add(25 * time.Minute)
+	b.End = later
+	chunks = b.getChunks(progress, later.Add(-3*time.Hour))
+	if assert.Len(t, chunks, 1) {
+		assert.Equal(t, Window{Start: now, End: later}, chunks[0].window)
+	}
+	// a chunk failed in the middle is written again alone
+	written := progress.chunks["deployments-metrics"][metricType]
+	progress.chunks["deployments-metrics"][metricType] = append(written[:1], written[2:]...)
+	chunks = b.getChunks(progress, later.Add(-3*time.Hour))
+	if assert.Len(t, chunks, 2) {
+		assert.Equal(t, Window{Start: now.Add(-137 * time.Minute), End: now.Add(-77 * time.Minute)}, chunks[0].window)
+	}
+}
+
+// sink stopping the backfill on its first write, failing the writes cancelled
+type stoppingSink struct {
+	testSink
+	stop func()
+}
+
+func (s *stoppingSink) Write(ctx context.Context, batch utils.Batch) error {
+	s.stop()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.testSink.Write(ctx, batch)
+}
+
+func TestBackfillRunStopped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backfill")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	_, options := fakemonitoring.NewTestServer(t)
+	client := &stackdriverClient.StackDriverClient{ProjectID: "deployments-metrics", Options: options}
+	assert.NoError(t, client.InitClient())
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sink := &stoppingSink{stop: cancel}
+	now := time.Now()
+	b := Backfill{
+		Logger:       log.New(ioutil.Discard, "", 0),
+		Sink:         sink,
+		Client:       client,
+		Metrics:      []utils.MetricsAndIntervalType{{MetricType: "storage.googleapis.com/storage/object_count"}},
+		Start:        now.Add(-6 * time.Hour),
+		End:          now,
+		Chunk:        time.Hour,
+		Concurrency:  1,
+		ProgressFile: filepath.Join(dir, "progress.json"),
+	}
+	assert.Error(t, b.Run(ctx))
+	// the chunks in flight once stopped are written and saved, the others left for the next run
+	progress, err := loadBackfillProgress(b.ProgressFile)
+	assert.NoError(t, err)
+	written := progress.chunks["deployments-metrics"]["storage.googleapis.com/storage/object_count"]
+	assert.NotEmpty(t, written)
+	assert.Equal(t, len(sink.windows), len(written))
+	assert.NotEmpty(t, b.getChunks(progress, b.getStartTime(now)))
+}
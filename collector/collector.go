@@ -0,0 +1,243 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/selfmetrics"
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+	"github.com/fernhtls/stackdriverExporter/utils"
+)
+
+// DefaultRetryDelay : time waited before writing again a batch failed in a sink
+const DefaultRetryDelay = 5 * time.Second
+
+// Collector : computes the windows of the metrics and fetches them once, feeding every sink the metric is routed to
+// Sinks	- sinks by output type, the metrics being routed to all the sinks when they have no outputs
+// Watermarks	- last end time written of the metrics, nil for fetching only the last cron interval on every run
+// Lag	- time not fetched yet before now, for the points ingested late
+// MaxWindow	- longest window fetched at once, 0 for no limit
+// WriteRetries	- times a batch failed in a sink is written again, RetryDelay apart
+type Collector struct {
+	Logger       *log.Logger
+	Sinks        map[string]utils.Sink
+	Watermarks   *WatermarkStore
+	Lag          time.Duration
+	MaxWindow    time.Duration
+	WriteRetries int
+	RetryDelay   time.Duration
+}
+
+// splits the time from start to end in windows of maxWindow at most, no window when end is not after start
+func getExportWindows(start, end time.Time, maxWindow time.Duration) []Window {
+	windows := make([]Window, 0)
+	for start.Before(end) {
+		windowEnd := end
+		if maxWindow > 0 && windowEnd.Sub(start) > maxWindow {
+			windowEnd = start.Add(maxWindow)
+		}
+		windows = append(windows, Window{Start: start, End: windowEnd})
+		start = windowEnd
+	}
+	return windows
+}
+
+// gets the output types of the sinks the metric is routed to, sorted
+func (c *Collector) getSinkNames(m utils.MetricsAndIntervalType) []string {
+	names := make([]string, 0, len(c.Sinks))
+	for name := range c.Sinks {
+		if m.RoutedTo(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// gets the start of the next fetch of the metric, its watermark or one cron interval before the end
+// when the metric was never fetched
+func (c *Collector) getStartTime(projectID string, m utils.MetricsAndIntervalType, end time.Time) (time.Time, error) {
+	if c.Watermarks != nil {
+		if watermark, ok := c.Watermarks.Get(projectID, m.MetricType); ok {
+			return watermark, nil
+		}
+	}
+	period, err := utils.GetCronPeriod(m.Interval, end)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return end.Add(-period), nil
+}
+
+// gets the delay of the points of the metric, its ingestion delay or the lag of the collector when not set
+func (c *Collector) getIngestionDelay(m utils.MetricsAndIntervalType) time.Duration {
+	if m.IngestionDelay > 0 {
+		return m.IngestionDelay
+	}
+	return c.Lag
+}
+
+// gets the last windows of the metric fetched on the previous runs, to fetch again with the late points
+func (c *Collector) getRefetchWindows(projectID string, m utils.MetricsAndIntervalType) []Window {
+	if c.Watermarks == nil || m.RefetchWindows <= 0 {
+		return nil
+	}
+	windows := c.Watermarks.Windows(projectID, m.MetricType)
+	if len(windows) > m.RefetchWindows {
+		windows = windows[len(windows)-m.RefetchWindows:]
+	}
+	return windows
+}
+
+// writes the batch in the sink and flushes it, so it's written once returning
+func writeBatch(ctx context.Context, sink utils.Sink, batch utils.Batch) error {
+	if err := sink.Write(ctx, batch); err != nil {
+		return err
+	}
+	return sink.Flush(ctx)
+}
+
+// writes the batch in the sink, writing it again WriteRetries times on errors
+func (c *Collector) writeSink(ctx context.Context, name string, batch utils.Batch) error {
+	for retry := 0; ; retry++ {
+		err := writeBatch(ctx, c.Sinks[name], batch)
+		if err == nil || retry >= c.WriteRetries || ctx.Err() != nil {
+			return err
+		}
+		c.Logger.Println(fmt.Errorf("error on writing metric %s to %s, retrying: %v", batch.Metric.MetricType, name, err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.RetryDelay):
+		}
+	}
+}
+
+// writes the batch in all the sinks, a sink failing doesn't stop the others
+func (c *Collector) write(ctx context.Context, sinkNames []string, batch utils.Batch) error {
+	failed := make([]string, 0)
+	for _, name := range sinkNames {
+		if err := c.writeSink(ctx, name, batch); err != nil {
+			c.Logger.Println(fmt.Errorf("error on writing metric %s to %s: %v", batch.Metric.MetricType, name, err))
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("error on writing window %s - %s to %s", batch.Start, batch.End, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// fetches the window of the metric once, writing it in all the sinks
+// refetch marks the windows of the previous runs fetched again, for the sinks keeping only the latest points
+func (c *Collector) collectWindow(ctx context.Context, client *stackdriverClient.StackDriverClient,
+	m utils.MetricsAndIntervalType, sinkNames []string, w Window, refetch bool) error {
+	c.Logger.Println("getting metrics for project", client.ProjectID, "type metric", m.MetricType,
+		"start:", w.Start, "end:", w.End)
+	series, err := utils.FetchSeries(ctx, client, m, w.Start, w.End)
+	if err != nil {
+		return err
+	}
+	return c.write(ctx, sinkNames, utils.Batch{
+		ProjectID: client.ProjectID,
+		Metric:    m,
+		Start:     w.Start,
+		End:       w.End,
+		Series:    series,
+		Refetch:   refetch,
+	})
+}
+
+// Collect : fetches the metric from its watermark to now minus its ingestion delay, in windows of MaxWindow at most,
+// every window feeding all the sinks of the metric and moving the watermark once written and flushed in all of them
+// the last RefetchWindows windows of the previous runs are then fetched again, for the late points
+// errors are logged and stop only the run for the project and metric, the next run retrying from the watermark
+func (c *Collector) Collect(ctx context.Context, client *stackdriverClient.StackDriverClient,
+	m utils.MetricsAndIntervalType) {
+	metric := m.MetricType
+	sinkNames := c.getSinkNames(m)
+	if len(sinkNames) == 0 {
+		return
+	}
+	defer selfmetrics.ObserveCollectionDuration(strings.Join(sinkNames, ","), metric, time.Now())
+	if c.Watermarks != nil {
+		unlock, err := c.Watermarks.lock(ctx, client.ProjectID, metric)
+		if err != nil {
+			c.Logger.Println(fmt.Errorf("run of metric %s for project %s stopped waiting for the previous run: %v",
+				metric, client.ProjectID, err))
+			return
+		}
+		defer unlock()
+	}
+	end := time.Now().Add(-c.getIngestionDelay(m)).Truncate(time.Minute)
+	start, err := c.getStartTime(client.ProjectID, m, end)
+	if err != nil {
+		c.Logger.Println(fmt.Errorf("error on getting start and end time : %v", err))
+		return
+	}
+	windows := getExportWindows(start, end, c.MaxWindow)
+	if len(windows) == 0 {
+		return
+	}
+	refetchWindows := c.getRefetchWindows(client.ProjectID, m)
+	for _, w := range windows {
+		if err := c.collectWindow(ctx, client, m, sinkNames, w, false); err != nil {
+			c.Logger.Println(err)
+			return
+		}
+		if c.Watermarks == nil {
+			continue
+		}
+		if err := c.Watermarks.Set(client.ProjectID, metric, w, m.RefetchWindows); err != nil {
+			c.Logger.Println(fmt.Errorf("error on writing state file : %v", err))
+			return
+		}
+	}
+	for _, w := range refetchWindows {
+		c.Logger.Println("re-fetching late points for project", client.ProjectID, "type metric", metric)
+		if err := c.collectWindow(ctx, client, m, sinkNames, w, true); err != nil {
+			c.Logger.Println(err)
+			return
+		}
+	}
+}
+
+// CatchUp : fetches the windows missed since the watermarks of the metrics, as while the exporter was stopped
+// metrics never fetched wait for their first run
+func (c *Collector) CatchUp(ctx context.Context, client *stackdriverClient.StackDriverClient,
+	metrics []utils.MetricsAndIntervalType) {
+	if c.Watermarks == nil {
+		return
+	}
+	for _, m := range metrics {
+		if _, ok := c.Watermarks.Get(client.ProjectID, m.MetricType); !ok {
+			continue
+		}
+		c.Logger.Println("catching up metrics for project", client.ProjectID, "type metric", m.MetricType)
+		c.Collect(ctx, client, m)
+	}
+}
+
+// Close : closes all the sinks, flushing the batches buffered
+func (c *Collector) Close() error {
+	names := make([]string, 0, len(c.Sinks))
+	for name := range c.Sinks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	failed := make([]string, 0)
+	for _, name := range names {
+		if err := c.Sinks[name].Close(); err != nil {
+			c.Logger.Println(fmt.Errorf("error on closing %s: %v", name, err))
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("error on closing %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/fakemonitoring"
+	"github.com/fernhtls/stackdriverExporter/jsonoutput"
+	"github.com/fernhtls/stackdriverExporter/prometheusOutput"
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+	"github.com/fernhtls/stackdriverExporter/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// sink keeping the windows written, failing while err is set or for the next failures writes
+type testSink struct {
+	err      error
+	failures int
+	writes   int
+	windows  []Window
+	series   int
+	flushes  int
+	closed   bool
+}
+
+func (s *testSink) Write(ctx context.Context, batch utils.Batch) error {
+	s.writes++
+	if s.err != nil {
+		return s.err
+	}
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("unavailable")
+	}
+	s.windows = append(s.windows, Window{Start: batch.Start, End: batch.End})
+	s.series += len(batch.Series)
+	return nil
+}
+
+func (s *testSink) Flush(ctx context.Context) error {
+	s.flushes++
+	return nil
+}
+
+func (s *testSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestGetExportWindows(t *testing.T) {
+	start := time.Date(2020, 10, 1, 10, 0, 0, 0, time.UTC)
+	// windows split by the max window, the last one ending at the end
+	windows := getExportWindows(start, start.Add(150*time.Minute), time.Hour)
+	assert.Equal(t, []Window{
+		{Start: start, End: start.Add(time.Hour)},
+		{Start: start.Add(time.Hour), End: start.Add(2 * time.Hour)},
+		{Start: start.Add(2 * time.Hour), End: start.Add(150 * time.Minute)},
+	}, windows)
+	// no max window
+	windows = getExportWindows(start, start.Add(150*time.Minute), 0)
+	assert.Equal(t, []Window{{Start: start, End: start.Add(150 * time.Minute)}}, windows)
+	// nothing to export when the watermark is already at the end
+	assert.Empty(t, getExportWindows(start, start, time.Hour))
+	assert.Empty(t, getExportWindows(start, start.Add(-time.Minute), time.Hour))
+}
+
+func TestGetStartTime(t *testing.T) {
+	end := time.Date(2020, 10, 1, 10, 0, 0, 0, time.UTC)
+	m := utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/object_count", Interval: "*/5 * * * *"}
+	// no watermark, one cron interval before the end
+	c := Collector{}
+	start, err := c.getStartTime("deployments-metrics", m, end)
+	assert.NoError(t, err)
+	assert.Equal(t, end.Add(-5*time.Minute), start)
+	// from the watermark
+	dir, err := ioutil.TempDir("", "watermarks")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c.Watermarks, err = LoadWatermarks(filepath.Join(dir, "state.json"))
+	assert.NoError(t, err)
+	assert.NoError(t, c.Watermarks.Set("deployments-metrics", m.MetricType,
+		Window{Start: end.Add(-4 * time.Hour), End: end.Add(-3 * time.Hour)}, 0))
+	start, err = c.getStartTime("deployments-metrics", m, end)
+	assert.NoError(t, err)
+	assert.Equal(t, end.Add(-3*time.Hour), start)
+	// invalid cron expression
+	m.Interval = "every minute"
+	_, err = c.getStartTime("billing-metrics", m, end)
+	assert.Error(t, err)
+}
+
+func TestGetSinkNames(t *testing.T) {
+	c := Collector{Sinks: map[string]utils.Sink{"json": &testSink{}, "prometheus": &testSink{}}}
+	m := utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/object_count"}
+	// all the sinks without outputs
+	assert.Equal(t, []string{"json", "prometheus"}, c.getSinkNames(m))
+	m.Outputs = []string{"prometheus"}
+	assert.Equal(t, []string{"prometheus"}, c.getSinkNames(m))
+	m.Outputs = []string{"bigquery"}
+	assert.Empty(t, c.getSinkNames(m))
+}
+
+func TestWriteSinks(t *testing.T) {
+	jsonSink, prometheusSink := &testSink{}, &testSink{}
+	c := Collector{
+		Logger: log.New(ioutil.Discard, "", 0),
+		Sinks:  map[string]utils.Sink{"json": jsonSink, "prometheus": prometheusSink},
+	}
+	m := utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/object_count"}
+	start := time.Date(2020, 10, 1, 10, 0, 0, 0, time.UTC)
+	batch := utils.Batch{
+		ProjectID: "deployments-metrics",
+		Metric:    m,
+		Start:     start,
+		End:       start.Add(time.Hour),
+		Series:    []*monitoringpb.TimeSeries{{}, {}},
+	}
+	w := Window{Start: batch.Start, End: batch.End}
+	// the series fetched once feed all the sinks, flushed once written
+	assert.NoError(t, c.write(context.Background(), c.getSinkNames(m), batch))
+	assert.Equal(t, []Window{w}, jsonSink.windows)
+	assert.Equal(t, []Window{w}, prometheusSink.windows)
+	assert.Equal(t, 2, prometheusSink.series)
+	assert.Equal(t, 1, jsonSink.flushes)
+	// a sink failing doesn't stop the others
+	jsonSink.err = errors.New("disk full")
+	err := c.write(context.Background(), c.getSinkNames(m), batch)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "json")
+	assert.Equal(t, 2, len(prometheusSink.windows))
+	// closing all the sinks
+	assert.NoError(t, c.Close())
+	assert.True(t, jsonSink.closed)
+	assert.True(t, prometheusSink.closed)
+}
+
+func TestWriteSinkRetries(t *testing.T) {
+	sink := &testSink{failures: 2}
+	c := Collector{
+		Logger:       log.New(ioutil.Discard, "", 0),
+		Sinks:        map[string]utils.Sink{"json": sink},
+		WriteRetries: 2,
+		RetryDelay:   time.Millisecond,
+	}
+	batch := utils.Batch{ProjectID: "deployments-metrics", Metric: utils.MetricsAndIntervalType{MetricType: "test"}}
+	// written on the last retry
+	assert.NoError(t, c.writeSink(context.Background(), "json", batch))
+	assert.Equal(t, 3, sink.writes)
+	assert.Equal(t, 1, len(sink.windows))
+	// failing after all the retries
+	sink.failures, sink.writes = 3, 0
+	assert.Error(t, c.writeSink(context.Background(), "json", batch))
+	assert.Equal(t, 3, sink.writes)
+	// no retry once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sink.failures, sink.writes = 1, 0
+	assert.Error(t, c.writeSink(ctx, "json", batch))
+	assert.Equal(t, 1, sink.writes)
+}
+
+// gets the value of the gauge of the series with the label value, from the default registry
+func getGaugeValue(t *testing.T, name, labelName, labelValue string) (float64, bool) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	assert.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == labelName && label.GetValue() == labelValue {
+					return metric.GetGauge().GetValue(), true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+// starts the fake server with the fixtures ending one minute ago, returning a client connected to it and a collector
+// writing in json in the directory and in prometheus
+func newFakeCollector(t *testing.T, dir string) (*fakemonitoring.Server, *stackdriverClient.StackDriverClient,
+	*Collector) {
+	server, options := fakemonitoring.NewTestServer(t)
+	client := &stackdriverClient.StackDriverClient{
+		ProjectID: "deployments-metrics",
+		Options:   options,
+	}
+	assert.NoError(t, client.InitClient())
+	promOutput := prometheusOutput.OutputConfig{ProjectIDs: []string{"deployments-metrics"}}
+	promSink, err := promOutput.NewSink([]*stackdriverClient.StackDriverClient{client})
+	assert.NoError(t, err)
+	return server, client, &Collector{
+		Logger: log.New(ioutil.Discard, "", 0),
+		Sinks: map[string]utils.Sink{
+			"json":       &jsonoutput.JSONOutput{Logger: log.New(ioutil.Discard, "", 0), OutputPath: dir},
+			"prometheus": promSink,
+		},
+	}
+}
+
+func TestCollectFakeServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collector")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	_, client, c := newFakeCollector(t, dir)
+	defer client.Close()
+	m := utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/object_count", Interval: "*/5 * * * *"}
+	c.Collect(context.Background(), client, m)
+	// one file for the window, with the latest point of every series
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(files)) {
+		content, err := ioutil.ReadFile(files[0])
+		assert.NoError(t, err)
+		assert.Contains(t, string(content), "prod-assets")
+		assert.Contains(t, string(content), "dev-assets")
+		assert.Contains(t, string(content), "1204")
+		assert.NotContains(t, string(content), "1198")
+	}
+	// gauges registered from the descriptors of the server and set to the latest points
+	name := "stackdriver_storage_googleapis_storage_object_count_gcs_bucket"
+	value, ok := getGaugeValue(t, name, "bucket_name", "prod-assets")
+	assert.True(t, ok)
+	assert.Equal(t, float64(1204), value)
+	value, ok = getGaugeValue(t, name, "bucket_name", "prod-backups")
+	assert.True(t, ok)
+	assert.Equal(t, float64(87), value)
+	// the gauges are unregistered once the sinks are closed
+	assert.NoError(t, c.Close())
+	_, ok = getGaugeValue(t, name, "bucket_name", "prod-assets")
+	assert.False(t, ok)
+}
+
+func TestCollectRefetchFakeServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "collector")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	_, client, c := newFakeCollector(t, dir)
+	defer client.Close()
+	m := utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/object_count", Interval: "*/5 * * * *",
+		RefetchWindows: 1}
+	// the previous window, with the points before the latest ones, is fetched again after the new window
+	c.Watermarks, err = LoadWatermarks(filepath.Join(dir, "state.json"))
+	assert.NoError(t, err)
+	end := time.Now().Truncate(time.Minute)
+	previous := Window{Start: end.Add(-10 * time.Minute), End: end.Add(-5 * time.Minute)}
+	assert.NoError(t, c.Watermarks.Set(client.ProjectID, m.MetricType, previous, m.RefetchWindows))
+	c.Collect(context.Background(), client, m)
+	files, err := filepath.Glob(filepath.Join(dir, "*_*.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(files))
+	// the gauges keep the latest points
+	value, ok := getGaugeValue(t, "stackdriver_storage_googleapis_storage_object_count_gcs_bucket",
+		"bucket_name", "prod-assets")
+	assert.True(t, ok)
+	assert.Equal(t, float64(1204), value)
+	assert.NoError(t, c.Close())
+}
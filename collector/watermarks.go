@@ -0,0 +1,127 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/atomicfile"
+)
+
+// Window : window of points exported in a file, from Start to End
+type Window struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// state of the metric, its watermark with its last windows exported for the re-fetches
+type metricState struct {
+	Watermark time.Time `json:"watermark"`
+	Windows   []Window  `json:"windows,omitempty"`
+}
+
+// WatermarkStore : last exported end time of every project and metric, persisted in the state file
+// the next export of the metric starts at its watermark, so the json files have no gaps or overlaps
+type WatermarkStore struct {
+	path       string
+	mu         sync.Mutex
+	watermarks map[string]map[string]metricState
+	locks      map[string]chan struct{}
+}
+
+// LoadWatermarks : loads the watermarks from the state file, a missing file has no watermarks
+func LoadWatermarks(path string) (*WatermarkStore, error) {
+	w := &WatermarkStore{
+		path:       path,
+		watermarks: make(map[string]map[string]metricState),
+		locks:      make(map[string]chan struct{}),
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return w, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error on reading state file: %v", err)
+	}
+	if err = json.Unmarshal(content, &w.watermarks); err != nil {
+		return nil, fmt.Errorf("error on parsing state file %s: %v", path, err)
+	}
+	return w, nil
+}
+
+// Get : gets the watermark of the metric in the project, false when the metric was never exported
+func (w *WatermarkStore) Get(projectID, metricType string) (time.Time, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	state, ok := w.watermarks[projectID][metricType]
+	return state.Watermark, ok
+}
+
+// Windows : gets the last windows exported of the metric in the project, oldest first
+func (w *WatermarkStore) Windows(projectID, metricType string) []Window {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]Window(nil), w.watermarks[projectID][metricType].Windows...)
+}
+
+// Set : sets the watermark of the metric in the project to the end of the window exported, writing the state file
+// the last keep windows are kept for the re-fetches
+func (w *WatermarkStore) Set(projectID, metricType string, window Window, keep int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.watermarks[projectID]; !ok {
+		w.watermarks[projectID] = make(map[string]metricState)
+	}
+	previous, existed := w.watermarks[projectID][metricType]
+	state := metricState{Watermark: window.End}
+	if keep > 0 {
+		windows := append(append([]Window(nil), previous.Windows...), window)
+		if len(windows) > keep {
+			windows = windows[len(windows)-keep:]
+		}
+		state.Windows = windows
+	}
+	w.watermarks[projectID][metricType] = state
+	if err := w.write(); err != nil {
+		// keeps the watermark of the state file, so the window is exported again
+		if existed {
+			w.watermarks[projectID][metricType] = previous
+		} else {
+			delete(w.watermarks[projectID], metricType)
+		}
+		return err
+	}
+	return nil
+}
+
+// locks the exports of the metric in the project, returning the unlock function
+// a run of the metric waits for the previous one, starting from its watermark, or until the context is done
+func (w *WatermarkStore) lock(ctx context.Context, projectID, metricType string) (func(), error) {
+	w.mu.Lock()
+	key := projectID + "|" + metricType
+	l, ok := w.locks[key]
+	if !ok {
+		l = make(chan struct{}, 1)
+		w.locks[key] = l
+	}
+	w.mu.Unlock()
+	select {
+	case l <- struct{}{}:
+		return func() { <-l }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// writes the state file
+func (w *WatermarkStore) write() error {
+	content, err := json.MarshalIndent(w.watermarks, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(w.path, content)
+}
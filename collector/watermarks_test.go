@@ -0,0 +1,98 @@
+package collector
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatermarkStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watermarks")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	w, err := LoadWatermarks(path)
+	assert.NoError(t, err)
+	_, ok := w.Get("deployments-metrics", "storage.googleapis.com/storage/object_count")
+	assert.False(t, ok)
+	watermark := time.Date(2020, 10, 1, 10, 0, 0, 0, time.UTC)
+	assert.NoError(t, w.Set("deployments-metrics", "storage.googleapis.com/storage/object_count",
+		Window{Start: watermark.Add(-time.Hour), End: watermark}, 0))
+	// watermarks persisted in the state file
+	w, err = LoadWatermarks(path)
+	assert.NoError(t, err)
+	got, ok := w.Get("deployments-metrics", "storage.googleapis.com/storage/object_count")
+	assert.True(t, ok)
+	assert.True(t, watermark.Equal(got))
+	_, ok = w.Get("billing-metrics", "storage.googleapis.com/storage/object_count")
+	assert.False(t, ok)
+}
+
+func TestWatermarkStoreWindows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watermarks")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	w, err := LoadWatermarks(path)
+	assert.NoError(t, err)
+	start := time.Date(2020, 10, 1, 10, 0, 0, 0, time.UTC)
+	windows := make([]Window, 0)
+	for i := 0; i < 4; i++ {
+		window := Window{Start: start.Add(time.Duration(i) * time.Hour), End: start.Add(time.Duration(i+1) * time.Hour)}
+		windows = append(windows, window)
+		assert.NoError(t, w.Set("deployments-metrics", "storage.googleapis.com/storage/object_count", window, 2))
+	}
+	// only the last windows are kept, persisted in the state file
+	w, err = LoadWatermarks(path)
+	assert.NoError(t, err)
+	got := w.Windows("deployments-metrics", "storage.googleapis.com/storage/object_count")
+	assert.Len(t, got, 2)
+	assert.True(t, windows[2].Start.Equal(got[0].Start))
+	assert.True(t, windows[3].End.Equal(got[1].End))
+	// windows not kept without re-fetches
+	assert.NoError(t, w.Set("deployments-metrics", "storage.googleapis.com/storage/object_count",
+		Window{Start: start.Add(4 * time.Hour), End: start.Add(5 * time.Hour)}, 0))
+	assert.Empty(t, w.Windows("deployments-metrics", "storage.googleapis.com/storage/object_count"))
+}
+
+func TestWatermarkStoreErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watermarks")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("not json"), 0644))
+	_, err = LoadWatermarks(path)
+	assert.Error(t, err)
+	// watermark not moved when the state file can't be written
+	w, err := LoadWatermarks(filepath.Join(dir, "missing", "state.json"))
+	assert.NoError(t, err)
+	assert.Error(t, w.Set("deployments-metrics", "storage.googleapis.com/storage/object_count",
+		Window{Start: time.Now().Add(-time.Hour), End: time.Now()}, 0))
+	_, ok := w.Get("deployments-metrics", "storage.googleapis.com/storage/object_count")
+	assert.False(t, ok)
+}
+
+func TestWatermarkStoreLock(t *testing.T) {
+	w, err := LoadWatermarks(filepath.Join(os.TempDir(), "missing", "state.json"))
+	assert.NoError(t, err)
+	unlock, err := w.lock(context.Background(), "deployments-metrics", "storage.googleapis.com/storage/object_count")
+	assert.NoError(t, err)
+	// a run of another metric doesn't wait
+	unlockOther, err := w.lock(context.Background(), "deployments-metrics", "storage.googleapis.com/storage/total_bytes")
+	assert.NoError(t, err)
+	unlockOther()
+	// a run of the same metric stops waiting once its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = w.lock(ctx, "deployments-metrics", "storage.googleapis.com/storage/object_count")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	unlock()
+	unlock, err = w.lock(context.Background(), "deployments-metrics", "storage.googleapis.com/storage/object_count")
+	assert.NoError(t, err)
+	unlock()
+}
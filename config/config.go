@@ -0,0 +1,556 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/prometheusOutput"
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+	"github.com/fernhtls/stackdriverExporter/utils"
+	"github.com/gorhill/cronexpr"
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// CurrentVersion : version of the config file schema
+const CurrentVersion = 1
+
+// output types of the config
+const (
+	JSONOutputType       = "json"
+	PrometheusOutputType = "prometheus"
+)
+
+// default intervals of the metrics, when no interval or schedule is set
+const (
+	defaultJSONSchedule       = "*/10 * * * *"
+	defaultPrometheusInterval = time.Minute
+)
+
+// Config : config of the exporter, loaded from a yaml or json file and overridden by the flags
+// Version	- version of the schema, CurrentVersion
+// Projects	- projects to collect the metrics from, or MetricsScope for all the projects of a metrics scope
+// StatusFile	- optional json file where the self metrics are written every minute
+// ShutdownTimeout	- time waited on SIGINT or SIGTERM for the running jobs to finish, before cancelling them
+type Config struct {
+	Version         int             `yaml:"version"`
+	Projects        []string        `yaml:"projects"`
+	MetricsScope    string          `yaml:"metrics_scope"`
+	Output          OutputConfig    `yaml:"output"`
+	Discovery       DiscoveryConfig `yaml:"discovery"`
+	StatusFile      string          `yaml:"status_file"`
+	ShutdownTimeout time.Duration   `yaml:"shutdown_timeout"`
+	Metrics         []MetricConfig  `yaml:"metrics"`
+}
+
+// OutputConfig : outputs of the metrics, json files and / or prometheus endpoint
+// Type	- output type, or output types separated by comma like "json,prometheus" to feed all of them
+// with the same series
+// WriteRetries	- times a window failed in an output is written again, json output only
+// CallTimeout	- timeout of every api call, 0 for no timeout
+// JobTimeout	- deadline of a whole run of a metric job, json output only, 0 for running until the next cron tick
+// APIRetries	- times an api call failing with a transient error is made again, APIRetryBackoff doubling up to
+// APIMaxRetryBackoff between them
+// ReadRequestsPerMinute	- read requests to the api per minute shared by all the jobs, 0 for no limit
+type OutputConfig struct {
+	Type                  string           `yaml:"type"`
+	WriteRetries          int              `yaml:"write_retries"`
+	CallTimeout           time.Duration    `yaml:"call_timeout"`
+	JobTimeout            time.Duration    `yaml:"job_timeout"`
+	APIRetries            int              `yaml:"api_retries"`
+	APIRetryBackoff       time.Duration    `yaml:"api_retry_backoff"`
+	APIMaxRetryBackoff    time.Duration    `yaml:"api_max_retry_backoff"`
+	ReadRequestsPerMinute int              `yaml:"read_requests_per_minute"`
+	JSON                  JSONConfig       `yaml:"json"`
+	Prometheus            PrometheusConfig `yaml:"prometheus"`
+}
+
+// JSONConfig : settings of the json output
+// Path	- directory where the json files are written
+// StateFile	- file with the watermarks of the metrics, ".stackdriver_exporter_state.json" in the path when empty
+// Lag	- time not exported yet before now, for the points ingested late
+// MaxWindow	- longest window written in a file, as when catching up after a stop
+type JSONConfig struct {
+	Path      string        `yaml:"path"`
+	StateFile string        `yaml:"state_file"`
+	Lag       time.Duration `yaml:"lag"`
+	MaxWindow time.Duration `yaml:"max_window"`
+}
+
+// DefaultStateFileName : name of the state file in the json output path, when not set
+const DefaultStateFileName = ".stackdriver_exporter_state.json"
+
+// GetStateFile : gets the state file of the json output, in the output path when not set
+func (j JSONConfig) GetStateFile() string {
+	if j.StateFile != "" {
+		return j.StateFile
+	}
+	return filepath.Join(j.Path, DefaultStateFileName)
+}
+
+// PrometheusConfig : settings of the prometheus output and its http server
+// MetadataLabels	- system / user metadata labels as "system:key" or "user:key"
+type PrometheusConfig struct {
+	Mode           string        `yaml:"mode"`
+	ListenAddress  string        `yaml:"listen_address"`
+	Port           int           `yaml:"port"`
+	Path           string        `yaml:"path"`
+	WebConfigFile  string        `yaml:"web_config_file"`
+	Lookback       time.Duration `yaml:"lookback"`
+	PollJitter     time.Duration `yaml:"poll_jitter"`
+	ScrapeCacheTTL time.Duration `yaml:"scrape_cache_ttl"`
+	MetadataLabels []string      `yaml:"metadata_labels"`
+}
+
+// DiscoveryConfig : expansion of the metric type patterns
+// Interval	- interval to expand again the patterns, 0 expands only on start
+// Excludes	- regular expressions of metric types left out
+type DiscoveryConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	Excludes []string      `yaml:"excludes"`
+}
+
+// MetricConfig : metric to collect
+// Type	- metric type, or a pattern like "storage.googleapis.com/*"
+// Interval	- interval between two collections, in whole minutes
+// Schedule	- cron expression of the collections, json output only, instead of the interval
+// Lookback	- window queried for the latest points in prometheus output, overrides the output lookback
+// IngestionDelay	- time the points take to be ingested, the query window ending that long before now
+// (overrides the lag of the json output)
+// RefetchWindows	- number of previous windows queried again for the points ingested late, replacing their json files
+// or updating the prometheus values
+// Outputs	- output types the metric is routed to, all the outputs when empty
+// CallTimeout	- timeout of every api call of the metric, overrides the output call timeout
+// Timeout	- deadline of a whole run of the metric job, overrides the output job timeout
+type MetricConfig struct {
+	Type           string             `yaml:"type"`
+	Interval       time.Duration      `yaml:"interval"`
+	Schedule       string             `yaml:"schedule"`
+	Filter         string             `yaml:"filter"`
+	Aggregation    *AggregationConfig `yaml:"aggregation"`
+	Lookback       time.Duration      `yaml:"lookback"`
+	IngestionDelay time.Duration      `yaml:"ingestion_delay"`
+	RefetchWindows int                `yaml:"refetch_windows"`
+	Outputs        []string           `yaml:"outputs"`
+	CallTimeout    time.Duration      `yaml:"call_timeout"`
+	Timeout        time.Duration      `yaml:"timeout"`
+}
+
+// AggregationConfig : server side aggregation of the metric
+type AggregationConfig struct {
+	AlignmentPeriod    time.Duration `yaml:"alignment_period"`
+	PerSeriesAligner   string        `yaml:"per_series_aligner"`
+	CrossSeriesReducer string        `yaml:"cross_series_reducer"`
+	GroupByFields      []string      `yaml:"group_by_fields"`
+}
+
+// ValidationError : errors of the config, with the location of every error
+type ValidationError struct {
+	Errors []string
+}
+
+func (v *ValidationError) Error() string {
+	return "config is not valid:\n  " + strings.Join(v.Errors, "\n  ")
+}
+
+// adds the error at the location
+func (v *ValidationError) add(location string, format string, args ...interface{}) {
+	v.Errors = append(v.Errors, location+": "+fmt.Sprintf(format, args...))
+}
+
+// Default : config with the default settings, before loading the file and the flags
+func Default() *Config {
+	return &Config{
+		Version: CurrentVersion,
+		Output: OutputConfig{
+			Type:               JSONOutputType,
+			WriteRetries:       2,
+			CallTimeout:        time.Minute,
+			APIRetries:         stackdriverClient.DefaultRetryPolicy.MaxRetries,
+			APIRetryBackoff:    stackdriverClient.DefaultRetryPolicy.InitialBackoff,
+			APIMaxRetryBackoff: stackdriverClient.DefaultRetryPolicy.MaxBackoff,
+			JSON: JSONConfig{
+				MaxWindow: time.Hour,
+			},
+			Prometheus: PrometheusConfig{
+				Mode:           prometheusOutput.PollMode,
+				Port:           8081,
+				Path:           "/stackmetrics",
+				Lookback:       10 * time.Minute,
+				PollJitter:     time.Minute,
+				ScrapeCacheTTL: time.Minute,
+			},
+		},
+		Discovery: DiscoveryConfig{
+			Interval: time.Hour,
+		},
+		ShutdownTimeout: 30 * time.Second,
+	}
+}
+
+// Load : loads the config file over the default settings
+func Load(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error on reading config file: %v", err)
+	}
+	c, err := Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("error on parsing config file %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// Parse : parses the yaml or json config over the default settings, unknown fields are errors
+func Parse(content []byte) (*Config, error) {
+	c := Default()
+	c.Version = 0
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return nil, err
+	}
+	if c.Version == 0 {
+		return nil, errors.New("version: version of the config is mandatory")
+	}
+	return c, nil
+}
+
+// OutputTypes : gets the output types of the config, in the order of the type
+func (c *Config) OutputTypes() []string {
+	types := make([]string, 0)
+	for _, t := range strings.Split(c.Output.Type, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// HasOutput : checks if the output type is one of the outputs of the config
+func (c *Config) HasOutput(outputType string) bool {
+	for _, t := range c.OutputTypes() {
+		if t == outputType {
+			return true
+		}
+	}
+	return false
+}
+
+// validates the output types and the settings of every output
+func (c *Config) validateOutputs(v *ValidationError) {
+	types := c.OutputTypes()
+	if len(types) == 0 {
+		v.add("output.type", "at least one output type is mandatory")
+	}
+	if c.Output.WriteRetries < 0 {
+		v.add("output.write_retries", "write retries can't be negative")
+	}
+	if c.Output.CallTimeout < 0 {
+		v.add("output.call_timeout", "call timeout can't be negative")
+	}
+	if c.Output.JobTimeout < 0 {
+		v.add("output.job_timeout", "job timeout can't be negative")
+	}
+	if c.Output.APIRetries < 0 {
+		v.add("output.api_retries", "api retries can't be negative")
+	}
+	if c.Output.APIRetryBackoff < 0 || c.Output.APIMaxRetryBackoff < c.Output.APIRetryBackoff {
+		v.add("output.api_retry_backoff", "api retry backoff can't be negative nor longer than api_max_retry_backoff")
+	}
+	if c.Output.ReadRequestsPerMinute < 0 {
+		v.add("output.read_requests_per_minute", "read requests per minute can't be negative")
+	}
+	seen := make(map[string]bool, len(types))
+	for _, t := range types {
+		if seen[t] {
+			v.add("output.type", "output type %q is repeated", t)
+			continue
+		}
+		seen[t] = true
+		switch t {
+		case JSONOutputType:
+			if c.Output.JSON.Path == "" {
+				v.add("output.json.path", "path is mandatory for json output")
+			}
+			if c.Output.JSON.Lag < 0 {
+				v.add("output.json.lag", "lag can't be negative")
+			}
+			if c.Output.JSON.MaxWindow < time.Minute {
+				v.add("output.json.max_window", "max_window should be at least 1m")
+			}
+		case PrometheusOutputType:
+			if _, err := c.PrometheusOutputConfig(); err != nil {
+				v.add("output.prometheus", "%v", err)
+			}
+			// series are fed by the other outputs fetches, not queried when scraped
+			if len(types) > 1 && c.Output.Prometheus.Mode == prometheusOutput.ScrapeMode {
+				v.add("output.prometheus.mode", "scrape mode can't be used with other outputs")
+			}
+		default:
+			v.add("output.type", "output type %q is not valid, should be json or prometheus", t)
+		}
+	}
+}
+
+// Validate : validates the whole config, returning a ValidationError with all the errors found
+func (c *Config) Validate() error {
+	v := &ValidationError{}
+	if c.Version != CurrentVersion {
+		v.add("version", "version %d is not supported, should be %d", c.Version, CurrentVersion)
+	}
+	switch {
+	case c.MetricsScope != "" && len(c.Projects) > 0:
+		v.add("projects", "use either projects or metrics_scope")
+	case c.MetricsScope == "" && len(c.Projects) == 0:
+		v.add("projects", "at least one project is mandatory")
+	}
+	for i, projectID := range c.Projects {
+		if strings.TrimSpace(projectID) == "" {
+			v.add(fmt.Sprintf("projects[%d]", i), "project can't be empty")
+		}
+	}
+	c.validateOutputs(v)
+	if c.Discovery.Interval < 0 {
+		v.add("discovery.interval", "interval can't be negative")
+	}
+	if c.ShutdownTimeout < 0 {
+		v.add("shutdown_timeout", "shutdown timeout can't be negative")
+	}
+	if _, err := utils.CompileMetricExcludes(c.Discovery.Excludes); err != nil {
+		v.add("discovery.excludes", "%v", err)
+	}
+	if len(c.Metrics) == 0 {
+		v.add("metrics", "provide at least one metric to be extracted")
+	}
+	metricIndexes := make(map[string]int)
+	for i, m := range c.Metrics {
+		location := fmt.Sprintf("metrics[%d]", i)
+		if first, ok := metricIndexes[m.Type]; ok {
+			v.add(location+".type", "metric type %s is already in metrics[%d]", m.Type, first)
+			continue
+		}
+		metricIndexes[m.Type] = i
+		for _, err := range c.validateMetric(m) {
+			v.add(location+err.field, "%v", err.err)
+		}
+	}
+	if len(v.Errors) > 0 {
+		return v
+	}
+	return nil
+}
+
+// error on a field of a metric
+type metricError struct {
+	field string
+	err   error
+}
+
+func (c *Config) validateMetric(m MetricConfig) []metricError {
+	errs := make([]metricError, 0)
+	if m.Type == "" {
+		errs = append(errs, metricError{".type", errors.New("metric type is mandatory")})
+	}
+	if _, err := c.getMetricInterval(m); err != nil {
+		errs = append(errs, metricError{".interval", err})
+	}
+	if _, err := m.Aggregation.toAggregation(); err != nil {
+		errs = append(errs, metricError{".aggregation", err})
+	}
+	if m.Lookback < 0 {
+		errs = append(errs, metricError{".lookback", errors.New("lookback can't be negative")})
+	}
+	if m.IngestionDelay < 0 {
+		errs = append(errs, metricError{".ingestion_delay", errors.New("ingestion delay can't be negative")})
+	}
+	if m.RefetchWindows < 0 {
+		errs = append(errs, metricError{".refetch_windows", errors.New("refetch windows can't be negative")})
+	}
+	if m.CallTimeout < 0 {
+		errs = append(errs, metricError{".call_timeout", errors.New("call timeout can't be negative")})
+	}
+	if m.Timeout < 0 {
+		errs = append(errs, metricError{".timeout", errors.New("timeout can't be negative")})
+	}
+	for _, o := range m.Outputs {
+		if !c.HasOutput(o) {
+			errs = append(errs, metricError{".outputs", fmt.Errorf("output %q is not an output type of the config", o)})
+		}
+	}
+	return errs
+}
+
+// gets the interval of the metric as used by the outputs
+// a cron expression when json is one of the outputs, the collections feeding all the outputs,
+// and a number of minutes for the prometheus output alone
+func (c *Config) getMetricInterval(m MetricConfig) (string, error) {
+	if m.Interval != 0 && m.Schedule != "" {
+		return "", errors.New("use either interval or schedule")
+	}
+	if m.Interval < 0 || m.Interval%time.Minute != 0 {
+		return "", fmt.Errorf("interval %s should be a whole number of minutes", m.Interval)
+	}
+	minutes := int(m.Interval / time.Minute)
+	if !c.HasOutput(JSONOutputType) {
+		if m.Schedule != "" {
+			return "", errors.New("schedule is only for json output, use interval for prometheus")
+		}
+		if minutes == 0 {
+			minutes = int(defaultPrometheusInterval / time.Minute)
+		}
+		return strconv.Itoa(minutes), nil
+	}
+	if m.Schedule != "" {
+		if err := validateSchedule(m.Schedule); err != nil {
+			return "", err
+		}
+		return m.Schedule, nil
+	}
+	switch {
+	case minutes == 0:
+		return defaultJSONSchedule, nil
+	case minutes < 60 && 60%minutes == 0:
+		return fmt.Sprintf("*/%d * * * *", minutes), nil
+	case minutes%60 == 0 && 24%(minutes/60) == 0:
+		return fmt.Sprintf("0 */%d * * *", minutes/60), nil
+	default:
+		return "", fmt.Errorf("interval %s can't be a cron expression, use schedule instead", m.Interval)
+	}
+}
+
+// validates the cron expression with the parser scheduling the jobs, so expressions with seconds or years
+// are rejected, cronexpr rejecting the steps out of the range of the fields that cron accepts
+func validateSchedule(schedule string) error {
+	if _, err := cron.ParseStandard(schedule); err != nil {
+		return err
+	}
+	_, err := cronexpr.Parse(schedule)
+	return err
+}
+
+// converts to the aggregation of the client, nil without aggregation
+func (a *AggregationConfig) toAggregation() (*stackdriverClient.Aggregation, error) {
+	if a == nil {
+		return nil, nil
+	}
+	aggregation := &stackdriverClient.Aggregation{
+		AlignmentPeriod:    a.AlignmentPeriod,
+		PerSeriesAligner:   a.PerSeriesAligner,
+		CrossSeriesReducer: a.CrossSeriesReducer,
+		GroupByFields:      a.GroupByFields,
+	}
+	if err := aggregation.Validate(); err != nil {
+		return nil, err
+	}
+	return aggregation, nil
+}
+
+// GetProjectIDs : gets the projects to collect, the metrics scope host project when set
+// series from a metrics scope already have the project id of the monitored project
+func (c *Config) GetProjectIDs() []string {
+	if c.MetricsScope != "" {
+		return []string{c.MetricsScope}
+	}
+	return c.Projects
+}
+
+// MetricsAndIntervals : gets the metrics with the interval of the output type
+func (c *Config) MetricsAndIntervals() ([]utils.MetricsAndIntervalType, error) {
+	metrics := make([]utils.MetricsAndIntervalType, 0, len(c.Metrics))
+	for i, m := range c.Metrics {
+		interval, err := c.getMetricInterval(m)
+		if err != nil {
+			return nil, fmt.Errorf("metrics[%d].interval: %v", i, err)
+		}
+		aggregation, err := m.Aggregation.toAggregation()
+		if err != nil {
+			return nil, fmt.Errorf("metrics[%d].aggregation: %v", i, err)
+		}
+		metrics = append(metrics, utils.MetricsAndIntervalType{
+			MetricType:     m.Type,
+			Interval:       interval,
+			Filter:         strings.TrimSpace(m.Filter),
+			Aggregation:    aggregation,
+			Lookback:       m.Lookback,
+			IngestionDelay: m.IngestionDelay,
+			RefetchWindows: m.RefetchWindows,
+			Outputs:        m.Outputs,
+			CallTimeout:    c.getMetricCallTimeout(m),
+			Timeout:        c.getMetricTimeout(m),
+		})
+	}
+	return metrics, nil
+}
+
+// gets the call timeout of the metric, the output call timeout when not set
+func (c *Config) getMetricCallTimeout(m MetricConfig) time.Duration {
+	if m.CallTimeout > 0 {
+		return m.CallTimeout
+	}
+	return c.Output.CallTimeout
+}
+
+// gets the deadline of a run of the metric job, the output job timeout when not set
+func (c *Config) getMetricTimeout(m MetricConfig) time.Duration {
+	if m.Timeout > 0 {
+		return m.Timeout
+	}
+	return c.Output.JobTimeout
+}
+
+// RetryPolicy : gets the retry policy of the api calls
+func (c *Config) RetryPolicy() stackdriverClient.RetryPolicy {
+	return stackdriverClient.RetryPolicy{
+		MaxRetries:     c.Output.APIRetries,
+		InitialBackoff: c.Output.APIRetryBackoff,
+		MaxBackoff:     c.Output.APIMaxRetryBackoff,
+	}
+}
+
+// PrometheusOutputConfig : builds and validates the config of the prometheus output
+func (c *Config) PrometheusOutputConfig() (prometheusOutput.OutputConfig, error) {
+	p := c.Output.Prometheus
+	excludes, err := utils.CompileMetricExcludes(c.Discovery.Excludes)
+	if err != nil {
+		return prometheusOutput.OutputConfig{}, err
+	}
+	metadata := make([]prometheusOutput.MetadataLabel, 0, len(p.MetadataLabels))
+	for _, m := range p.MetadataLabels {
+		metadataLabel, err := prometheusOutput.ParseMetadataLabel(m)
+		if err != nil {
+			return prometheusOutput.OutputConfig{}, err
+		}
+		metadata = append(metadata, metadataLabel)
+	}
+	var webConfig *prometheusOutput.WebConfig
+	if p.WebConfigFile != "" {
+		if webConfig, err = prometheusOutput.LoadWebConfig(p.WebConfigFile); err != nil {
+			return prometheusOutput.OutputConfig{}, err
+		}
+	}
+	o := prometheusOutput.OutputConfig{
+		ProjectIDs:        c.GetProjectIDs(),
+		ListenAddress:     p.ListenAddress,
+		BaseHandlerPath:   p.Path,
+		Port:              p.Port,
+		WebConfig:         webConfig,
+		MetricExcludes:    excludes,
+		DiscoveryInterval: c.Discovery.Interval,
+		MetadataLabels:    metadata,
+		Mode:              p.Mode,
+		CacheTTL:          p.ScrapeCacheTTL,
+		Lookback:          p.Lookback,
+		PollJitter:        p.PollJitter,
+	}
+	if err = o.ValidateConfig(); err != nil {
+		return prometheusOutput.OutputConfig{}, err
+	}
+	return o, nil
+}
@@ -0,0 +1,243 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadYAML(t *testing.T) {
+	c, err := Load("testdata/config.yml")
+	assert.NoError(t, err)
+	assert.NoError(t, c.Validate())
+	assert.Equal(t, []string{"deployments-metrics", "billing-metrics"}, c.GetProjectIDs())
+	assert.Equal(t, 30*time.Minute, c.Discovery.Interval)
+	// defaults are kept for the settings not in the file
+	assert.Equal(t, time.Minute, c.Output.Prometheus.ScrapeCacheTTL)
+	metrics, err := c.MetricsAndIntervals()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(metrics))
+	// prometheus intervals are in minutes
+	assert.Equal(t, "60", metrics[0].Interval)
+	assert.Equal(t, 2*time.Hour, metrics[0].Lookback)
+	assert.Equal(t, 4*time.Minute, metrics[0].IngestionDelay)
+	assert.Equal(t, 2, metrics[0].RefetchWindows)
+	assert.Equal(t, `resource.labels.bucket_name = starts_with("prod-")`, metrics[0].Filter)
+	assert.Equal(t, "1", metrics[1].Interval)
+	assert.Equal(t, 5*time.Minute, metrics[1].Aggregation.AlignmentPeriod)
+	assert.Equal(t, []string{"resource.labels.project_id"}, metrics[1].Aggregation.GroupByFields)
+	p, err := c.PrometheusOutputConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, "/metrics/gcp", p.BaseHandlerPath)
+	assert.Equal(t, 9255, p.Port)
+	assert.Equal(t, 15*time.Minute, p.Lookback)
+	assert.Equal(t, 1, len(p.MetadataLabels))
+	assert.Equal(t, 1, len(p.MetricExcludes))
+}
+
+func TestLoadJSON(t *testing.T) {
+	c, err := Load("testdata/config.json")
+	assert.NoError(t, err)
+	assert.NoError(t, c.Validate())
+	assert.Equal(t, []string{"monitoring-host"}, c.GetProjectIDs())
+	metrics, err := c.MetricsAndIntervals()
+	assert.NoError(t, err)
+	// json intervals are cron expressions
+	assert.Equal(t, "0 * * * *", metrics[0].Interval)
+	assert.Equal(t, "*/5 * * * *", metrics[1].Interval)
+	assert.Equal(t, defaultJSONSchedule, metrics[2].Interval)
+	assert.Equal(t, 2*time.Minute, c.Output.JSON.Lag)
+	assert.Equal(t, 6*time.Hour, c.Output.JSON.MaxWindow)
+	assert.Equal(t, "/tmp/"+DefaultStateFileName, c.Output.JSON.GetStateFile())
+}
+
+func TestParseErrors(t *testing.T) {
+	// version is mandatory
+	_, err := Parse([]byte("projects: [test]\n"))
+	assert.Error(t, err)
+	// unknown fields
+	_, err = Parse([]byte("version: 1\nproject: test\n"))
+	assert.Error(t, err)
+	_, err = Parse([]byte("version: 1\nmetrics:\n  - type: x\n    every: 5m\n"))
+	assert.Error(t, err)
+	// wrong types
+	_, err = Parse([]byte("version: 1\ndiscovery:\n  interval: often\n"))
+	assert.Error(t, err)
+	_, err = Load("testdata/missing.yml")
+	assert.Error(t, err)
+}
+
+func TestValidateLocations(t *testing.T) {
+	c, err := Parse([]byte(`
+version: 2
+projects: ["test", ""]
+output:
+  type: json
+metrics:
+  - type: storage.googleapis.com/storage/total_bytes
+    interval: 7m
+  - type: storage.googleapis.com/storage/object_count
+    interval: 5m
+    schedule: "*/5 * * * *"
+  - type: bigquery.googleapis.com/query/count
+    aggregation:
+      alignment_period: 5m
+      per_series_aligner: ALIGN_WRONG
+  - type: storage.googleapis.com/storage/total_bytes
+  - type: pubsub.googleapis.com/subscription/num_undelivered_messages
+    ingestion_delay: -1m
+    refetch_windows: -1
+`))
+	assert.NoError(t, err)
+	err = c.Validate()
+	assert.Error(t, err)
+	v, ok := err.(*ValidationError)
+	assert.True(t, ok)
+	assert.Equal(t, 9, len(v.Errors), err.Error())
+	assert.Contains(t, v.Errors[0], "version:")
+	assert.Contains(t, v.Errors[1], "projects[1]:")
+	assert.Contains(t, v.Errors[2], "output.json.path:")
+	assert.Contains(t, v.Errors[3], "metrics[0].interval:")
+	assert.Contains(t, v.Errors[4], "metrics[1].interval:")
+	assert.Contains(t, v.Errors[5], "metrics[2].aggregation:")
+	assert.Contains(t, v.Errors[6], "metrics[3].type: metric type storage.googleapis.com/storage/total_bytes is already in metrics[0]")
+	assert.Contains(t, v.Errors[7], "metrics[4].ingestion_delay:")
+	assert.Contains(t, v.Errors[8], "metrics[4].refetch_windows:")
+}
+
+func TestValidateOutput(t *testing.T) {
+	c := Default()
+	c.Projects = []string{"test"}
+	c.Metrics = []MetricConfig{{Type: "storage.googleapis.com/storage/total_bytes"}}
+	c.Output.Type = "bigquery"
+	assert.Error(t, c.Validate())
+	c.Output.Type = JSONOutputType
+	c.Output.JSON.Path = "/tmp"
+	// schedules with seconds or years can't be scheduled
+	c.Metrics[0].Schedule = "0 */5 * * * *"
+	assert.Error(t, c.Validate())
+	c.Metrics[0].Schedule = "*/5 * * * *"
+	assert.NoError(t, c.Validate())
+	c.Metrics[0].Schedule = ""
+	c.Output.JSON.Path = ""
+	c.Output.Type = PrometheusOutputType
+	assert.NoError(t, c.Validate())
+	// schedule is only for json output
+	c.Metrics[0].Schedule = "*/5 * * * *"
+	assert.Error(t, c.Validate())
+	c.Metrics[0].Schedule = ""
+	c.Output.Prometheus.Path = "metrics"
+	assert.Error(t, c.Validate())
+	c.Output.Prometheus.Path = "/metrics"
+	c.Output.Prometheus.MetadataLabels = []string{"region"}
+	assert.Error(t, c.Validate())
+	c.Output.Prometheus.MetadataLabels = nil
+	// projects or metrics scope
+	c.MetricsScope = "host"
+	assert.Error(t, c.Validate())
+	c.Projects = nil
+	assert.NoError(t, c.Validate())
+	// windows of the json output
+	c.Output.Type = JSONOutputType
+	c.Output.JSON.Path = "/tmp"
+	assert.NoError(t, c.Validate())
+	c.Output.JSON.Lag = -time.Minute
+	assert.Error(t, c.Validate())
+	c.Output.JSON.Lag = 0
+	c.Output.JSON.MaxWindow = time.Second
+	assert.Error(t, c.Validate())
+	c.Output.JSON.MaxWindow = time.Hour
+	c.Output.WriteRetries = -1
+	assert.Error(t, c.Validate())
+	c.Output.WriteRetries = 0
+	c.ShutdownTimeout = -time.Second
+	assert.Error(t, c.Validate())
+	c.ShutdownTimeout = 0
+	c.Output.CallTimeout = -time.Second
+	assert.Error(t, c.Validate())
+	c.Output.CallTimeout = 0
+	c.Metrics[0].Timeout = -time.Second
+	assert.Error(t, c.Validate())
+	c.Metrics[0].Timeout = 0
+	c.Output.APIMaxRetryBackoff = c.Output.APIRetryBackoff / 2
+	assert.Error(t, c.Validate())
+	c.Output.APIMaxRetryBackoff = c.Output.APIRetryBackoff
+	c.Output.ReadRequestsPerMinute = -1
+	assert.Error(t, c.Validate())
+	c.Output.ReadRequestsPerMinute = 600
+	assert.NoError(t, c.Validate())
+}
+
+func TestMetricTimeouts(t *testing.T) {
+	c := Default()
+	c.Output.JobTimeout = 4 * time.Minute
+	c.Metrics = []MetricConfig{
+		{Type: "storage.googleapis.com/storage/total_bytes"},
+		{Type: "storage.googleapis.com/storage/object_count", CallTimeout: 10 * time.Second, Timeout: 2 * time.Minute},
+	}
+	metrics, err := c.MetricsAndIntervals()
+	assert.NoError(t, err)
+	// the output timeouts are used when the metric has none
+	assert.Equal(t, time.Minute, metrics[0].CallTimeout)
+	assert.Equal(t, 4*time.Minute, metrics[0].Timeout)
+	assert.Equal(t, 10*time.Second, metrics[1].CallTimeout)
+	assert.Equal(t, 2*time.Minute, metrics[1].Timeout)
+}
+
+func TestGetMetricIntervalJSON(t *testing.T) {
+	c := Default()
+	for interval, schedule := range map[time.Duration]string{
+		0:                defaultJSONSchedule,
+		time.Minute:      "*/1 * * * *",
+		15 * time.Minute: "*/15 * * * *",
+		time.Hour:        "0 */1 * * *",
+		6 * time.Hour:    "0 */6 * * *",
+	} {
+		s, err := c.getMetricInterval(MetricConfig{Interval: interval})
+		assert.NoError(t, err)
+		assert.Equal(t, schedule, s)
+	}
+	for _, interval := range []time.Duration{7 * time.Minute, 90 * time.Second, 5 * time.Hour, -time.Minute} {
+		_, err := c.getMetricInterval(MetricConfig{Interval: interval})
+		assert.Error(t, err, interval.String())
+	}
+}
+
+func TestValidateMultipleOutputs(t *testing.T) {
+	c, err := Parse([]byte(`
+version: 1
+projects: [test]
+output:
+  type: json,prometheus
+  json:
+    path: /tmp
+metrics:
+  - type: storage.googleapis.com/storage/total_bytes
+    interval: 5m
+    outputs: [prometheus]
+  - type: storage.googleapis.com/storage/object_count
+`))
+	assert.NoError(t, err)
+	assert.NoError(t, c.Validate())
+	assert.Equal(t, []string{JSONOutputType, PrometheusOutputType}, c.OutputTypes())
+	assert.True(t, c.HasOutput(PrometheusOutputType))
+	metrics, err := c.MetricsAndIntervals()
+	assert.NoError(t, err)
+	// intervals are cron expressions when json is one of the outputs
+	assert.Equal(t, "*/5 * * * *", metrics[0].Interval)
+	assert.Equal(t, []string{PrometheusOutputType}, metrics[0].Outputs)
+	assert.Nil(t, metrics[1].Outputs)
+	// scrape mode queries stackdriver itself
+	c.Output.Prometheus.Mode = "scrape"
+	assert.Error(t, c.Validate())
+	c.Output.Prometheus.Mode = "poll"
+	// metrics are routed only to the outputs of the config
+	c.Metrics[0].Outputs = []string{"bigquery"}
+	assert.Error(t, c.Validate())
+	c.Metrics[0].Outputs = nil
+	c.Output.Type = "json,json"
+	assert.Error(t, c.Validate())
+	c.Output.Type = ""
+	assert.Error(t, c.Validate())
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getMetricFlagInterval : gets the optional interval passed after the metric type
+// a cron expression for the json output, and a number of minutes for the prometheus output
+func getMetricFlagInterval(metricSlice []string, outputType string, m *MetricConfig) error {
+	if len(metricSlice) < 2 || metricSlice[1] == "" {
+		return nil
+	}
+	switch outputType {
+	case PrometheusOutputType:
+		// interval in minutes to poll the metric in prometheus
+		interval, err := strconv.Atoi(metricSlice[1])
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("interval %q should be a number of minutes", metricSlice[1])
+		}
+		m.Interval = time.Duration(interval) * time.Minute
+	default:
+		// checking the cron expression if its valid
+		if err := validateSchedule(metricSlice[1]); err != nil {
+			return err
+		}
+		m.Schedule = metricSlice[1]
+	}
+	return nil
+}
+
+// getMetricFilter : gets the optional filter expression passed after the interval
+func getMetricFilter(metricSlice []string) string {
+	if len(metricSlice) < 3 {
+		return ""
+	}
+	return strings.TrimSpace(metricSlice[2])
+}
+
+// getMetricAggregation : gets the optional aggregation passed after the filter
+// as "alignment_period,aligner[,reducer[,group_by_field...]]", like "300s,ALIGN_RATE,REDUCE_SUM,resource.labels.bucket_name"
+func getMetricAggregation(metricSlice []string) (*AggregationConfig, error) {
+	if len(metricSlice) < 4 || strings.TrimSpace(metricSlice[3]) == "" {
+		return nil, nil
+	}
+	aggSlice := strings.Split(metricSlice[3], ",")
+	for i := range aggSlice {
+		aggSlice[i] = strings.TrimSpace(aggSlice[i])
+	}
+	if len(aggSlice) < 2 {
+		return nil, errors.New("aggregation should have at least the alignment period and the aligner")
+	}
+	alignmentPeriod, err := time.ParseDuration(aggSlice[0])
+	if err != nil {
+		return nil, err
+	}
+	aggregation := &AggregationConfig{
+		AlignmentPeriod:  alignmentPeriod,
+		PerSeriesAligner: aggSlice[1],
+	}
+	if len(aggSlice) > 2 {
+		aggregation.CrossSeriesReducer = aggSlice[2]
+		aggregation.GroupByFields = aggSlice[3:]
+	}
+	if _, err := aggregation.toAggregation(); err != nil {
+		return nil, err
+	}
+	return aggregation, nil
+}
+
+// splits the metric flag on the pipes out of the double quoted strings,
+// so the strings of the filter can hold pipes, as in monitoring.regex.full_match("a|b")
+func splitMetricFlag(metric string) []string {
+	metricSlice := make([]string, 0, 4)
+	quoted := false
+	start := 0
+	for i := 0; i < len(metric); i++ {
+		switch metric[i] {
+		case '\\':
+			// escaped character of a string
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case '|':
+			if !quoted {
+				metricSlice = append(metricSlice, metric[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(metricSlice, metric[start:])
+}
+
+// ParseMetricFlag : parses the metric passed as "metric_type|interval|filter|aggregation" on the --metric_type flag
+// all but the metric type being optional, pipes in the double quoted strings of the filter being kept in the filter
+func ParseMetricFlag(metric string, outputType string) (MetricConfig, error) {
+	metricSlice := splitMetricFlag(metric)
+	if len(metricSlice) > 4 {
+		return MetricConfig{}, errors.New("more than four arguments passed to generate the metric, interval, filter and aggregation")
+	}
+	m := MetricConfig{
+		Type:   metricSlice[0],
+		Filter: getMetricFilter(metricSlice),
+	}
+	if err := getMetricFlagInterval(metricSlice, outputType, &m); err != nil {
+		return MetricConfig{}, err
+	}
+	aggregation, err := getMetricAggregation(metricSlice)
+	if err != nil {
+		return MetricConfig{}, err
+	}
+	m.Aggregation = aggregation
+	return m, nil
+}
+
+// SetMetricFlags : sets the metrics passed on the --metric_type flags, parsed for the output types of the config
+// (cron expressions when json is one of the outputs)
+// metrics of the config file with the same metric type are overridden, repeated flags keep the first metric
+func (c *Config) SetMetricFlags(metrics []string) error {
+	outputType := c.Output.Type
+	if c.HasOutput(JSONOutputType) {
+		outputType = JSONOutputType
+	}
+	flagMetrics := make(map[string]bool)
+	for _, metric := range metrics {
+		m, err := ParseMetricFlag(metric, outputType)
+		if err != nil {
+			return fmt.Errorf("metric_type %q: %v", metric, err)
+		}
+		if flagMetrics[m.Type] {
+			continue
+		}
+		flagMetrics[m.Type] = true
+		c.setMetric(m)
+	}
+	return nil
+}
+
+// sets the metric, replacing the metric with the same metric type
+func (c *Config) setMetric(m MetricConfig) {
+	for i := range c.Metrics {
+		if c.Metrics[i].Type == m.Type {
+			c.Metrics[i] = m
+			return
+		}
+	}
+	c.Metrics = append(c.Metrics, m)
+}
+
+// SetProjectFlags : sets the projects passed on the --project_id flags, repeated or comma separated
+// overriding the projects of the config file
+func (c *Config) SetProjectFlags(projects []string) {
+	c.Projects = make([]string, 0, len(projects))
+	for _, p := range projects {
+		for _, projectID := range strings.Split(p, ",") {
+			if projectID = strings.TrimSpace(projectID); projectID != "" {
+				c.Projects = append(c.Projects, projectID)
+			}
+		}
+	}
+}
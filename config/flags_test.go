@@ -0,0 +1,105 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMetricFlag(t *testing.T) {
+	m, err := ParseMetricFlag("metrictype|*/1 * * * *", JSONOutputType)
+	assert.NoError(t, err)
+	assert.Equal(t, "metrictype", m.Type)
+	assert.Equal(t, "*/1 * * * *", m.Schedule)
+	// blank interval uses the default interval
+	m, err = ParseMetricFlag("metrictype||metric.labels.storage_class = \"STANDARD\"", JSONOutputType)
+	assert.NoError(t, err)
+	assert.Equal(t, "", m.Schedule)
+	assert.Equal(t, "metric.labels.storage_class = \"STANDARD\"", m.Filter)
+	_, err = ParseMetricFlag("metrictype|*/99 * * * *", JSONOutputType)
+	assert.Error(t, err)
+	// the jobs are scheduled without seconds nor years
+	_, err = ParseMetricFlag("metrictype|0 */5 * * * *", JSONOutputType)
+	assert.Error(t, err)
+	_, err = ParseMetricFlag("metrictype|0 */5 * * * * 2030", JSONOutputType)
+	assert.Error(t, err)
+	_, err = ParseMetricFlag("metrictype|*/5 * * * *|filter|60s,ALIGN_MEAN|Dummy", JSONOutputType)
+	assert.Error(t, err)
+}
+
+func TestParseMetricFlagQuotedPipes(t *testing.T) {
+	// pipes in the strings of the filter are kept in the filter
+	m, err := ParseMetricFlag(`metrictype||metric.labels.method = monitoring.regex.full_match("get|list")|60s,ALIGN_RATE`,
+		JSONOutputType)
+	assert.NoError(t, err)
+	assert.Equal(t, `metric.labels.method = monitoring.regex.full_match("get|list")`, m.Filter)
+	if assert.NotNil(t, m.Aggregation) {
+		assert.Equal(t, "ALIGN_RATE", m.Aggregation.PerSeriesAligner)
+	}
+	m, err = ParseMetricFlag(`metrictype||resource.labels.bucket_name = "a\"|b"`, JSONOutputType)
+	assert.NoError(t, err)
+	assert.Equal(t, `resource.labels.bucket_name = "a\"|b"`, m.Filter)
+	assert.Nil(t, m.Aggregation)
+	// pipes out of the strings still split the metric
+	_, err = ParseMetricFlag(`metrictype||metric.labels.method = "get"|list|60s,ALIGN_RATE`, JSONOutputType)
+	assert.Error(t, err)
+}
+
+func TestParseMetricFlagPrometheus(t *testing.T) {
+	m, err := ParseMetricFlag("metrictype|5", PrometheusOutputType)
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, m.Interval)
+	// prometheus interval is in minutes
+	_, err = ParseMetricFlag("metrictype|*/5 * * * *", PrometheusOutputType)
+	assert.Error(t, err)
+	_, err = ParseMetricFlag("metrictype|0", PrometheusOutputType)
+	assert.Error(t, err)
+}
+
+func TestParseMetricFlagAggregation(t *testing.T) {
+	m, err := ParseMetricFlag("bigquery.googleapis.com/query/count|*/10 * * * *||300s,ALIGN_DELTA,REDUCE_SUM,resource.labels.project_id",
+		JSONOutputType)
+	assert.NoError(t, err)
+	assert.NotNil(t, m.Aggregation)
+	assert.Equal(t, m.Aggregation.AlignmentPeriod, 5*time.Minute)
+	assert.Equal(t, m.Aggregation.PerSeriesAligner, "ALIGN_DELTA")
+	assert.Equal(t, m.Aggregation.CrossSeriesReducer, "REDUCE_SUM")
+	assert.Equal(t, m.Aggregation.GroupByFields, []string{"resource.labels.project_id"})
+	m, err = ParseMetricFlag("storage.googleapis.com/storage/object_count", JSONOutputType)
+	assert.NoError(t, err)
+	assert.Nil(t, m.Aggregation)
+	// missing aligner
+	_, err = ParseMetricFlag("bigquery.googleapis.com/query/count|||300s", JSONOutputType)
+	assert.Error(t, err)
+	// wrong alignment period
+	_, err = ParseMetricFlag("bigquery.googleapis.com/query/count|||5 minutes,ALIGN_DELTA", JSONOutputType)
+	assert.Error(t, err)
+	// wrong aligner
+	_, err = ParseMetricFlag("bigquery.googleapis.com/query/count|||300s,ALIGN_WRONG", JSONOutputType)
+	assert.Error(t, err)
+}
+
+func TestSetMetricFlags(t *testing.T) {
+	c, err := Load("testdata/config.json")
+	assert.NoError(t, err)
+	err = c.SetMetricFlags([]string{
+		"storage.googleapis.com/storage/total_bytes|*/10 * * * *",
+		"pubsub.googleapis.com/subscription/num_undelivered_messages|*/5 * * * *",
+		"pubsub.googleapis.com/subscription/num_undelivered_messages|*/1 * * * *", // not including repeting metrics
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(c.Metrics))
+	// flags override the metrics of the config file
+	assert.Equal(t, "*/10 * * * *", c.Metrics[0].Schedule)
+	assert.Equal(t, "pubsub.googleapis.com/subscription/num_undelivered_messages", c.Metrics[3].Type)
+	assert.Equal(t, "*/5 * * * *", c.Metrics[3].Schedule)
+	assert.Error(t, c.SetMetricFlags([]string{"metrictype|*/99 * * * *"}))
+}
+
+func TestSetProjectFlags(t *testing.T) {
+	c := Default()
+	c.Projects = []string{"from-file"}
+	c.SetProjectFlags([]string{"project-a, project-b", "project-c", ""})
+	assert.Equal(t, []string{"project-a", "project-b", "project-c"}, c.Projects)
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// Reloader : reloads the config on SIGHUP or when the config file changes
+// Path	- config file checked for changes every Interval, not checked when empty or Interval is 0
+// Load	- loads the config, with the overrides of the flags
+// Apply	- applies the metrics of the new valid config
+// invalid configs are rejected, keeping the current config
+type Reloader struct {
+	Path     string
+	Interval time.Duration
+	Load     func() (*Config, error)
+	Apply    func(*Config)
+	Logger   *log.Logger
+	current  *Config
+	content  []byte
+}
+
+// Start : starts watching for SIGHUP and the changes of the config file, from the current config
+func (r *Reloader) Start(current *Config) {
+	r.current = current
+	r.content = r.readFile()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var changes <-chan time.Time
+	if r.Path != "" && r.Interval > 0 {
+		ticker := time.NewTicker(r.Interval)
+		changes = ticker.C
+	}
+	go func() {
+		for {
+			select {
+			case <-hup:
+				r.Logger.Println("SIGHUP received, reloading config")
+				r.Reload()
+			case <-changes:
+				if r.fileChanged() {
+					r.Logger.Printf("config file %s changed, reloading config\n", r.Path)
+					r.Reload()
+				}
+			}
+		}
+	}()
+}
+
+// reads the content of the config file, nil when not set or not readable
+func (r *Reloader) readFile() []byte {
+	if r.Path == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(r.Path)
+	if err != nil {
+		return nil
+	}
+	return content
+}
+
+// checks if the content of the config file changed since the last check
+// a file not readable is not a change, as editors can remove the file before writing it again
+func (r *Reloader) fileChanged() bool {
+	content := r.readFile()
+	if content == nil || bytes.Equal(content, r.content) {
+		return false
+	}
+	r.content = content
+	return true
+}
+
+// Reload : loads and validates the config, applying it when valid
+// only the metrics are reloaded, other settings changed need a restart
+func (r *Reloader) Reload() bool {
+	c, err := r.Load()
+	if err == nil {
+		err = c.Validate()
+	}
+	if err != nil {
+		r.Logger.Printf("config rejected, keeping the current config: %v\n", err)
+		return false
+	}
+	if !r.current.sameSettings(c) {
+		r.Logger.Println("only the metrics are reloaded, restart the exporter to apply the other settings")
+	}
+	r.Apply(c)
+	r.current = c
+	return true
+}
+
+// checks if the configs have the same settings, other than the metrics
+func (c *Config) sameSettings(other *Config) bool {
+	settings, otherSettings := *c, *other
+	settings.Metrics, otherSettings.Metrics = nil, nil
+	return reflect.DeepEqual(settings, otherSettings)
+}
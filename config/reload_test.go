@@ -0,0 +1,68 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	current, err := Load("testdata/config.json")
+	assert.NoError(t, err)
+	var next *Config
+	var loadErr error
+	applied := 0
+	r := &Reloader{
+		Load:   func() (*Config, error) { return next, loadErr },
+		Apply:  func(*Config) { applied++ },
+		Logger: log.New(ioutil.Discard, "", 0),
+	}
+	r.current = current
+	// invalid configs are rejected, keeping the current config
+	next = Default()
+	assert.False(t, r.Reload())
+	loadErr = errors.New("yaml: line 3: did not find expected key")
+	assert.False(t, r.Reload())
+	assert.Equal(t, 0, applied)
+	assert.Equal(t, current, r.current)
+	// valid configs are applied
+	next, loadErr = Load("testdata/config.json")
+	assert.NoError(t, loadErr)
+	next.Metrics = next.Metrics[1:]
+	assert.True(t, r.Reload())
+	assert.Equal(t, 1, applied)
+	assert.Equal(t, next, r.current)
+}
+
+func TestSameSettings(t *testing.T) {
+	c, err := Load("testdata/config.json")
+	assert.NoError(t, err)
+	other, err := Load("testdata/config.json")
+	assert.NoError(t, err)
+	other.Metrics = nil
+	assert.True(t, c.sameSettings(other))
+	other.Output.JSON.Path = "/var/metrics"
+	assert.False(t, c.sameSettings(other))
+}
+
+func TestFileChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("version: 1\n"), 0600))
+	r := &Reloader{Path: path}
+	r.content = r.readFile()
+	assert.False(t, r.fileChanged())
+	assert.NoError(t, ioutil.WriteFile(path, []byte("version: 1\nprojects: [test]\n"), 0600))
+	assert.True(t, r.fileChanged())
+	assert.False(t, r.fileChanged())
+	// a removed file is not a change
+	assert.NoError(t, os.Remove(path))
+	assert.False(t, r.fileChanged())
+}
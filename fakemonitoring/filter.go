@@ -0,0 +1,120 @@
+package fakemonitoring
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// condition of a monitoring filter, as metric.type = "type" or resource.labels.key = starts_with("prefix")
+type condition struct {
+	key    string
+	value  string
+	prefix bool
+}
+
+// filter : conditions of a monitoring filter joined by AND, all of them matching
+// only equality and starts_with on metric.type, resource.type, resource.labels and metric.labels are supported
+type filter []condition
+
+// parses the value of a condition, a quoted string or starts_with of a quoted string
+func parseConditionValue(value string) (string, bool, error) {
+	prefix := false
+	if strings.HasPrefix(value, "starts_with(") && strings.HasSuffix(value, ")") {
+		prefix = true
+		value = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(value, "starts_with("), ")"))
+	}
+	unquoted, err := strconv.Unquote(value)
+	if err != nil {
+		return "", false, fmt.Errorf("value %s should be a quoted string", value)
+	}
+	return unquoted, prefix, nil
+}
+
+// checks if the key of a condition is supported, other comparisons than equality leaving operators in the key
+func isFilterKey(key string) bool {
+	switch {
+	case strings.ContainsAny(key, " !<>:"):
+		return false
+	case key == "metric.type", key == "resource.type":
+		return true
+	case strings.HasPrefix(key, "resource.labels."), strings.HasPrefix(key, "metric.labels."):
+		return true
+	}
+	return false
+}
+
+// parses the monitoring filter, an empty filter matching everything
+func parseFilter(expression string) (filter, error) {
+	f := make(filter, 0)
+	if strings.TrimSpace(expression) == "" {
+		return f, nil
+	}
+	for _, term := range strings.Split(expression, " AND ") {
+		// terms grouped in parentheses, like the filter of the metric after its type
+		term = strings.TrimLeft(strings.TrimSpace(term), "( ")
+		for strings.Count(term, ")") > strings.Count(term, "(") {
+			term = strings.TrimSpace(strings.TrimSuffix(term, ")"))
+		}
+		parts := strings.SplitN(term, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("condition %q is not supported", term)
+		}
+		key := strings.TrimSpace(parts[0])
+		if !isFilterKey(key) {
+			return nil, fmt.Errorf("key %q is not supported", key)
+		}
+		value, prefix, err := parseConditionValue(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+		f = append(f, condition{key: key, value: value, prefix: prefix})
+	}
+	return f, nil
+}
+
+// checks if the value matches the condition
+func (c condition) match(value string) bool {
+	if c.prefix {
+		return strings.HasPrefix(value, c.value)
+	}
+	return value == c.value
+}
+
+// gets the value of the key in the series
+func getSeriesValue(series *monitoringpb.TimeSeries, key string) string {
+	switch {
+	case key == "metric.type":
+		return series.GetMetric().GetType()
+	case key == "resource.type":
+		return series.GetResource().GetType()
+	case strings.HasPrefix(key, "resource.labels."):
+		return series.GetResource().GetLabels()[strings.TrimPrefix(key, "resource.labels.")]
+	default:
+		return series.GetMetric().GetLabels()[strings.TrimPrefix(key, "metric.labels.")]
+	}
+}
+
+// matchSeries : checks if the series matches all the conditions
+func (f filter) matchSeries(series *monitoringpb.TimeSeries) bool {
+	for _, c := range f {
+		if !c.match(getSeriesValue(series, c.key)) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchDescriptor : checks if the metric descriptor matches the conditions on the metric type
+// conditions on the labels of the series are left out
+func (f filter) matchDescriptor(descriptor *metricpb.MetricDescriptor) bool {
+	for _, c := range f {
+		if c.key == "metric.type" && !c.match(descriptor.GetType()) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package fakemonitoring
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func TestParseFilter(t *testing.T) {
+	f, err := parseFilter(`metric.type = "storage.googleapis.com/storage/object_count" AND ` +
+		`(resource.labels.bucket_name = starts_with("prod-") AND metric.labels.storage_class = "STANDARD")`)
+	assert.NoError(t, err)
+	assert.Equal(t, filter{
+		{key: "metric.type", value: "storage.googleapis.com/storage/object_count"},
+		{key: "resource.labels.bucket_name", value: "prod-", prefix: true},
+		{key: "metric.labels.storage_class", value: "STANDARD"},
+	}, f)
+	f, err = parseFilter("")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(f))
+	// only equality on the supported keys
+	_, err = parseFilter(`metadata.user_labels.team = "data"`)
+	assert.Error(t, err)
+	_, err = parseFilter(`resource.labels.zone != "eu"`)
+	assert.Error(t, err)
+	_, err = parseFilter(`resource.labels.zone = eu`)
+	assert.Error(t, err)
+}
+
+func TestFilterMatch(t *testing.T) {
+	series := &monitoringpb.TimeSeries{
+		Metric: &metricpb.Metric{
+			Type:   "storage.googleapis.com/storage/object_count",
+			Labels: map[string]string{"storage_class": "STANDARD"},
+		},
+		Resource: &monitoredrespb.MonitoredResource{
+			Type:   "gcs_bucket",
+			Labels: map[string]string{"bucket_name": "prod-assets"},
+		},
+	}
+	f, err := parseFilter(`metric.type = starts_with("storage.googleapis.com/") AND resource.type = "gcs_bucket" AND ` +
+		`resource.labels.bucket_name = starts_with("prod-")`)
+	assert.NoError(t, err)
+	assert.True(t, f.matchSeries(series))
+	f, err = parseFilter(`metric.labels.storage_class = "NEARLINE"`)
+	assert.NoError(t, err)
+	assert.False(t, f.matchSeries(series))
+	// descriptors only match on the metric type
+	f, err = parseFilter(`metric.type = starts_with("storage.googleapis.com/") AND resource.labels.bucket_name = "none"`)
+	assert.NoError(t, err)
+	assert.True(t, f.matchDescriptor(&metricpb.MetricDescriptor{Type: "storage.googleapis.com/storage/total_bytes"}))
+	assert.False(t, f.matchDescriptor(&metricpb.MetricDescriptor{Type: "bigquery.googleapis.com/query/count"}))
+}
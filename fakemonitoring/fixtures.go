@@ -0,0 +1,107 @@
+// Package fakemonitoring : in-process fake of the cloud monitoring MetricService, serving fixtures to the clients
+// so the clients and the outputs can be tested offline, without credentials
+package fakemonitoring
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Fixtures : descriptors and time series served by the fake server
+type Fixtures struct {
+	MetricDescriptors   []*metricpb.MetricDescriptor
+	ResourceDescriptors []*monitoredrespb.MonitoredResourceDescriptor
+	TimeSeries          []*monitoringpb.TimeSeries
+}
+
+// fixtures file, every entry as returned by the api in json
+type fixturesFile struct {
+	MetricDescriptors   []json.RawMessage `json:"metricDescriptors"`
+	ResourceDescriptors []json.RawMessage `json:"resourceDescriptors"`
+	TimeSeries          []json.RawMessage `json:"timeSeries"`
+}
+
+// unmarshals the json entries of the fixtures file in the messages created by newMessage
+func unmarshalEntries(entries []json.RawMessage, newMessage func() proto.Message) error {
+	for _, entry := range entries {
+		if err := jsonpb.Unmarshal(bytes.NewReader(entry), newMessage()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadFixtures : loads the fixtures from a json file with the metricDescriptors, resourceDescriptors and timeSeries
+// lists, every entry as returned by the api
+func LoadFixtures(path string) (*Fixtures, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := fixturesFile{}
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+	f := &Fixtures{}
+	err = unmarshalEntries(file.MetricDescriptors, func() proto.Message {
+		d := &metricpb.MetricDescriptor{}
+		f.MetricDescriptors = append(f.MetricDescriptors, d)
+		return d
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = unmarshalEntries(file.ResourceDescriptors, func() proto.Message {
+		d := &monitoredrespb.MonitoredResourceDescriptor{}
+		f.ResourceDescriptors = append(f.ResourceDescriptors, d)
+		return d
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = unmarshalEntries(file.TimeSeries, func() proto.Message {
+		s := &monitoringpb.TimeSeries{}
+		f.TimeSeries = append(f.TimeSeries, s)
+		return s
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ShiftPoints : moves the points of all the series so the newest point ends at end, keeping their spacing
+// as for serving the fixtures in the windows computed from now
+func (f *Fixtures) ShiftPoints(end time.Time) {
+	var newest time.Time
+	for _, s := range f.TimeSeries {
+		for _, p := range s.GetPoints() {
+			if t := p.GetInterval().GetEndTime().AsTime(); t.After(newest) {
+				newest = t
+			}
+		}
+	}
+	shift := end.Sub(newest)
+	for _, s := range f.TimeSeries {
+		for _, p := range s.GetPoints() {
+			if p.Interval == nil {
+				continue
+			}
+			if p.Interval.StartTime != nil {
+				p.Interval.StartTime = timestamppb.New(p.Interval.StartTime.AsTime().Add(shift))
+			}
+			if p.Interval.EndTime != nil {
+				p.Interval.EndTime = timestamppb.New(p.Interval.EndTime.AsTime().Add(shift))
+			}
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package fakemonitoring
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadFixtures(t *testing.T) {
+	f, err := LoadFixtures("testdata/fixtures.json")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(f.MetricDescriptors))
+	assert.Equal(t, 1, len(f.ResourceDescriptors))
+	assert.Equal(t, 4, len(f.TimeSeries))
+	assert.Equal(t, int64(1204), f.TimeSeries[0].Points[0].Value.GetInt64Value())
+	_, err = LoadFixtures("testdata/missing.json")
+	assert.Error(t, err)
+}
+
+func TestShiftPoints(t *testing.T) {
+	f, err := LoadFixtures("testdata/fixtures.json")
+	assert.NoError(t, err)
+	end := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	f.ShiftPoints(end)
+	// the newest point ends at end, the spacing of the points being kept
+	assert.Equal(t, end, f.TimeSeries[0].Points[0].Interval.EndTime.AsTime())
+	assert.Equal(t, end.Add(-5*time.Minute), f.TimeSeries[0].Points[1].Interval.EndTime.AsTime())
+}
@@ -0,0 +1,239 @@
+package fakemonitoring
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server : fake MetricService listening on a local port, serving the descriptors and time series of the fixtures
+// the series are filtered by the filter and the interval of the requests, the aggregation being ignored
+// Addr	- address the clients connect to, with insecure credentials
+// PageSize	- series or descriptors by page when the request has no page size, 0 for a single page
+type Server struct {
+	monitoringpb.UnimplementedMetricServiceServer
+	Addr     string
+	PageSize int
+	fixtures *Fixtures
+	server   *grpc.Server
+	mu       sync.Mutex
+	failures []codes.Code
+	calls    map[string]int
+}
+
+// NewServer : starts the fake server on a random local port, serving the fixtures until Close
+func NewServer(fixtures *Fixtures) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		fixtures: fixtures,
+		server:   grpc.NewServer(),
+		calls:    make(map[string]int),
+	}
+	monitoringpb.RegisterMetricServiceServer(s.server, s)
+	go s.server.Serve(listener)
+	return s, nil
+}
+
+// Close : stops the server, closing the connections of the clients
+func (s *Server) Close() {
+	s.server.Stop()
+}
+
+// FailNext : makes the next calls fail with the codes, one call by code in order
+func (s *Server) FailNext(codes ...codes.Code) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, codes...)
+}
+
+// Calls : gets the calls received by the method, failed ones included
+func (s *Server) Calls(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[method]
+}
+
+// counts the call of the method, returning the failure set for it
+func (s *Server) call(method string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[method]++
+	if len(s.failures) == 0 {
+		return nil
+	}
+	code := s.failures[0]
+	s.failures = s.failures[1:]
+	return status.Errorf(code, "fake failure of %s", method)
+}
+
+// gets the page of the items from the page token, the offset of the first item, and the token of the next page
+func getPage(total int, pageSize int32, defaultSize int, pageToken string) (int, int, string, error) {
+	start := 0
+	if pageToken != "" {
+		var err error
+		if start, err = strconv.Atoi(pageToken); err != nil || start < 0 || start > total {
+			return 0, 0, "", status.Errorf(codes.InvalidArgument, "page token %q is not valid", pageToken)
+		}
+	}
+	size := int(pageSize)
+	if size <= 0 {
+		size = defaultSize
+	}
+	end := total
+	if size > 0 && start+size < total {
+		end = start + size
+	}
+	nextToken := ""
+	if end < total {
+		nextToken = strconv.Itoa(end)
+	}
+	return start, end, nextToken, nil
+}
+
+// gets the type after the collection in the resource name, like projects/p/metricDescriptors/<type>
+func getNameType(name, collection string) string {
+	if i := strings.Index(name, "/"+collection+"/"); i >= 0 {
+		return name[i+len(collection)+2:]
+	}
+	return ""
+}
+
+// GetMetricDescriptor : implements monitoringpb.MetricServiceServer
+func (s *Server) GetMetricDescriptor(ctx context.Context,
+	req *monitoringpb.GetMetricDescriptorRequest) (*metricpb.MetricDescriptor, error) {
+	if err := s.call("GetMetricDescriptor"); err != nil {
+		return nil, err
+	}
+	metricType := getNameType(req.GetName(), "metricDescriptors")
+	for _, d := range s.fixtures.MetricDescriptors {
+		if d.GetType() == metricType {
+			return d, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "metric descriptor %s not found", metricType)
+}
+
+// ListMetricDescriptors : implements monitoringpb.MetricServiceServer
+func (s *Server) ListMetricDescriptors(ctx context.Context,
+	req *monitoringpb.ListMetricDescriptorsRequest) (*monitoringpb.ListMetricDescriptorsResponse, error) {
+	if err := s.call("ListMetricDescriptors"); err != nil {
+		return nil, err
+	}
+	f, err := parseFilter(req.GetFilter())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	descriptors := make([]*metricpb.MetricDescriptor, 0)
+	for _, d := range s.fixtures.MetricDescriptors {
+		if f.matchDescriptor(d) {
+			descriptors = append(descriptors, d)
+		}
+	}
+	start, end, nextToken, err := getPage(len(descriptors), req.GetPageSize(), s.PageSize, req.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+	return &monitoringpb.ListMetricDescriptorsResponse{
+		MetricDescriptors: descriptors[start:end],
+		NextPageToken:     nextToken,
+	}, nil
+}
+
+// GetMonitoredResourceDescriptor : implements monitoringpb.MetricServiceServer
+func (s *Server) GetMonitoredResourceDescriptor(ctx context.Context,
+	req *monitoringpb.GetMonitoredResourceDescriptorRequest) (*monitoredrespb.MonitoredResourceDescriptor, error) {
+	if err := s.call("GetMonitoredResourceDescriptor"); err != nil {
+		return nil, err
+	}
+	resourceType := getNameType(req.GetName(), "monitoredResourceDescriptors")
+	for _, d := range s.fixtures.ResourceDescriptors {
+		if d.GetType() == resourceType {
+			return d, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "monitored resource descriptor %s not found", resourceType)
+}
+
+// ListMonitoredResourceDescriptors : implements monitoringpb.MetricServiceServer, the filter being ignored
+func (s *Server) ListMonitoredResourceDescriptors(ctx context.Context,
+	req *monitoringpb.ListMonitoredResourceDescriptorsRequest) (*monitoringpb.ListMonitoredResourceDescriptorsResponse, error) {
+	if err := s.call("ListMonitoredResourceDescriptors"); err != nil {
+		return nil, err
+	}
+	descriptors := s.fixtures.ResourceDescriptors
+	start, end, nextToken, err := getPage(len(descriptors), req.GetPageSize(), s.PageSize, req.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+	return &monitoringpb.ListMonitoredResourceDescriptorsResponse{
+		ResourceDescriptors: descriptors[start:end],
+		NextPageToken:       nextToken,
+	}, nil
+}
+
+// gets the series with its points ending in the interval, from start (excluded) to end, nil without points
+func getIntervalSeries(series *monitoringpb.TimeSeries, start, end time.Time) *monitoringpb.TimeSeries {
+	points := make([]*monitoringpb.Point, 0)
+	for _, p := range series.GetPoints() {
+		t := p.GetInterval().GetEndTime().AsTime()
+		if t.After(start) && !t.After(end) {
+			points = append(points, p)
+		}
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	// the fixtures are shared by the calls
+	intervalSeries := proto.Clone(series).(*monitoringpb.TimeSeries)
+	intervalSeries.Points = points
+	return intervalSeries
+}
+
+// ListTimeSeries : implements monitoringpb.MetricServiceServer
+func (s *Server) ListTimeSeries(ctx context.Context,
+	req *monitoringpb.ListTimeSeriesRequest) (*monitoringpb.ListTimeSeriesResponse, error) {
+	if err := s.call("ListTimeSeries"); err != nil {
+		return nil, err
+	}
+	f, err := parseFilter(req.GetFilter())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.GetInterval().GetEndTime() == nil {
+		return nil, status.Error(codes.InvalidArgument, "interval end time is mandatory")
+	}
+	start := req.GetInterval().GetStartTime().AsTime()
+	end := req.GetInterval().GetEndTime().AsTime()
+	series := make([]*monitoringpb.TimeSeries, 0)
+	for _, ts := range s.fixtures.TimeSeries {
+		if !f.matchSeries(ts) {
+			continue
+		}
+		if intervalSeries := getIntervalSeries(ts, start, end); intervalSeries != nil {
+			series = append(series, intervalSeries)
+		}
+	}
+	first, last, nextToken, err := getPage(len(series), req.GetPageSize(), s.PageSize, req.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+	return &monitoringpb.ListTimeSeriesResponse{
+		TimeSeries:    series[first:last],
+		NextPageToken: nextToken,
+	}, nil
+}
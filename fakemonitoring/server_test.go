@@ -0,0 +1,46 @@
+package fakemonitoring
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGetPage(t *testing.T) {
+	// all the items in one page without page size
+	start, end, next, err := getPage(5, 0, 0, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{0, 5, ""}, []interface{}{start, end, next})
+	// page size of the request first, then of the server
+	start, end, next, err = getPage(5, 2, 3, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{0, 2, "2"}, []interface{}{start, end, next})
+	start, end, next, err = getPage(5, 0, 3, "3")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{3, 5, ""}, []interface{}{start, end, next})
+	_, _, _, err = getPage(5, 0, 3, "next")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGetIntervalSeries(t *testing.T) {
+	f, err := LoadFixtures("testdata/fixtures.json")
+	assert.NoError(t, err)
+	series := f.TimeSeries[0]
+	newest := series.Points[0].Interval.EndTime.AsTime()
+	// points ending after the start, up to the end
+	s := getIntervalSeries(series, newest.Add(-5*time.Minute), newest)
+	assert.Equal(t, 1, len(s.Points))
+	assert.Equal(t, 2, len(series.Points))
+	assert.Nil(t, getIntervalSeries(series, newest, newest.Add(time.Minute)))
+}
+
+func TestServerFailures(t *testing.T) {
+	s := &Server{calls: make(map[string]int)}
+	s.FailNext(codes.Unavailable)
+	assert.Equal(t, codes.Unavailable, status.Code(s.call("ListTimeSeries")))
+	assert.NoError(t, s.call("ListTimeSeries"))
+	assert.Equal(t, 2, s.Calls("ListTimeSeries"))
+}
@@ -0,0 +1,32 @@
+package fakemonitoring
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// NewTestServer : starts the fake server with testdata/fixtures.json, the points moved to end one minute ago
+// returning the options of the clients connecting to it, the server being closed once the test is done
+func NewTestServer(t *testing.T) (*Server, []option.ClientOption) {
+	_, file, _, _ := runtime.Caller(0)
+	fixtures, err := LoadFixtures(filepath.Join(filepath.Dir(file), "testdata", "fixtures.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixtures.ShiftPoints(time.Now().Add(-time.Minute))
+	server, err := NewServer(fixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	return server, []option.ClientOption{
+		option.WithEndpoint(server.Addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+	}
+}
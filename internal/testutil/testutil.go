@@ -0,0 +1,30 @@
+// Package testutil : fixtures shared by the tests of the outputs
+package testutil
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/stretchr/testify/assert"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// ReadSeries : reads the series of testdata/series.json next to this file, one series by line as returned by the api
+// the gcs buckets prod-assets (latest point 1204), prod-backups (87, points not ordered) and staging-assets (0),
+// and a gce instance
+func ReadSeries(t *testing.T) []*monitoringpb.TimeSeries {
+	_, file, _, _ := runtime.Caller(0)
+	content, err := ioutil.ReadFile(filepath.Join(filepath.Dir(file), "testdata", "series.json"))
+	assert.NoError(t, err)
+	series := make([]*monitoringpb.TimeSeries, 0)
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		s := &monitoringpb.TimeSeries{}
+		assert.NoError(t, jsonpb.UnmarshalString(line, s))
+		series = append(series, s)
+	}
+	return series
+}
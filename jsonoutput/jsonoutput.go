@@ -1,8 +1,10 @@
 package jsonoutput
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -10,14 +12,13 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
 	"github.com/fernhtls/stackdriverExporter/utils"
 	"github.com/gogo/protobuf/jsonpb"
-	"google.golang.org/api/iterator"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
-// JSONOutput : Struct type for json output
+// JSONOutput : Struct type for json output, writing a file for every window of series received
 type JSONOutput struct {
 	Logger     *log.Logger
 	OutputPath string
@@ -38,55 +39,66 @@ func (j *JSONOutput) ValidateOutputPath() error {
 	return nil
 }
 
-func (j *JSONOutput) buildFileName(metricType string, startTime *timestamppb.Timestamp, endTime *timestamppb.Timestamp) string {
+func (j *JSONOutput) buildFileName(projectID, metricType string, startTime *timestamppb.Timestamp, endTime *timestamppb.Timestamp) string {
 	exp := regexp.MustCompile(`[^\w]`)
 	fileName := strings.Join([]string{
+		exp.ReplaceAllString(projectID, "-"),
 		exp.ReplaceAllString(metricType, "-"),
 		strconv.FormatInt(startTime.AsTime().Unix(), 10),
 		strconv.FormatInt(endTime.AsTime().Unix(), 10)}, "_")
 	return filepath.Join(j.OutputPath, fileName+".json")
 }
 
-// GetTimeSeriesMetric : writes the metrics capture for the interval in file
-func (j *JSONOutput) GetTimeSeriesMetric(client *stackdriverClient.StackDriverClient, metric, cronInterval string) {
-	startTime, endTime, err := utils.GetStartAndEndTimeCronJobs(cronInterval)
+// Write : writes the series of the batch in the file of its window, through a temporary file renamed once written
+// so a file is never half written, and a window written again replaces its file
+func (j *JSONOutput) Write(ctx context.Context, batch utils.Batch) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fileName := j.buildFileName(batch.ProjectID, batch.Metric.MetricType, timestamppb.New(batch.Start),
+		timestamppb.New(batch.End))
+	f, err := os.Create(fileName + ".tmp")
 	if err != nil {
-		j.Logger.Println(fmt.Errorf("error on getting start and end time : %v", err))
+		return fmt.Errorf("error on creating file to write: %v", err)
 	}
-	j.Logger.Println("getting metrics for type metric", metric, "start:", startTime.AsTime(), "end:", endTime.AsTime())
-	if err := client.InitClient(); err != nil {
-		j.Logger.Println(fmt.Errorf("error on creating client: %v", err))
+	j.Logger.Println(fmt.Sprintf("Wrtinting to file: %s", fileName))
+	err = MarshalSeries(f, batch.Series, j.Logger)
+	if err == nil {
+		err = f.Sync()
 	}
-	it, err := client.GetTimeSeriesMetric(metric, startTime, endTime)
-	if err != nil {
-		j.Logger.Println(fmt.Errorf("error on creating client: %v", err))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
-	fileName := j.buildFileName(metric, startTime, endTime)
-	f, err := os.Create(fileName)
 	if err != nil {
-		j.Logger.Println(fmt.Errorf("error on creating file to write: %v", err))
+		os.Remove(f.Name())
+		return err
 	}
-	defer f.Close()
-	j.Logger.Println(fmt.Sprintf("Wrtinting to file: %s", fileName))
-	for {
-		resp, err := it.Next()
-		if err == iterator.Done {
-			j.Logger.Println(fmt.Errorf("done error: %v", err))
-			break
-		}
-		if err != nil {
-			j.Logger.Println(fmt.Errorf("error retrieving timeseries values: %v", err))
-		}
-		jm := jsonpb.Marshaler{}
-		resJSON, err := jm.MarshalToString(resp)
+	return os.Rename(f.Name(), fileName)
+}
+
+// Flush : nothing to flush, every batch being written in its file
+func (j *JSONOutput) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Close : nothing to release, the files being closed once written
+func (j *JSONOutput) Close() error {
+	return nil
+}
+
+// MarshalSeries : writes the series, one json document by line
+// series failing to marshal are logged and skipped
+func MarshalSeries(w io.Writer, series []*monitoringpb.TimeSeries, logger *log.Logger) error {
+	jm := jsonpb.Marshaler{}
+	for _, s := range series {
+		resJSON, err := jm.MarshalToString(s)
 		if err != nil {
-			j.Logger.Println(err)
+			logger.Println(err)
+			continue
 		}
-		_, err = f.WriteString(resJSON + "\n")
-		if err != nil {
-			j.Logger.Println(fmt.Errorf("error on writing to file : %v", err))
-			break
+		if _, err = io.WriteString(w, resJSON+"\n"); err != nil {
+			return fmt.Errorf("error on writing to file : %v", err)
 		}
 	}
-	f.Sync()
+	return nil
 }
@@ -1,14 +1,21 @@
 package jsonoutput
 
 import (
+	"context"
+	"io/ioutil"
+	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"testing"
 
+	"github.com/fernhtls/stackdriverExporter/internal/testutil"
 	"github.com/fernhtls/stackdriverExporter/utils"
 
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func TestBuildFileName(t *testing.T) {
@@ -19,10 +26,10 @@ func TestBuildFileName(t *testing.T) {
 	if err != nil {
 		t.Error("error on generating test file name")
 	}
-	fileName := j.buildFileName("storage.googleapis.com/storage/object_count", startTime, endTime)
+	fileName := j.buildFileName("deployments-metrics", "storage.googleapis.com/storage/object_count", startTime, endTime)
 	startTimeUnixString := strconv.FormatInt(startTime.AsTime().Unix(), 10)
 	endTimeUnixString := strconv.FormatInt(endTime.AsTime().Unix(), 10)
-	fileNameCompare := "/tmp/storage-googleapis-com-storage-object_count_" + startTimeUnixString + "_" + endTimeUnixString + ".json"
+	fileNameCompare := "/tmp/deployments-metrics_storage-googleapis-com-storage-object_count_" + startTimeUnixString + "_" + endTimeUnixString + ".json"
 	t.Log("fileName: ", fileName)
 	t.Log("fileNameCompare: ", fileNameCompare)
 	assert.Equal(t, fileName, fileNameCompare)
@@ -54,3 +61,51 @@ func TestValidateOutputMethod(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jsonoutput")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	j := JSONOutput{
+		OutputPath: dir,
+		Logger:     log.New(ioutil.Discard, "", 0),
+	}
+	start := time.Date(2020, 10, 1, 10, 0, 0, 0, time.UTC)
+	batch := utils.Batch{
+		ProjectID: "deployments-metrics",
+		Metric:    utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/object_count"},
+		Start:     start,
+		End:       start.Add(time.Hour),
+		Series:    testutil.ReadSeries(t),
+	}
+	assert.Equal(t, 4, len(batch.Series))
+	assert.NoError(t, j.Write(context.Background(), batch))
+	assert.NoError(t, j.Flush(context.Background()))
+	fileName := j.buildFileName(batch.ProjectID, batch.Metric.MetricType, timestamppb.New(batch.Start),
+		timestamppb.New(batch.End))
+	// one series by line, in the order of the batch
+	content, err := ioutil.ReadFile(fileName)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Equal(t, len(batch.Series), len(lines))
+	for i, bucket := range []string{"prod-assets", "prod-backups", "staging-assets"} {
+		assert.Contains(t, lines[i], `"bucket_name":"`+bucket+`"`)
+	}
+	assert.Contains(t, lines[0], `"int64Value":"1204"`)
+	// written again, replacing the file
+	batch.Series = batch.Series[:1]
+	assert.NoError(t, j.Write(context.Background(), batch))
+	content, err = ioutil.ReadFile(fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(strings.Split(strings.TrimSpace(string(content)), "\n")))
+	// no temporary file left
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+	// nothing written once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	batch.End = batch.End.Add(time.Hour)
+	assert.Error(t, j.Write(ctx, batch))
+	assert.NoError(t, j.Close())
+}
@@ -1,25 +1,59 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"github.com/fernhtls/stackdriverExporter/prometheusOutput"
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/fernhtls/stackdriverExporter/collector"
+	"github.com/fernhtls/stackdriverExporter/config"
 	"github.com/fernhtls/stackdriverExporter/jsonoutput"
+	"github.com/fernhtls/stackdriverExporter/prometheusOutput"
+	"github.com/fernhtls/stackdriverExporter/selfmetrics"
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
 	"github.com/fernhtls/stackdriverExporter/utils"
 	"github.com/robfig/cron/v3"
 )
 
 type metricsListType []string
 
-var projectID string
+var configFile string
+var configReloadInterval time.Duration
+var projectIDs metricsListType
+var metricsScope string
 var metricsList metricsListType
+var metricExcludes metricsListType
+var metadataLabels metricsListType
+var discoveryInterval time.Duration
+var prometheusMode string
+var scrapeCacheTTL time.Duration
+var prometheusLookback time.Duration
+var prometheusPollJitter time.Duration
 var outputTypeArg string
-var outputType int
 var outputPath string
+var writeRetries int
+var callTimeout time.Duration
+var jobTimeout time.Duration
+var apiRetries int
+var apiRetryBackoff time.Duration
+var apiMaxRetryBackoff time.Duration
+var readRequestsPerMinute int
+var jsonStateFile string
+var jsonLag time.Duration
+var jsonMaxWindow time.Duration
+var statusFile string
+var shutdownTimeout time.Duration
+var webListenAddress string
+var webPort int
+var webPath string
+var webConfigFile string
+var exporterConfig *config.Config
 var cronServer *cron.Cron
 var cronLogger *log.Logger
 
@@ -34,98 +68,525 @@ func (m *metricsListType) Set(value string) error {
 
 func init() {
 	// Definitions of all flags to run and get from command line
+	// the defaults are the defaults of the config file, flags override the config file
+	defaults := config.Default()
 	flag.Usage = func() {
 		fmt.Println("Help / Usage of stackdriverExporter :")
 		fmt.Println("")
 		flag.PrintDefaults()
 		fmt.Println("")
+		fmt.Println("Subcommands (see stackdriverExporter <subcommand> --help):")
+		fmt.Println("  backfill		exports a time range of the metrics of a project in json files")
+		fmt.Println("  list-metrics		lists the metric descriptors of a project")
+		fmt.Println("  describe-metric	describes a metric with its monitored resources")
+		fmt.Println("  query			prints the time series of a metric, from one api call")
+		fmt.Println("")
 	}
-	flag.StringVar(&projectID, "project_id", "", "gcp project id to connect and extract the metrics")
-	flag.StringVar(&outputTypeArg, "output_type", "json", "output type for pushing the metrics extracted")
+	flag.StringVar(&configFile, "config_file", "",
+		"yaml or json config file with the projects, metrics and outputs (flags override the config file)")
+	flag.DurationVar(&configReloadInterval, "config_reload_interval", 30*time.Second,
+		"interval to check the config file for changes, reloading the metrics (0 reloads only on SIGHUP)")
+	flag.Var(&projectIDs, "project_id",
+		"gcp project id to connect and extract the metrics (pass --project_id multiple times, or comma separated, for multiple projects)")
+	flag.StringVar(&metricsScope, "metrics_scope", "",
+		"gcp metrics scope host project, extracting the metrics of all the monitored projects of the scope")
+	flag.StringVar(&outputTypeArg, "output_type", defaults.Output.Type,
+		"output type for pushing the metrics extracted, or output types separated by comma like json,prometheus to feed all of them")
 	flag.StringVar(&outputPath, "output_path", "", "optional for when extracting the data to json")
+	flag.IntVar(&writeRetries, "write_retries", defaults.Output.WriteRetries,
+		"times a window failed in an output is written again before waiting for the next run (json output)")
+	flag.DurationVar(&callTimeout, "call_timeout", defaults.Output.CallTimeout,
+		"timeout of every call to the cloud monitoring api, like every page of the time series (0 for no timeout)")
+	flag.DurationVar(&jobTimeout, "job_timeout", defaults.Output.JobTimeout,
+		"deadline of a whole run of a metric job in json output (0 for cancelling the run only on the next cron tick)")
+	flag.IntVar(&apiRetries, "api_retries", defaults.Output.APIRetries,
+		"times a call to the cloud monitoring api failing with unavailable, deadline exceeded or resource exhausted is made again")
+	flag.DurationVar(&apiRetryBackoff, "api_retry_backoff", defaults.Output.APIRetryBackoff,
+		"backoff before retrying a call to the cloud monitoring api, doubled on every retry with jitter")
+	flag.DurationVar(&apiMaxRetryBackoff, "api_max_retry_backoff", defaults.Output.APIMaxRetryBackoff,
+		"longest backoff between two retries of a call to the cloud monitoring api")
+	flag.IntVar(&readRequestsPerMinute, "read_requests_per_minute", defaults.Output.ReadRequestsPerMinute,
+		"read requests per minute to the cloud monitoring api, shared by all the jobs (0 for no limit)")
+	flag.StringVar(&jsonStateFile, "json_state_file", "",
+		"file with the last exported end time of every metric in json output (.stackdriver_exporter_state.json in the output path when empty)")
+	flag.DurationVar(&jsonLag, "json_lag", defaults.Output.JSON.Lag,
+		"time not exported yet before now in json output, for the points ingested late by stackdriver")
+	flag.DurationVar(&jsonMaxWindow, "json_max_window", defaults.Output.JSON.MaxWindow,
+		"longest window written in a json file, as when catching up the windows missed while the exporter was stopped")
 	textMetricFlag := "Metric types to extract (pass --metric_type multiple time to extract multiple metrics)"
 	textMetricFlag += "\nAfter a pipe character (\"|\"), add as well the interval to collect the metric as a cron expression like \"5/* * * * *\""
+	textMetricFlag += "\nAfter a second pipe, optionally add a cloud monitoring filter for the metric (interval can be left blank for the default)"
+	textMetricFlag += "\nAfter a third pipe, optionally add the aggregation as \"alignment_period,aligner[,reducer[,group_by_field...]]\""
 	textMetricFlag += "\nExample: --metric_type \"storage.googleapis.com/storage/total_bytes|*/5 * * * *\" "
+	textMetricFlag += "\nExample: --metric_type \"storage.googleapis.com/storage/total_bytes||resource.labels.bucket_name = starts_with(\\\"prod-\\\")\" "
+	textMetricFlag += "\nExample: --metric_type \"bigquery.googleapis.com/query/count|||300s,ALIGN_DELTA,REDUCE_SUM,resource.labels.project_id\" "
 	flag.Var(&metricsList, "metric_type", textMetricFlag)
+	textExcludeFlag := "Regular expression of metric types to leave out when expanding patterns like \"storage.googleapis.com/*\""
+	textExcludeFlag += "\n(pass --metric_exclude multiple times to exclude multiple expressions)"
+	flag.Var(&metricExcludes, "metric_exclude", textExcludeFlag)
+	textMetadataFlag := "Metadata label of the series to add as prometheus label, as \"system:key\" or \"user:key\""
+	textMetadataFlag += "\n(pass --metadata_label multiple times to add multiple labels)"
+	flag.Var(&metadataLabels, "metadata_label", textMetadataFlag)
+	flag.DurationVar(&discoveryInterval, "discovery_interval", defaults.Discovery.Interval,
+		"interval to expand again the metric type patterns, adding new metric types found (0 expands only on start)")
+	flag.StringVar(&prometheusMode, "prometheus_mode", defaults.Output.Prometheus.Mode,
+		"prometheus output mode: poll (gathers every metric at its interval) or scrape (queries stackdriver when scraped)")
+	flag.DurationVar(&scrapeCacheTTL, "scrape_cache_ttl", defaults.Output.Prometheus.ScrapeCacheTTL,
+		"time the results are kept in prometheus scrape mode before querying stackdriver again")
+	flag.DurationVar(&prometheusLookback, "prometheus_lookback", defaults.Output.Prometheus.Lookback,
+		"window queried for the latest points of the metrics in prometheus output (never shorter than the metric interval)")
+	flag.DurationVar(&prometheusPollJitter, "prometheus_poll_jitter", defaults.Output.Prometheus.PollJitter,
+		"maximum random delay of the first poll of every metric in prometheus poll mode, spreading the api calls")
+	flag.StringVar(&webListenAddress, "web_listen_address", defaults.Output.Prometheus.ListenAddress,
+		"address to bind the prometheus endpoint (all the interfaces when empty)")
+	flag.IntVar(&webPort, "web_port", defaults.Output.Prometheus.Port, "port of the prometheus endpoint")
+	flag.StringVar(&webPath, "web_path", defaults.Output.Prometheus.Path,
+		"path of the prometheus endpoint, like /metrics/gcp")
+	flag.StringVar(&webConfigFile, "web_config_file", "",
+		"optional yaml file with the tls and basic auth / bearer token config of the prometheus endpoint")
+	flag.StringVar(&statusFile, "status_file", "",
+		"optional json file where the exporter self metrics are written every minute")
+	flag.DurationVar(&shutdownTimeout, "shutdown_timeout", defaults.ShutdownTimeout,
+		"time waited on SIGINT or SIGTERM for the running jobs to finish, before cancelling them and exiting")
 	cronLogger = log.New(os.Stdout, "cron_server: ", log.LstdFlags)
 	// New cron server
+	// Recovering from panics so a job failing doesn't stop the other jobs
 	cronServer = cron.New(
 		cron.WithLogger(
-			cron.VerbosePrintfLogger(cronLogger)))
+			cron.VerbosePrintfLogger(cronLogger)),
+		cron.WithChain(
+			cron.Recover(cron.VerbosePrintfLogger(cronLogger))))
+}
+
+// loads the config file and overrides it with the flags passed on command line
+// called again on reloads, so the flags keep overriding the config file
+func buildConfig() (*config.Config, error) {
+	c := config.Default()
+	if configFile != "" {
+		var err error
+		if c, err = config.Load(configFile); err != nil {
+			return nil, err
+		}
+	}
+	// only the flags passed on command line override the config file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "project_id":
+			c.SetProjectFlags(projectIDs)
+			c.MetricsScope = ""
+		case "metrics_scope":
+			c.MetricsScope = metricsScope
+			c.Projects = nil
+		case "output_type":
+			c.Output.Type = outputTypeArg
+		case "output_path":
+			c.Output.JSON.Path = outputPath
+		case "write_retries":
+			c.Output.WriteRetries = writeRetries
+		case "call_timeout":
+			c.Output.CallTimeout = callTimeout
+		case "job_timeout":
+			c.Output.JobTimeout = jobTimeout
+		case "api_retries":
+			c.Output.APIRetries = apiRetries
+		case "api_retry_backoff":
+			c.Output.APIRetryBackoff = apiRetryBackoff
+		case "api_max_retry_backoff":
+			c.Output.APIMaxRetryBackoff = apiMaxRetryBackoff
+		case "read_requests_per_minute":
+			c.Output.ReadRequestsPerMinute = readRequestsPerMinute
+		case "json_state_file":
+			c.Output.JSON.StateFile = jsonStateFile
+		case "json_lag":
+			c.Output.JSON.Lag = jsonLag
+		case "json_max_window":
+			c.Output.JSON.MaxWindow = jsonMaxWindow
+		case "metric_exclude":
+			c.Discovery.Excludes = metricExcludes
+		case "metadata_label":
+			c.Output.Prometheus.MetadataLabels = metadataLabels
+		case "discovery_interval":
+			c.Discovery.Interval = discoveryInterval
+		case "prometheus_mode":
+			c.Output.Prometheus.Mode = prometheusMode
+		case "scrape_cache_ttl":
+			c.Output.Prometheus.ScrapeCacheTTL = scrapeCacheTTL
+		case "prometheus_lookback":
+			c.Output.Prometheus.Lookback = prometheusLookback
+		case "prometheus_poll_jitter":
+			c.Output.Prometheus.PollJitter = prometheusPollJitter
+		case "web_listen_address":
+			c.Output.Prometheus.ListenAddress = webListenAddress
+		case "web_port":
+			c.Output.Prometheus.Port = webPort
+		case "web_path":
+			c.Output.Prometheus.Path = webPath
+		case "web_config_file":
+			c.Output.Prometheus.WebConfigFile = webConfigFile
+		case "status_file":
+			c.StatusFile = statusFile
+		case "shutdown_timeout":
+			c.ShutdownTimeout = shutdownTimeout
+		}
+	})
+	if len(projectIDs) > 0 && metricsScope != "" {
+		return nil, errors.New("use either project id or metrics scope")
+	}
+	// metrics are parsed after the output type, the interval depending on the output
+	if err := c.SetMetricFlags(metricsList); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
-// validation of flags being passed on command line
-func validateFlags() {
-	switch outputTypeArg {
-	case "json":
-		outputType = utils.JSONOutput
-	case "prometheus":
-		outputType = utils.PrometheusOutput
-	default:
-		log.Fatal("output type not valid")
+// loads and validates the config on start
+func loadConfig() {
+	c, err := buildConfig()
+	if err != nil {
+		log.Fatal(err)
 	}
-	if projectID == "" {
-		log.Fatal("project id is mandatory")
+	if err = c.Validate(); err != nil {
+		log.Fatal(err)
 	}
-	if len(metricsList) == 0 {
-		log.Fatal("provide at least one metrics to be extracted")
+	exporterConfig = c
+}
+
+// reloads the config on SIGHUP or when the config file changes, applying the new metrics
+func startConfigReloader(apply func([]utils.MetricsAndIntervalType)) {
+	reloader := &config.Reloader{
+		Path:     configFile,
+		Interval: configReloadInterval,
+		Load:     buildConfig,
+		Apply: func(c *config.Config) {
+			metrics, err := c.MetricsAndIntervals()
+			if err != nil {
+				cronLogger.Println(fmt.Errorf("error on reloading metrics list: %v", err))
+				return
+			}
+			apply(metrics)
+		},
+		Logger: log.New(os.Stdout, "config_reloader: ", log.LstdFlags),
+	}
+	reloader.Start(exporterConfig)
+}
+
+// sends the metrics of a reload without blocking, dropping the metrics of the previous reload not received yet
+func replacePendingReload(reloads chan []utils.MetricsAndIntervalType, metrics []utils.MetricsAndIntervalType) {
+	for {
+		select {
+		case reloads <- metrics:
+			return
+		default:
+		}
+		select {
+		case <-reloads:
+		default:
+		}
 	}
 }
 
 func startCronServer() {
+	metricTypes := make([]string, 0, len(exporterConfig.Metrics))
+	for _, m := range exporterConfig.Metrics {
+		metricTypes = append(metricTypes, m.Type)
+	}
 	fmt.Println("")
-	fmt.Println("  Project: ", "\t\t", projectID)
-	fmt.Println("  Metrics list: ", "\t", metricsList.String())
+	fmt.Println("  Projects: ", "\t\t", strings.Join(exporterConfig.GetProjectIDs(), ", "))
+	fmt.Println("  Metrics list: ", "\t", strings.Join(metricTypes, ", "))
 	fmt.Println("")
 	if len(cronServer.Entries()) == 0 {
 		log.Fatal("no jobs were added to the cronserver")
 	}
-	cronServer.Run()
+	cronServer.Start()
 }
 
-func buildJobsOutPut() {
-	switch outputType {
-	case utils.JSONOutput:
-		metricsAndIntervals, err := utils.SetMetricsAndIntervalList(metricsList, utils.JSONOutput)
+// adds a job to the cron server expanding again the metric patterns and adding the new metric types found
+// patterns are checked on every run, as they can be added on config reloads
+// a run is cancelled with the context, or when still listing the metrics at the next run
+func addDiscoveryJob(ctx context.Context, jobs *utils.CronJobs, discovery *utils.MetricsDiscovery) {
+	if exporterConfig.Discovery.Interval <= 0 {
+		return
+	}
+	cronServer.Schedule(cron.Every(exporterConfig.Discovery.Interval), cron.FuncJob(func() {
+		if !discovery.HasPatterns() {
+			return
+		}
+		ctx, cancel := context.WithTimeout(ctx, exporterConfig.Discovery.Interval)
+		defer cancel()
+		// the metric types of the patterns listed are added, the patterns failing being listed again on the next run
+		metrics, err := discovery.Expand(ctx)
 		if err != nil {
-			log.Fatal("error on setting metrics list:", err)
+			cronLogger.Println(fmt.Errorf("error on discovering metrics for project %s: %v", jobs.Client().ProjectID, err))
 		}
-		if outputPath == "" {
-			log.Fatal("should pass a output_path for json output")
+		added, err := jobs.AddJobs(metrics)
+		if err != nil {
+			cronLogger.Println(fmt.Errorf("error on adding discovered metrics: %v", err))
 		}
-		j := jsonoutput.JSONOutput{
-			OutputPath: outputPath,
-			Logger:     cronLogger,
+		if len(added) > 0 {
+			cronLogger.Println("added jobs for discovered metrics:", strings.Join(added, ", "))
 		}
-		if err = j.ValidateOutputPath(); err != nil {
+	}))
+}
+
+// syncs the jobs of every project with the reloaded metrics, leaving the jobs of the metrics not changed
+// returns the metrics expanded in all the projects, the listings being cancelled with the context
+// the reload is rejected when the metrics fail to be expanded in any of the projects, keeping the current jobs
+// as a project left out would have all its jobs removed
+func syncJobs(ctx context.Context, projectsJobs []*utils.CronJobs, discoveries []*utils.MetricsDiscovery,
+	metrics []utils.MetricsAndIntervalType) ([]utils.MetricsAndIntervalType, error) {
+	expanded := make([][]utils.MetricsAndIntervalType, len(projectsJobs))
+	for i, jobs := range projectsJobs {
+		var err error
+		if expanded[i], err = discoveries[i].ExpandMetrics(ctx, metrics); err != nil {
+			return nil, fmt.Errorf("error on expanding metrics list for project %s: %v", jobs.Client().ProjectID, err)
+		}
+	}
+	synced := make([]utils.MetricsAndIntervalType, 0)
+	for i, jobs := range projectsJobs {
+		projectID := jobs.Client().ProjectID
+		discoveries[i].SetMetrics(metrics)
+		synced = append(synced, expanded[i]...)
+		added, removed, err := jobs.SyncJobs(expanded[i])
+		if err != nil {
+			cronLogger.Println(fmt.Errorf("error on syncing jobs for project %s: %v", projectID, err))
+		}
+		cronLogger.Printf("reloaded jobs for project %s, added: [%s] removed: [%s]\n", projectID,
+			strings.Join(added, ", "), strings.Join(removed, ", "))
+	}
+	return synced, nil
+}
+
+// gets the metrics routed to the output type
+func getRoutedMetrics(metrics []utils.MetricsAndIntervalType, outputType string) []utils.MetricsAndIntervalType {
+	routed := make([]utils.MetricsAndIntervalType, 0, len(metrics))
+	for _, m := range metrics {
+		if m.RoutedTo(outputType) {
+			routed = append(routed, m)
+		}
+	}
+	return routed
+}
+
+// creates the clients of the projects, shared by the jobs and the outputs until closed on exit
+// projects failing to create their client are logged and left out
+func newProjectClients() []*stackdriverClient.StackDriverClient {
+	clients := make([]*stackdriverClient.StackDriverClient, 0)
+	for _, projectID := range exporterConfig.GetProjectIDs() {
+		client := &stackdriverClient.StackDriverClient{ProjectID: projectID}
+		if err := client.InitClient(); err != nil {
+			cronLogger.Println(fmt.Errorf("error on creating client for project %s: %v", projectID, err))
+			continue
+		}
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// builds the sinks of the outputs fed by the cron jobs, json and optionally prometheus, with the clients of the jobs
+// the prometheus config is returned for serving the metrics set by its sink, nil without prometheus output
+func buildSinks(clients []*stackdriverClient.StackDriverClient) (map[string]utils.Sink, *prometheusOutput.Sink,
+	*prometheusOutput.OutputConfig) {
+	j := &jsonoutput.JSONOutput{
+		OutputPath: exporterConfig.Output.JSON.Path,
+		Logger:     cronLogger,
+	}
+	if err := j.ValidateOutputPath(); err != nil {
+		log.Fatal(err)
+	}
+	sinks := map[string]utils.Sink{config.JSONOutputType: j}
+	if !exporterConfig.HasOutput(config.PrometheusOutputType) {
+		return sinks, nil, nil
+	}
+	p, err := exporterConfig.PrometheusOutputConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	promSink, err := p.NewSink(clients)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sinks[config.PrometheusOutputType] = promSink
+	return sinks, promSink, &p
+}
+
+// writes the status file every minute, when set
+// in json output the file is the only way to follow the self metrics of the exporter
+func addStatusFileJob() {
+	statusFile := exporterConfig.StatusFile
+	if statusFile == "" {
+		return
+	}
+	cronServer.Schedule(cron.Every(time.Minute), cron.FuncJob(func() {
+		if err := selfmetrics.WriteStatusFile(statusFile); err != nil {
+			cronLogger.Println(fmt.Errorf("error on writing status file: %v", err))
+		}
+	}))
+}
+
+func buildJobsOutPut() {
+	metricsAndIntervals, err := exporterConfig.MetricsAndIntervals()
+	if err != nil {
+		log.Fatal("error on setting metrics list:", err)
+	}
+	addStatusFileJob()
+	// all the clients share the retry policy and the read limit
+	stackdriverClient.SetRetryPolicy(exporterConfig.RetryPolicy())
+	stackdriverClient.SetReadLimit(exporterConfig.Output.ReadRequestsPerMinute)
+	switch {
+	case exporterConfig.HasOutput(config.JSONOutputType):
+		excludes, err := utils.CompileMetricExcludes(exporterConfig.Discovery.Excludes)
+		if err != nil {
 			log.Fatal(err)
 		}
-		if err = utils.AddJobs(cronServer, metricsAndIntervals, projectID, &j); err != nil {
-			log.Fatal("error on adding jobs to cron server:", err)
+		// every fetch of the jobs feeds all the outputs of the metric
+		clients := newProjectClients()
+		sinks, promSink, p := buildSinks(clients)
+		c := &collector.Collector{
+			Logger:       cronLogger,
+			Sinks:        sinks,
+			Lag:          exporterConfig.Output.JSON.Lag,
+			MaxWindow:    exporterConfig.Output.JSON.MaxWindow,
+			WriteRetries: exporterConfig.Output.WriteRetries,
+			RetryDelay:   collector.DefaultRetryDelay,
+		}
+		if c.Watermarks, err = collector.LoadWatermarks(exporterConfig.Output.JSON.GetStateFile()); err != nil {
+			log.Fatal(err)
+		}
+		// runs of the jobs are cancelled when they don't finish within the shutdown timeout
+		jobsCtx, cancelJobs := context.WithCancel(context.Background())
+		var catchUps sync.WaitGroup
+		// errors on a project are logged and don't stop the jobs of the other projects
+		projectsJobs := make([]*utils.CronJobs, 0)
+		discoveries := make([]*utils.MetricsDiscovery, 0)
+		for _, client := range clients {
+			projectID := client.ProjectID
+			jobs := utils.NewCronJobs(jobsCtx, cronServer, client, c, cronLogger)
+			discovery := &utils.MetricsDiscovery{
+				Client:   jobs.Client(),
+				Metrics:  metricsAndIntervals,
+				Excludes: excludes,
+			}
+			projectsJobs = append(projectsJobs, jobs)
+			discoveries = append(discoveries, discovery)
+			addDiscoveryJob(jobsCtx, jobs, discovery)
+			// the metrics are scheduled even when patterns fail to be listed, the patterns being listed again
+			// by the discovery job when enabled
+			expanded, err := discovery.Expand(jobsCtx)
+			if err != nil {
+				cronLogger.Println(fmt.Errorf("error on expanding metrics list for project %s: %v", projectID, err))
+			}
+			if _, err = jobs.AddJobs(expanded); err != nil {
+				log.Fatal("error on adding jobs to cron server:", err)
+			}
+			// the windows missed while stopped are exported in the background, the jobs waiting for the catch up
+			catchUps.Add(1)
+			go func(jobs *utils.CronJobs) {
+				defer catchUps.Done()
+				c.CatchUp(jobsCtx, jobs.Client(), expanded)
+			}(jobs)
+		}
+		startConfigReloader(func(metrics []utils.MetricsAndIntervalType) {
+			synced, err := syncJobs(jobsCtx, projectsJobs, discoveries, metrics)
+			if err != nil {
+				cronLogger.Println(fmt.Errorf("reload rejected, keeping the current metrics: %v", err))
+				return
+			}
+			if promSink != nil {
+				// metrics removed or not routed anymore are unregistered from the endpoint
+				promSink.SyncMetrics(jobsCtx, getRoutedMetrics(synced, config.PrometheusOutputType))
+			}
+		})
+		stop := notifyStop()
+		serverCtx, cancelServer := context.WithCancel(context.Background())
+		var serverDone chan error
+		if p != nil {
+			serverDone = make(chan error, 1)
+			go func() {
+				serverDone <- p.Serve(serverCtx, exporterConfig.ShutdownTimeout)
+			}()
 		}
 		startCronServer()
-	case utils.PrometheusOutput:
-		fmt.Println("prometheus output will just start the http server and gather the metrics every minute")
-		metricsAndIntervals, err := utils.SetMetricsAndIntervalList(metricsList, utils.PrometheusOutput)
+		select {
+		case sig := <-stop:
+			cronLogger.Printf("received %s, shutting down\n", sig)
+		case err := <-serverDone:
+			log.Fatal(err)
+		}
+		code := exitClean
+		if !drainJobs(&catchUps, exporterConfig.ShutdownTimeout) {
+			cronLogger.Println("jobs still running after the shutdown timeout, cancelling them")
+			cancelJobs()
+			waitCancelledJobs(&catchUps)
+			code = exitShutdownTimeout
+		}
+		if !closeJobs(projectsJobs, c) && code == exitClean {
+			code = exitShutdownError
+		}
+		if p != nil && !stopServer(cancelServer, serverDone) && code == exitClean {
+			code = exitShutdownError
+		}
+		cancelJobs()
+		cancelServer()
+		cronLogger.Println("stopped with exit code", code)
+		os.Exit(code)
+	case exporterConfig.HasOutput(config.PrometheusOutputType):
+		fmt.Println("prometheus output will just start the http server and gather the metrics at their interval")
+		p, err := exporterConfig.PrometheusOutputConfig()
 		if err != nil {
-			log.Fatal("error on setting metrics list:", err)
+			log.Fatal(err)
 		}
-		p := prometheusOutput.OutputConfig{
-			ProjectID: projectID,
-			BaseHandlerPath: "/stackmetrics",
-			Port: 8081,
+		// the cron server only runs the status file job in prometheus output
+		if exporterConfig.StatusFile != "" {
+			cronServer.Start()
 		}
-		if err := p.ValidateConfig(); err != nil {
+		// a reload not applied yet is replaced, so the reloader never waits for a poll or registration running
+		reloads := make(chan []utils.MetricsAndIntervalType, 1)
+		startConfigReloader(func(metrics []utils.MetricsAndIntervalType) {
+			replacePendingReload(reloads, metrics)
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		stop := notifyStop()
+		go func() {
+			sig := <-stop
+			cronLogger.Printf("received %s, shutting down\n", sig)
+			cancel()
+		}()
+		err = p.StartServerPrometheusMetrics(ctx, metricsAndIntervals, reloads, exporterConfig.ShutdownTimeout)
+		if ctx.Err() == nil {
+			// the http server failed before being stopped
 			log.Fatal(err)
 		}
-		p.StartServerPrometheusMetrics(metricsAndIntervals)
+		cronServer.Stop()
+		code := exitClean
+		if err != nil {
+			cronLogger.Println(fmt.Errorf("error on shutting down the http server: %v", err))
+			code = exitShutdownError
+		}
+		cronLogger.Println("stopped with exit code", code)
+		os.Exit(code)
 	default: // stops process - unrecognized output
 		log.Fatal("output type not allowed")
 	}
 }
 
+// subcommands run instead of the exporter, with their own flags
+var subcommands = map[string]func(args []string) error{
+	"backfill":        runBackfill,
+	"list-metrics":    runListMetrics,
+	"describe-metric": runDescribeMetric,
+	"query":           runQuery,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
 	flag.Parse()
-	validateFlags()
+	loadConfig()
 	buildJobsOutPut()
 }
@@ -0,0 +1,217 @@
+package prometheusOutput
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/selfmetrics"
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+	"github.com/fernhtls/stackdriverExporter/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/api/iterator"
+	"google.golang.org/genproto/googleapis/api/distribution"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// longest time a scrape queries stackdriver, the metrics not fetched in time keeping their last results
+const scrapeTimeout = time.Minute
+
+// ScrapeCollector : prometheus collector querying stackdriver when scraped
+// results are kept for the cache ttl, and metrics are stamped with the end time of the point
+// series not returned anymore by stackdriver are not exported on the next query
+// on errors the last results of the metric are kept, and stackdriver is queried again on the next scrape
+type ScrapeCollector struct {
+	ctx            context.Context
+	clients        []*stackdriverClient.StackDriverClient
+	cacheTTL       time.Duration
+	lookback       time.Duration
+	metadataLabels []MetadataLabel
+	mu             sync.Mutex
+	metrics        map[string]*scrapeMetric
+	pending        *pendingMetrics
+}
+
+// definition and cached results of a metric, by project
+type scrapeMetric struct {
+	def       *metricDefinition
+	mu        sync.Mutex
+	fetchedAt time.Time
+	results   map[string][]prometheus.Metric
+}
+
+// NewScrapeCollector : creates the collector for the projects, with the ttl of the cached results
+// and the lookback for the latest points of the metrics, the calls of the scrapes being cancelled with the context
+func NewScrapeCollector(ctx context.Context, clients []*stackdriverClient.StackDriverClient, cacheTTL,
+	lookback time.Duration, metadataLabels []MetadataLabel) *ScrapeCollector {
+	return &ScrapeCollector{
+		ctx:            ctx,
+		clients:        clients,
+		cacheTTL:       cacheTTL,
+		lookback:       lookback,
+		metadataLabels: metadataLabels,
+		metrics:        make(map[string]*scrapeMetric),
+		pending:        newPendingMetrics(),
+	}
+}
+
+// AddMetrics : adds the metrics not yet in the collector, so it can be called again for discovered metrics
+// metrics failing to be added are added again on the next scrape, the descriptor calls being cancelled with the context
+func (c *ScrapeCollector) AddMetrics(ctx context.Context, metrics []utils.MetricsAndIntervalType) {
+	for _, m := range metrics {
+		c.mu.Lock()
+		_, ok := c.metrics[m.MetricType]
+		c.mu.Unlock()
+		if ok {
+			continue
+		}
+		def, err := buildMetricDefinition(ctx, c.clients, m, c.metadataLabels)
+		if err != nil {
+			collectionError(m.MetricType, "", registerStage, err)
+			c.pending.add(m)
+			continue
+		}
+		if def.valueType == metricpb.MetricDescriptor_STRING {
+			prometheusLogger.Printf("no string metrics in prometheus, skipping %s\n", m.MetricType)
+			continue
+		}
+		c.mu.Lock()
+		c.metrics[m.MetricType] = &scrapeMetric{def: def, results: make(map[string][]prometheus.Metric)}
+		c.mu.Unlock()
+		prometheusLogger.Printf("added metric %s to the scrape collector\n", m.MetricType)
+	}
+}
+
+// Describe : implements prometheus.Collector, sending no descriptions as metrics are added on discovery
+func (c *ScrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+// Collect : implements prometheus.Collector, querying stackdriver for the metrics with expired results
+// the calls are cancelled after the scrape timeout, or with the context of the collector
+func (c *ScrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(c.ctx, scrapeTimeout)
+	defer cancel()
+	c.AddMetrics(ctx, c.pending.take())
+	c.mu.Lock()
+	metrics := make([]*scrapeMetric, 0, len(c.metrics))
+	for _, m := range c.metrics {
+		metrics = append(metrics, m)
+	}
+	c.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, m := range metrics {
+		wg.Add(1)
+		go func(m *scrapeMetric) {
+			defer wg.Done()
+			isolateMetric(m.def.metric.MetricType, func() {
+				for _, result := range c.getResults(ctx, m) {
+					ch <- result
+				}
+			})
+		}(m)
+	}
+	wg.Wait()
+}
+
+// gets the cached results of the metric, querying stackdriver when the cache is expired
+func (c *ScrapeCollector) getResults(ctx context.Context, m *scrapeMetric) []prometheus.Metric {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fetchedAt.IsZero() || time.Since(m.fetchedAt) >= c.cacheTTL {
+		c.fetchResults(ctx, m)
+	}
+	results := make([]prometheus.Metric, 0)
+	for _, projectResults := range m.results {
+		results = append(results, projectResults...)
+	}
+	return results
+}
+
+// queries stackdriver for the results of the metric in all the projects
+// a project failing keeps its last results, so the series don't disappear on transient errors
+func (c *ScrapeCollector) fetchResults(ctx context.Context, m *scrapeMetric) {
+	metricType := m.def.metric.MetricType
+	defer selfmetrics.ObserveCollectionDuration("prometheus", metricType, time.Now())
+	startTime, endTime, err := getMinuteIntervalTimes(m.def.metric, c.lookback)
+	if err != nil {
+		collectionError(metricType, "", intervalStage, err)
+		return
+	}
+	for _, client := range c.clients {
+		it, err := getMetricValue(ctx, client, m.def.metric, startTime, endTime)
+		if err != nil {
+			collectionError(metricType, client.ProjectID, queryStage, err)
+			continue
+		}
+		projectResults, err := appendScrapeResults(nil, m.def, client.ProjectID, it.Next)
+		if err != nil {
+			collectionError(metricType, client.ProjectID, queryStage, err)
+			continue
+		}
+		m.results[client.ProjectID] = projectResults
+	}
+	m.fetchedAt = time.Now()
+}
+
+// appends the const metrics of the series returned by next, using the latest point of every series
+// series without a valid value are logged and skipped, only the errors of next stopping the project
+func appendScrapeResults(results []prometheus.Metric, def *metricDefinition, projectID string,
+	next func() (*monitoringpb.TimeSeries, error)) ([]prometheus.Metric, error) {
+	for {
+		resp, err := next()
+		if err == iterator.Done {
+			return results, nil
+		}
+		if err != nil {
+			return results, err
+		}
+		r, ok := def.resources[resp.Resource.Type]
+		if !ok {
+			continue
+		}
+		utils.TagProjectID(resp, projectID)
+		var lastPoint *monitoringpb.Point
+		for _, p := range resp.GetPoints() {
+			if lastPoint == nil || p.Interval.EndTime.AsTime().After(lastPoint.Interval.EndTime.AsTime()) {
+				lastPoint = p
+			}
+		}
+		if lastPoint == nil {
+			continue
+		}
+		desc := prometheus.NewDesc(prometheus.BuildFQName("stackdriver", "", r.name), r.help,
+			getSeriesLabelNames(r.labels), nil)
+		labelValues := getSeriesLabelValues(r.labels, resp)
+		var metric prometheus.Metric
+		switch def.valueType {
+		case metricpb.MetricDescriptor_DISTRIBUTION:
+			metric, err = newConstHistogram(desc, lastPoint.Value.GetDistributionValue(), labelValues)
+		default:
+			metric, err = prometheus.NewConstMetric(desc, prometheus.GaugeValue,
+				getMetricValueNumeric(getSeriesValueType(resp, def.valueType), lastPoint), labelValues...)
+		}
+		if err != nil {
+			// a series failing is skipped, the other series of the project being kept
+			collectionError(def.metric.MetricType, projectID, seriesStage,
+				fmt.Errorf("series %v skipped: %v", labelValues, err))
+			continue
+		}
+		results = append(results, prometheus.NewMetricWithTimestamp(lastPoint.Interval.EndTime.AsTime(), metric))
+	}
+}
+
+// creates the const histogram of the distribution
+func newConstHistogram(desc *prometheus.Desc, d *distribution.Distribution,
+	labelValues []string) (prometheus.Metric, error) {
+	if d == nil {
+		return nil, errors.New("no distribution value")
+	}
+	buckets, err := getDistributionBuckets(d)
+	if err != nil {
+		return nil, err
+	}
+	return prometheus.NewConstHistogram(desc, uint64(d.Count), d.Mean*float64(d.Count), buckets, labelValues...)
+}
@@ -0,0 +1,135 @@
+package prometheusOutput
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/utils"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/iterator"
+	"google.golang.org/genproto/googleapis/api/distribution"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// returns a next function iterating the series
+func seriesIterator(series ...*monitoringpb.TimeSeries) func() (*monitoringpb.TimeSeries, error) {
+	return func() (*monitoringpb.TimeSeries, error) {
+		if len(series) == 0 {
+			return nil, iterator.Done
+		}
+		s := series[0]
+		series = series[1:]
+		return s, nil
+	}
+}
+
+func int64Point(t *testing.T, end time.Time, value int64) *monitoringpb.Point {
+	endTime, err := ptypes.TimestampProto(end)
+	assert.NoError(t, err)
+	return &monitoringpb.Point{
+		Interval: &monitoringpb.TimeInterval{EndTime: endTime},
+		Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: value}},
+	}
+}
+
+func TestAppendScrapeResults(t *testing.T) {
+	def := &metricDefinition{
+		metric:    utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/object_count", Interval: "5"},
+		valueType: metricpb.MetricDescriptor_INT64,
+		resources: map[string]resourceDefinition{
+			"gcs_bucket": {
+				name:   "storage_googleapis_storage_object_count_gcs_bucket",
+				help:   "object count",
+				labels: buildSeriesLabels([]string{"bucket_name", "project_id"}, nil, nil),
+			},
+		},
+	}
+	end := time.Now().Truncate(time.Second)
+	series := &monitoringpb.TimeSeries{
+		Resource: &monitoredrespb.MonitoredResource{
+			Type:   "gcs_bucket",
+			Labels: map[string]string{"bucket_name": "bucket"},
+		},
+		Points: []*monitoringpb.Point{
+			int64Point(t, end, 10),
+			int64Point(t, end.Add(-time.Minute), 5),
+		},
+	}
+	// series of resources not in the definition are skipped
+	otherSeries := &monitoringpb.TimeSeries{
+		Resource: &monitoredrespb.MonitoredResource{Type: "other"},
+		Points:   []*monitoringpb.Point{int64Point(t, end, 1)},
+	}
+	results, err := appendScrapeResults(nil, def, "test", seriesIterator(series, otherSeries))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	m := &dto.Metric{}
+	assert.NoError(t, results[0].Write(m))
+	// latest value, stamped with the end time of the point and labeled with the project
+	assert.Equal(t, float64(10), m.GetGauge().GetValue())
+	assert.Equal(t, end.UnixNano()/int64(time.Millisecond), m.GetTimestampMs())
+	assert.Equal(t, "bucket", m.Label[0].GetValue())
+	assert.Equal(t, "test", m.Label[1].GetValue())
+	// errors are returned with the results so far
+	results, err = appendScrapeResults(nil, def, "test", func() (*monitoringpb.TimeSeries, error) {
+		return nil, errors.New("unavailable")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 0, len(results))
+}
+
+func TestAppendScrapeResultsSkipsSeries(t *testing.T) {
+	def := &metricDefinition{
+		metric:    utils.MetricsAndIntervalType{MetricType: "bigquery.googleapis.com/query/execution_times", Interval: "5"},
+		valueType: metricpb.MetricDescriptor_DISTRIBUTION,
+		resources: map[string]resourceDefinition{
+			"global": {
+				name:   "bigquery_googleapis_query_execution_times_global",
+				help:   "execution times",
+				labels: buildSeriesLabels([]string{"location", "project_id"}, nil, nil),
+			},
+		},
+	}
+	newSeries := func(location string, d *distribution.Distribution) *monitoringpb.TimeSeries {
+		point := int64Point(t, time.Now(), 0)
+		point.Value = &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DistributionValue{DistributionValue: d}}
+		return &monitoringpb.TimeSeries{
+			Resource: &monitoredrespb.MonitoredResource{Type: "global", Labels: map[string]string{"location": location}},
+			Points:   []*monitoringpb.Point{point},
+		}
+	}
+	// the series without a valid distribution is skipped, the other series of the project being kept
+	results, err := appendScrapeResults(nil, def, "test", seriesIterator(
+		newSeries("eu", nil),
+		newSeries("us", &distribution.Distribution{Count: 2, Mean: 1}),
+		newSeries("asia", &distribution.Distribution{Count: 1, BucketOptions: &distribution.Distribution_BucketOptions{}}),
+	))
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(results)) {
+		m := &dto.Metric{}
+		assert.NoError(t, results[0].Write(m))
+		assert.Equal(t, uint64(2), m.GetHistogram().GetSampleCount())
+	}
+}
+
+func TestScrapeCollectorCache(t *testing.T) {
+	c := NewScrapeCollector(context.Background(), nil, time.Minute, 0, nil)
+	desc := prometheus.NewDesc("stackdriver_test", "test", nil, nil)
+	cached := prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1)
+	c.metrics["test"] = &scrapeMetric{
+		def:       &metricDefinition{metric: utils.MetricsAndIntervalType{MetricType: "test", Interval: "5"}},
+		fetchedAt: time.Now(),
+		results:   map[string][]prometheus.Metric{"test": {cached}},
+	}
+	// results in the cache are returned without querying stackdriver
+	ch := make(chan prometheus.Metric, 1)
+	c.Collect(ch)
+	assert.Equal(t, cached, <-ch)
+}
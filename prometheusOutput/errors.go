@@ -0,0 +1,84 @@
+package prometheusOutput
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/fernhtls/stackdriverExporter/selfmetrics"
+	"github.com/fernhtls/stackdriverExporter/utils"
+)
+
+// stages of the collection where the errors are counted
+const (
+	registerStage = "register"
+	intervalStage = "interval"
+	queryStage    = "query"
+	seriesStage   = "series"
+	panicStage    = "panic"
+)
+
+// logs and counts the error of the metric, the collection goes on with the other metrics
+func collectionError(metricType, projectID, stage string, err error) {
+	selfmetrics.CollectionError(metricType, projectID, stage)
+	prometheusLogger.Printf("error on %s of metric %s (project: %s): %v\n", stage, metricType, projectID, err)
+}
+
+// runs the collection of the metric, recovering from panics so a metric doesn't stop the others
+func isolateMetric(metricType string, collect func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			collectionError(metricType, "", panicStage, fmt.Errorf("%v", r))
+		}
+	}()
+	collect()
+}
+
+// pendingMetrics : metrics failed to be registered, retried on the next cycle
+type pendingMetrics struct {
+	mu      sync.Mutex
+	metrics map[string]utils.MetricsAndIntervalType
+}
+
+func newPendingMetrics() *pendingMetrics {
+	return &pendingMetrics{
+		metrics: make(map[string]utils.MetricsAndIntervalType),
+	}
+}
+
+// adds the metric to be registered on the next cycle
+func (p *pendingMetrics) add(m utils.MetricsAndIntervalType) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.metrics[m.MetricType] = m
+}
+
+// checks if the metric failed to be registered
+func (p *pendingMetrics) has(metricType string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.metrics[metricType]
+	return ok
+}
+
+// takes all the pending metrics, they are added again if failing one more time
+func (p *pendingMetrics) take() []utils.MetricsAndIntervalType {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	metrics := make([]utils.MetricsAndIntervalType, 0, len(p.metrics))
+	for _, m := range p.metrics {
+		metrics = append(metrics, m)
+	}
+	p.metrics = make(map[string]utils.MetricsAndIntervalType)
+	return metrics
+}
+
+// keeps only the pending metrics of the metric types, as on config reloads
+func (p *pendingMetrics) retain(metricTypes map[string]bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for metricType := range p.metrics {
+		if !metricTypes[metricType] {
+			delete(p.metrics, metricType)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package prometheusOutput
+
+import (
+	"testing"
+
+	"github.com/fernhtls/stackdriverExporter/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPendingMetrics(t *testing.T) {
+	p := newPendingMetrics()
+	p.add(utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/total_bytes", Interval: "5"})
+	p.add(utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/total_bytes", Interval: "5"})
+	metrics := p.take()
+	assert.Equal(t, 1, len(metrics))
+	assert.Equal(t, 0, len(p.take()))
+}
+
+func TestIsolateMetric(t *testing.T) {
+	// panics are recovered and counted
+	assert.NotPanics(t, func() {
+		isolateMetric("storage.googleapis.com/storage/total_bytes", func() {
+			panic("inconsistent label cardinality")
+		})
+	})
+}
@@ -0,0 +1,120 @@
+package prometheusOutput
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/genproto/googleapis/api/distribution"
+)
+
+// DistributionCollector : prometheus collector exporting stackdriver distributions as histograms
+// keeps the last distribution of each series, as the client histograms can only observe single values
+type DistributionCollector struct {
+	desc       *prometheus.Desc
+	mu         sync.Mutex
+	histograms map[string]constHistogram
+}
+
+// histogram values for one series
+type constHistogram struct {
+	labelValues []string
+	count       uint64
+	sum         float64
+	buckets     map[float64]uint64
+}
+
+// NewDistributionCollector : creates the collector for the histograms of a metric and resource type
+func NewDistributionCollector(name, help string, labelKeys []string) *DistributionCollector {
+	return &DistributionCollector{
+		desc:       prometheus.NewDesc(prometheus.BuildFQName("stackdriver", "", name), help, labelKeys, nil),
+		histograms: make(map[string]constHistogram),
+	}
+}
+
+// Describe : implements prometheus.Collector
+func (c *DistributionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect : implements prometheus.Collector, sending a const histogram for every series
+func (c *DistributionCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, h := range c.histograms {
+		ch <- prometheus.MustNewConstHistogram(c.desc, h.count, h.sum, h.buckets, h.labelValues...)
+	}
+}
+
+// Set : sets the distribution of the series with the label values
+func (c *DistributionCollector) Set(labelValues []string, d *distribution.Distribution) error {
+	if d == nil {
+		return errors.New("distribution can't be nil")
+	}
+	buckets, err := getDistributionBuckets(d)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.histograms[strings.Join(labelValues, "\xff")] = constHistogram{
+		labelValues: labelValues,
+		count:       uint64(d.Count),
+		sum:         d.Mean * float64(d.Count),
+		buckets:     buckets,
+	}
+	return nil
+}
+
+// gets the bucket bounds from the bucket options of the distribution
+// linear and exponential options have num_finite_buckets + 1 bounds
+func getDistributionBounds(options *distribution.Distribution_BucketOptions) ([]float64, error) {
+	if options == nil {
+		return nil, nil
+	}
+	switch {
+	case options.GetLinearBuckets() != nil:
+		linear := options.GetLinearBuckets()
+		bounds := make([]float64, 0, linear.NumFiniteBuckets+1)
+		for i := int32(0); i <= linear.NumFiniteBuckets; i++ {
+			bounds = append(bounds, linear.Offset+linear.Width*float64(i))
+		}
+		return bounds, nil
+	case options.GetExponentialBuckets() != nil:
+		exponential := options.GetExponentialBuckets()
+		bounds := make([]float64, 0, exponential.NumFiniteBuckets+1)
+		for i := int32(0); i <= exponential.NumFiniteBuckets; i++ {
+			bounds = append(bounds, exponential.Scale*math.Pow(exponential.GrowthFactor, float64(i)))
+		}
+		return bounds, nil
+	case options.GetExplicitBuckets() != nil:
+		return options.GetExplicitBuckets().Bounds, nil
+	default:
+		return nil, errors.New("unknown bucket options on distribution")
+	}
+}
+
+// gets the cumulative prometheus buckets ("le") from the distribution bucket counts
+// the first stackdriver bucket is the underflow (below the first bound) and the last the overflow,
+// the overflow is only in the count of the histogram (+Inf bucket)
+// bucket counts can have less values than buckets, the missing trailing buckets being zero
+func getDistributionBuckets(d *distribution.Distribution) (map[float64]uint64, error) {
+	bounds, err := getDistributionBounds(d.BucketOptions)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.BucketCounts) > len(bounds)+1 {
+		return nil, errors.New("distribution has more bucket counts than buckets")
+	}
+	buckets := make(map[float64]uint64, len(bounds))
+	var cumulative uint64
+	for i, bound := range bounds {
+		if i < len(d.BucketCounts) {
+			cumulative += uint64(d.BucketCounts[i])
+		}
+		buckets[bound] = cumulative
+	}
+	return buckets, nil
+}
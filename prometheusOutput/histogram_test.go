@@ -0,0 +1,134 @@
+package prometheusOutput
+
+import (
+	"testing"
+
+	"github.com/fernhtls/stackdriverExporter/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/api/distribution"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestGetDistributionBucketsLinear(t *testing.T) {
+	d := &distribution.Distribution{
+		Count: 10,
+		Mean:  2.5,
+		BucketOptions: &distribution.Distribution_BucketOptions{
+			Options: &distribution.Distribution_BucketOptions_LinearBuckets{
+				LinearBuckets: &distribution.Distribution_BucketOptions_Linear{
+					NumFiniteBuckets: 3, Width: 1, Offset: 1,
+				},
+			},
+		},
+		// underflow, [1,2), [2,3), [3,4), overflow
+		BucketCounts: []int64{1, 2, 3, 2, 2},
+	}
+	buckets, err := getDistributionBuckets(d)
+	assert.NoError(t, err)
+	assert.Equal(t, map[float64]uint64{1: 1, 2: 3, 3: 6, 4: 8}, buckets)
+}
+
+func TestGetDistributionBucketsExponential(t *testing.T) {
+	d := &distribution.Distribution{
+		Count: 3,
+		BucketOptions: &distribution.Distribution_BucketOptions{
+			Options: &distribution.Distribution_BucketOptions_ExponentialBuckets{
+				ExponentialBuckets: &distribution.Distribution_BucketOptions_Exponential{
+					NumFiniteBuckets: 2, GrowthFactor: 2, Scale: 10,
+				},
+			},
+		},
+		// trailing buckets without values are left out
+		BucketCounts: []int64{0, 3},
+	}
+	buckets, err := getDistributionBuckets(d)
+	assert.NoError(t, err)
+	assert.Equal(t, map[float64]uint64{10: 0, 20: 3, 40: 3}, buckets)
+}
+
+func TestGetDistributionBucketsExplicit(t *testing.T) {
+	d := &distribution.Distribution{
+		Count: 4,
+		BucketOptions: &distribution.Distribution_BucketOptions{
+			Options: &distribution.Distribution_BucketOptions_ExplicitBuckets{
+				ExplicitBuckets: &distribution.Distribution_BucketOptions_Explicit{
+					Bounds: []float64{0.5, 1, 5},
+				},
+			},
+		},
+		// underflow, [0.5,1), [1,5), overflow
+		BucketCounts: []int64{1, 1, 1, 1},
+	}
+	buckets, err := getDistributionBuckets(d)
+	assert.NoError(t, err)
+	assert.Equal(t, map[float64]uint64{0.5: 1, 1: 2, 5: 3}, buckets)
+	// more counts than buckets
+	d.BucketCounts = []int64{1, 1, 1, 0, 1}
+	_, err = getDistributionBuckets(d)
+	assert.Error(t, err)
+}
+
+func TestDistributionCollector(t *testing.T) {
+	c := NewDistributionCollector("bigquery_googleapis_query_execution_times_global",
+		"execution times", []string{"project_id"})
+	err := c.Set([]string{"test"}, &distribution.Distribution{
+		Count: 4,
+		Mean:  2,
+		BucketOptions: &distribution.Distribution_BucketOptions{
+			Options: &distribution.Distribution_BucketOptions_ExplicitBuckets{
+				ExplicitBuckets: &distribution.Distribution_BucketOptions_Explicit{Bounds: []float64{1, 3}},
+			},
+		},
+		BucketCounts: []int64{1, 2, 1},
+	})
+	assert.NoError(t, err)
+	assert.Error(t, c.Set([]string{"test"}, nil))
+	registry := prometheus.NewRegistry()
+	assert.NoError(t, registry.Register(c))
+	families, err := registry.Gather()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(families))
+	assert.Equal(t, "stackdriver_bigquery_googleapis_query_execution_times_global", families[0].GetName())
+	assert.Equal(t, dto.MetricType_HISTOGRAM, families[0].GetType())
+	h := families[0].Metric[0].GetHistogram()
+	assert.Equal(t, uint64(4), h.GetSampleCount())
+	assert.Equal(t, float64(8), h.GetSampleSum())
+	assert.Equal(t, uint64(1), h.Bucket[0].GetCumulativeCount())
+	assert.Equal(t, uint64(3), h.Bucket[1].GetCumulativeCount())
+}
+
+func TestSetHistogramSeries(t *testing.T) {
+	labels := buildSeriesLabels([]string{"project_id", "location"}, nil, nil)
+	c := NewDistributionCollector("bigquery_googleapis_query_execution_times_global", "execution times",
+		getSeriesLabelNames(labels))
+	histoMetric := PrometheusHistoMetric{
+		MetricsAndInterval: utils.MetricsAndIntervalType{MetricType: "bigquery.googleapis.com/query/execution_times"},
+		ResourceTypeHistoMetricVec: map[string]PrometheusHistoMetricDetail{
+			"global": {HistoCollector: c, Labels: labels},
+		},
+		StackValueType: metricpb.MetricDescriptor_DISTRIBUTION,
+	}
+	newSeries := func(location string, d *distribution.Distribution) *monitoringpb.TimeSeries {
+		return &monitoringpb.TimeSeries{
+			Resource: &monitoredres.MonitoredResource{
+				Type:   "global",
+				Labels: map[string]string{"project_id": "deployments-metrics", "location": location},
+			},
+			Points: []*monitoringpb.Point{{
+				Interval: &monitoringpb.TimeInterval{EndTime: timestamppb.Now()},
+				Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DistributionValue{DistributionValue: d}},
+			}},
+		}
+	}
+	// the series without distribution is skipped, the next one being set
+	setHistogramSeries(histoMetric, newSeries("eu", nil))
+	setHistogramSeries(histoMetric, newSeries("us", &distribution.Distribution{Count: 2, Mean: 1}))
+	ch := make(chan prometheus.Metric, 10)
+	c.Collect(ch)
+	assert.Equal(t, 1, len(ch))
+}
@@ -0,0 +1,145 @@
+package prometheusOutput
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	structpb "google.golang.org/protobuf/types/known/structpb"
+)
+
+// sources of the label values in the series
+const (
+	resourceLabelSource = iota
+	metricLabelSource
+	systemMetadataLabelSource
+	userMetadataLabelSource
+)
+
+// SeriesLabel : prometheus label and where to get its value in the series
+// Name	- prometheus label name, prefixed when colliding with other labels
+// Source	- resource labels, metric labels or system / user metadata labels
+// Key	- key of the label in the series
+type SeriesLabel struct {
+	Name   string
+	Source int
+	Key    string
+}
+
+// MetadataLabel : metadata label to export, from the FULL view of the series
+// System	- true for system metadata labels, false for user metadata labels
+type MetadataLabel struct {
+	System bool
+	Key    string
+}
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// ParseMetadataLabel : parses the metadata label as "system:key" or "user:key"
+func ParseMetadataLabel(metadataLabel string) (MetadataLabel, error) {
+	parts := strings.SplitN(metadataLabel, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return MetadataLabel{}, fmt.Errorf("metadata label %q should be system:key or user:key", metadataLabel)
+	}
+	switch parts[0] {
+	case "system":
+		return MetadataLabel{System: true, Key: parts[1]}, nil
+	case "user":
+		return MetadataLabel{System: false, Key: parts[1]}, nil
+	default:
+		return MetadataLabel{}, fmt.Errorf("metadata label %q should be system:key or user:key", metadataLabel)
+	}
+}
+
+// sanitizes the label name for prometheus
+func sanitizeLabelName(name string) string {
+	name = invalidLabelChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// builds the labels of the metric from the resource labels, metric labels and metadata labels
+// resource labels keep their names, metric labels colliding with them are prefixed with "metric_"
+// and metadata labels are always prefixed with "system_" or "user_"
+func buildSeriesLabels(resourceKeys, metricKeys []string, metadataLabels []MetadataLabel) []SeriesLabel {
+	used := make(map[string]bool)
+	labels := make([]SeriesLabel, 0, len(resourceKeys)+len(metricKeys)+len(metadataLabels))
+	add := func(name, prefix string, source int, key string) {
+		name = sanitizeLabelName(name)
+		for used[name] {
+			name = sanitizeLabelName(prefix + name)
+		}
+		used[name] = true
+		labels = append(labels, SeriesLabel{Name: name, Source: source, Key: key})
+	}
+	for _, k := range resourceKeys {
+		add(k, "resource_", resourceLabelSource, k)
+	}
+	for _, k := range metricKeys {
+		add(k, "metric_", metricLabelSource, k)
+	}
+	for _, m := range metadataLabels {
+		if m.System {
+			add("system_"+m.Key, "metadata_", systemMetadataLabelSource, m.Key)
+		} else {
+			add("user_"+m.Key, "metadata_", userMetadataLabelSource, m.Key)
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels
+}
+
+// gets the prometheus label names
+func getSeriesLabelNames(labels []SeriesLabel) []string {
+	names := make([]string, 0, len(labels))
+	for _, l := range labels {
+		names = append(names, l.Name)
+	}
+	return names
+}
+
+// gets the label values from the series, in the same order as the labels
+// labels missing in the series (like the ones dropped by a cross series reducer) are set as blank
+func getSeriesLabelValues(labels []SeriesLabel, series *monitoringpb.TimeSeries) []string {
+	values := make([]string, 0, len(labels))
+	for _, l := range labels {
+		var value string
+		switch l.Source {
+		case resourceLabelSource:
+			value = series.GetResource().GetLabels()[l.Key]
+		case metricLabelSource:
+			value = series.GetMetric().GetLabels()[l.Key]
+		case systemMetadataLabelSource:
+			value = getStructValueString(series.GetMetadata().GetSystemLabels().GetFields()[l.Key])
+		case userMetadataLabelSource:
+			value = series.GetMetadata().GetUserLabels()[l.Key]
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+// gets the system metadata value as string, lists are joined by comma
+func getStructValueString(v *structpb.Value) string {
+	switch v.GetKind().(type) {
+	case *structpb.Value_StringValue:
+		return v.GetStringValue()
+	case *structpb.Value_NumberValue:
+		return strconv.FormatFloat(v.GetNumberValue(), 'f', -1, 64)
+	case *structpb.Value_BoolValue:
+		return strconv.FormatBool(v.GetBoolValue())
+	case *structpb.Value_ListValue:
+		values := make([]string, 0)
+		for _, lv := range v.GetListValue().GetValues() {
+			values = append(values, getStructValueString(lv))
+		}
+		return strings.Join(values, ",")
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,64 @@
+package prometheusOutput
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	structpb "google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestParseMetadataLabel(t *testing.T) {
+	m, err := ParseMetadataLabel("system:machine_image")
+	assert.NoError(t, err)
+	assert.Equal(t, MetadataLabel{System: true, Key: "machine_image"}, m)
+	m, err = ParseMetadataLabel("user:env")
+	assert.NoError(t, err)
+	assert.Equal(t, MetadataLabel{System: false, Key: "env"}, m)
+	_, err = ParseMetadataLabel("env")
+	assert.Error(t, err)
+	_, err = ParseMetadataLabel("other:env")
+	assert.Error(t, err)
+	_, err = ParseMetadataLabel("user:")
+	assert.Error(t, err)
+}
+
+func TestBuildSeriesLabels(t *testing.T) {
+	labels := buildSeriesLabels([]string{"bucket_name", "location", "project_id"},
+		[]string{"location", "response_code"},
+		[]MetadataLabel{{System: true, Key: "name"}, {System: false, Key: "team.name"}})
+	assert.Equal(t, []string{"bucket_name", "location", "metric_location", "project_id",
+		"response_code", "system_name", "user_team_name"}, getSeriesLabelNames(labels))
+	// colliding metric label gets the value from the metric labels
+	for _, l := range labels {
+		if l.Name == "metric_location" {
+			assert.Equal(t, metricLabelSource, l.Source)
+			assert.Equal(t, "location", l.Key)
+		}
+	}
+}
+
+func TestGetSeriesLabelValues(t *testing.T) {
+	labels := buildSeriesLabels([]string{"bucket_name", "project_id"},
+		[]string{"response_code", "method"},
+		[]MetadataLabel{{System: true, Key: "region"}, {System: false, Key: "env"}})
+	series := &monitoringpb.TimeSeries{
+		Resource: &monitoredrespb.MonitoredResource{
+			Labels: map[string]string{"bucket_name": "bucket", "project_id": "test"},
+		},
+		Metric: &metricpb.Metric{
+			Labels: map[string]string{"response_code": "OK"},
+		},
+		Metadata: &monitoredrespb.MonitoredResourceMetadata{
+			SystemLabels: &structpb.Struct{Fields: map[string]*structpb.Value{
+				"region": structpb.NewStringValue("europe-west1"),
+			}},
+			UserLabels: map[string]string{"env": "prod"},
+		},
+	}
+	// labels are sorted by name, method is missing in the series
+	assert.Equal(t, []string{"bucket", "", "test", "OK", "europe-west1", "prod"},
+		getSeriesLabelValues(labels, series))
+}
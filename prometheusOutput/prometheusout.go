@@ -1,36 +1,44 @@
 package prometheusOutput
 
 import (
-	monitoring "cloud.google.com/go/monitoring/apiv3"
+	"context"
 	"errors"
 	"fmt"
+	"github.com/fernhtls/stackdriverExporter/selfmetrics"
 	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
 	"github.com/fernhtls/stackdriverExporter/utils"
 	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 	"google.golang.org/genproto/googleapis/api/label"
 	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type PrometheusGaugeMetricDetail struct {
 	Name           string
+	Labels         []SeriesLabel
 	GaugeMetricVec *prometheus.GaugeVec
 }
 
 type PrometheusHistoMetricDetail struct {
 	Name           string
-	HistoMetricVec *prometheus.HistogramVec
+	Labels         []SeriesLabel
+	HistoCollector *DistributionCollector
 }
 
 type PrometheusGaugeMetric struct {
@@ -47,34 +55,75 @@ type PrometheusHistoMetric struct {
 
 var (
 	prometheusLogger          *log.Logger
+	prometheusMetricsMu       sync.RWMutex
+	prometheusRegisterMu      sync.Mutex
 	prometheusMetricsGaugeVec []PrometheusGaugeMetric
 	prometheusMetricsHistoVec []PrometheusHistoMetric
+	prometheusMetricTypes     map[string]bool
+	prometheusPendingMetrics  *pendingMetrics
 )
 
 func init() {
 	prometheusLogger = log.New(os.Stdout, "prometheus_server: ", log.LstdFlags)
 	prometheusMetricsGaugeVec = make([]PrometheusGaugeMetric, 0)
 	prometheusMetricsHistoVec = make([]PrometheusHistoMetric, 0)
+	prometheusMetricTypes = make(map[string]bool)
+	prometheusPendingMetrics = newPendingMetrics()
 }
 
+// modes for gathering the metrics
+const (
+	// PollMode : metrics are gathered in background and set in gauges / histograms
+	PollMode = "poll"
+	// ScrapeMode : metrics are gathered when scraped, from a cache with the results
+	ScrapeMode = "scrape"
+)
+
 // OutputConfig : struct for the prometheus config output
+// ProjectIDs	- projects to collect the metrics from, series are labeled with the project id
+// ListenAddress	- address to bind the http server, all the interfaces when empty
+// BaseHandlerPath	- path of the metrics endpoint, like /metrics/gcp
+// WebConfig	- optional tls and basic auth / bearer token protection of the endpoint
+// MetricExcludes	- regular expressions of metric types left out when expanding metric patterns
+// DiscoveryInterval	- interval to expand again the metric patterns, 0 expands only on start
+// MetadataLabels	- system / user metadata labels of the series added as labels
+// Mode	- poll (default) or scrape
+// CacheTTL	- time the results are kept in scrape mode before querying stackdriver again
+// Lookback	- window queried for the latest points of a metric, never shorter than the interval of the metric
+// PollJitter	- maximum random delay of the first poll of a metric in poll mode, spreading the api calls
+// ClientOptions	- optional settings of the connections of the clients, like stackdriverClient.InsecureEndpoint
 type OutputConfig struct {
-	ProjectID       string
-	BaseHandlerPath string
-	Port            int
+	ProjectIDs        []string
+	ListenAddress     string
+	BaseHandlerPath   string
+	Port              int
+	WebConfig         *WebConfig
+	MetricExcludes    []*regexp.Regexp
+	DiscoveryInterval time.Duration
+	MetadataLabels    []MetadataLabel
+	Mode              string
+	CacheTTL          time.Duration
+	Lookback          time.Duration
+	PollJitter        time.Duration
+	ClientOptions     []option.ClientOption
 }
 
 // validates the handler path
 func validateHandlerPath(path string) (bool, error) {
-	m, err := regexp.MatchString("^/[a-z]+$", path)
+	m, err := regexp.MatchString("^(/[a-zA-Z0-9_.-]+)+$", path)
 	return m, err
 }
 
 // ValidateConfig : validating the config for the prometheus output
 func (p *OutputConfig) ValidateConfig() error {
-	if p.ProjectID == "" {
+	if len(p.ProjectIDs) == 0 {
 		return errors.New("project should be configured")
 	}
+	for _, projectID := range p.ProjectIDs {
+		if projectID == "" {
+			return errors.New("project can't be empty")
+		}
+	}
 	// validates the HandlePath
 	if p.BaseHandlerPath == "" {
 		return errors.New("handler path can't be empty")
@@ -85,16 +134,35 @@ func (p *OutputConfig) ValidateConfig() error {
 		return errors.New("handler path is not valid")
 	}
 	// valid ports to run the handler
-	if p.Port <= 0 {
-		return errors.New("port cant be nil or 0")
+	if p.Port <= 0 || p.Port > 65535 {
+		return errors.New("port should be between 1 and 65535")
+	}
+	if p.WebConfig != nil {
+		if err := p.WebConfig.Validate(); err != nil {
+			return err
+		}
+	}
+	if p.Lookback < 0 || p.PollJitter < 0 {
+		return errors.New("lookback and poll jitter can't be negative")
+	}
+	switch p.Mode {
+	case "", PollMode:
+	case ScrapeMode:
+		if p.CacheTTL <= 0 {
+			return errors.New("cache ttl should be set for scrape mode")
+		}
+	default:
+		return fmt.Errorf("mode %s is not valid", p.Mode)
 	}
 	return nil
 }
 
 // function to return the iterator for adding metrics to prometheus
-func getMetricValue(client *stackdriverClient.StackDriverClient,
-	metricType string, startTime, endTime *timestamp.Timestamp) (*monitoring.TimeSeriesIterator, error) {
-	it, err := client.GetTimeSeriesMetric(metricType, startTime, endTime)
+// every call of the iterator is cancelled with the context, or after the call timeout of the metric
+func getMetricValue(ctx context.Context, client *stackdriverClient.StackDriverClient,
+	m utils.MetricsAndIntervalType, startTime, endTime *timestamp.Timestamp) (*stackdriverClient.TimeSeriesIterator, error) {
+	ctx = stackdriverClient.WithCallTimeout(ctx, m.CallTimeout)
+	it, err := client.GetTimeSeriesMetricContext(ctx, m.MetricType, m.Filter, m.Aggregation, startTime, endTime)
 	if err != nil {
 		return nil, err
 	}
@@ -102,15 +170,18 @@ func getMetricValue(client *stackdriverClient.StackDriverClient,
 }
 
 // generates the metric name - type + resource type + label name
+// all the parts of the metric path are used, so compute.googleapis.com/instance/cpu/utilization
+// and compute.googleapis.com/instance/cpu/usage_time don't get the same name
 func generateMetricName(metricType, resourceType string) (string, error) {
-	fullMetricName := ""
 	mt := strings.Split(metricType, "/")
 	pr := strings.Split(mt[0], ".")
-	fullMetricName = strings.Join([]string{pr[0], pr[1], mt[1], mt[2], resourceType}, "_")
-	if fullMetricName == "" {
+	if len(mt) < 2 || len(pr) < 2 {
 		return "", fmt.Errorf("error on generating name -> metricType: %s, mt: %v", metricType, mt)
 	}
-	return fullMetricName, nil
+	nameParts := append([]string{pr[0], pr[1]}, mt[1:]...)
+	nameParts = append(nameParts, resourceType)
+	exp := regexp.MustCompile(`[^a-zA-Z0-9_]`)
+	return exp.ReplaceAllString(strings.Join(nameParts, "_"), "_"), nil
 }
 
 // gets the metric value for numeric data point
@@ -133,204 +204,618 @@ func getMetricValueNumeric(valueType metricpb.MetricDescriptor_ValueType, point
 	}
 }
 
-// Function to get gauge metrics and add to prometheus
-func geMetricsBackground(client *stackdriverClient.StackDriverClient) {
-	go func() {
-		for {
-			getGaugeMetrics(client)
-			prometheusLogger.Println("**** got all gauge metrics ****")
-			time.Sleep(1 * time.Minute)
-		}
-	}()
+// gets the value type of the metric after the aggregation
+// distributions are kept only when aligned / reduced by delta or sum, other aligners return numbers
+func getAggregatedValueType(valueType metricpb.MetricDescriptor_ValueType,
+	aggregation *stackdriverClient.Aggregation) metricpb.MetricDescriptor_ValueType {
+	if aggregation == nil || valueType != metricpb.MetricDescriptor_DISTRIBUTION {
+		return valueType
+	}
+	switch aggregation.PerSeriesAligner {
+	case "ALIGN_NONE", "ALIGN_DELTA", "ALIGN_SUM":
+	default:
+		return metricpb.MetricDescriptor_DOUBLE
+	}
+	switch aggregation.CrossSeriesReducer {
+	case "", "REDUCE_NONE", "REDUCE_SUM":
+		return valueType
+	default:
+		return metricpb.MetricDescriptor_DOUBLE
+	}
+}
+
+// gets the value type of the series, as aligners can change it (ALIGN_RATE on INT64 returns DOUBLE)
+func getSeriesValueType(series *monitoringpb.TimeSeries,
+	valueType metricpb.MetricDescriptor_ValueType) metricpb.MetricDescriptor_ValueType {
+	if series.ValueType != metricpb.MetricDescriptor_VALUE_TYPE_UNSPECIFIED {
+		return series.ValueType
+	}
+	return valueType
+}
+
+// retries every minute the metrics failed to be registered, the metrics are polled by the scheduler
+// until the context is done
+func registerPendingBackground(ctx context.Context, clients []*stackdriverClient.StackDriverClient,
+	metadataLabels []MetadataLabel, scheduler *pollScheduler) {
 	go func() {
 		for {
-			getHistogramMetrics(client)
-			prometheusLogger.Println("**** got all histogram metrics ****")
-			time.Sleep(1 * time.Minute)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(1 * time.Minute):
+			}
+			registerMetrics(ctx, clients, prometheusPendingMetrics.take(), metadataLabels, scheduler)
 		}
 	}()
 }
 
-func getGaugeMetrics(client *stackdriverClient.StackDriverClient) {
-	for _, gaugeMetric := range prometheusMetricsGaugeVec {
-		interval, err := strconv.Atoi(gaugeMetric.MetricsAndInterval.Interval)
-		if err != nil {
-			prometheusLogger.Fatal(err)
+// gets the gauge metric for all the projects, the calls being cancelled with the context
+// on errors the gauges keep the last values, and the metric is collected again on the next cycle
+func getGaugeMetric(ctx context.Context, clients []*stackdriverClient.StackDriverClient,
+	gaugeMetric PrometheusGaugeMetric, lookback time.Duration) {
+	metricType := gaugeMetric.MetricsAndInterval.MetricType
+	defer selfmetrics.ObserveCollectionDuration("prometheus", metricType, time.Now())
+	startTime, endTime, err := getMinuteIntervalTimes(gaugeMetric.MetricsAndInterval, lookback)
+	if err != nil {
+		collectionError(metricType, "", intervalStage, err)
+		return
+	}
+	prometheusLogger.Printf("collecting metric %s\n", metricType)
+	// errors on a project don't stop collecting the other projects
+	for _, client := range clients {
+		if err := getGaugeMetricProject(ctx, client, gaugeMetric, startTime, endTime); err != nil {
+			collectionError(metricType, client.ProjectID, queryStage, err)
 		}
-		startTime, endTime, err := utils.GetStartAndEndTimeMinuteInterval(int64(interval))
-		if err != nil {
-			prometheusLogger.Fatal(err)
+	}
+}
+
+func getGaugeMetricProject(ctx context.Context, client *stackdriverClient.StackDriverClient,
+	gaugeMetric PrometheusGaugeMetric, startTime, endTime *timestamp.Timestamp) error {
+	it, err := getMetricValue(ctx, client, gaugeMetric.MetricsAndInterval, startTime, endTime)
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := it.Next()
+		if err == iterator.Done {
+			break
 		}
-		prometheusLogger.Printf("collecting metric %s\n", gaugeMetric.MetricsAndInterval.MetricType)
-		it, err := getMetricValue(client, gaugeMetric.MetricsAndInterval.MetricType, startTime, endTime)
 		if err != nil {
-			prometheusLogger.Fatal(err)
+			return err
 		}
-		for {
-			resp, err := it.Next()
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				prometheusLogger.Fatal(err)
-			}
-			// setting value - getting only latest value to set
-			var lastValue float64
-			var endTime *timestamp.Timestamp
-			for _, p := range resp.GetPoints() {
-				if endTime == nil || p.Interval.EndTime.AsTime().After(endTime.AsTime()) {
-					endTime = p.Interval.EndTime
-					lastValue = getMetricValueNumeric(gaugeMetric.StackValueType, p)
-				}
-			}
-			gaugeMetric.ResourceTypeGaugeMetricVec[resp.Resource.Type].GaugeMetricVec.WithLabelValues(
-				getMapLabelsValues(resp.Resource.Labels)...).Set(lastValue)
+		utils.TagProjectID(resp, client.ProjectID)
+		setGaugeSeries(gaugeMetric, resp)
+	}
+	return nil
+}
+
+// sets the gauge of the series to its latest value
+func setGaugeSeries(gaugeMetric PrometheusGaugeMetric, series *monitoringpb.TimeSeries) {
+	gaugeDetail, ok := gaugeMetric.ResourceTypeGaugeMetricVec[series.Resource.Type]
+	if !ok {
+		return
+	}
+	// setting value - getting only latest value to set
+	var lastValue float64
+	var endTime *timestamp.Timestamp
+	valueType := getSeriesValueType(series, gaugeMetric.StackValueType)
+	for _, p := range series.GetPoints() {
+		if endTime == nil || p.Interval.EndTime.AsTime().After(endTime.AsTime()) {
+			endTime = p.Interval.EndTime
+			lastValue = getMetricValueNumeric(valueType, p)
 		}
 	}
+	if endTime == nil {
+		return
+	}
+	gaugeDetail.GaugeMetricVec.WithLabelValues(
+		getSeriesLabelValues(gaugeDetail.Labels, series)...).Set(lastValue)
 }
 
-func getHistogramMetrics(client *stackdriverClient.StackDriverClient) {
-	for _, histoMetric := range prometheusMetricsHistoVec {
-		interval, err := strconv.Atoi(histoMetric.MetricsAndInterval.Interval)
-		if err != nil {
-			prometheusLogger.Fatal(err)
+// gets the histogram metric for all the projects, the calls being cancelled with the context
+// on errors the histograms keep the last values, and the metric is collected again on the next cycle
+func getHistogramMetric(ctx context.Context, clients []*stackdriverClient.StackDriverClient,
+	histoMetric PrometheusHistoMetric, lookback time.Duration) {
+	metricType := histoMetric.MetricsAndInterval.MetricType
+	defer selfmetrics.ObserveCollectionDuration("prometheus", metricType, time.Now())
+	startTime, endTime, err := getMinuteIntervalTimes(histoMetric.MetricsAndInterval, lookback)
+	if err != nil {
+		collectionError(metricType, "", intervalStage, err)
+		return
+	}
+	prometheusLogger.Printf("collecting metric %s\n", metricType)
+	// errors on a project don't stop collecting the other projects
+	for _, client := range clients {
+		if err := getHistogramMetricProject(ctx, client, histoMetric, startTime, endTime); err != nil {
+			collectionError(metricType, client.ProjectID, queryStage, err)
 		}
-		startTime, endTime, err := utils.GetStartAndEndTimeMinuteInterval(int64(interval))
-		if err != nil {
-			prometheusLogger.Fatal(err)
+	}
+}
+
+func getHistogramMetricProject(ctx context.Context, client *stackdriverClient.StackDriverClient,
+	histoMetric PrometheusHistoMetric, startTime, endTime *timestamp.Timestamp) error {
+	it, err := getMetricValue(ctx, client, histoMetric.MetricsAndInterval, startTime, endTime)
+	if err != nil {
+		return err
+	}
+	for {
+		resp, err := it.Next()
+		if err == iterator.Done {
+			break
 		}
-		prometheusLogger.Printf("collecting metric %s\n", histoMetric.MetricsAndInterval.MetricType)
-		it, err := getMetricValue(client, histoMetric.MetricsAndInterval.MetricType, startTime, endTime)
 		if err != nil {
-			prometheusLogger.Fatal(err)
-		}
-		for {
-			resp, err := it.Next()
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				prometheusLogger.Fatal(err)
-			}
-			for _, p := range resp.GetPoints() {
-				histoMetric.ResourceTypeHistoMetricVec[resp.Resource.Type].HistoMetricVec.WithLabelValues(
-					getMapLabelsValues(resp.Resource.Labels)...).Observe(
-						getMetricValueNumeric(histoMetric.StackValueType, p))
-			}
+			return err
 		}
+		utils.TagProjectID(resp, client.ProjectID)
+		setHistogramSeries(histoMetric, resp)
 	}
+	return nil
 }
 
-func getMapLabelsValues(mapLabels map[string]string) []string {
-	// get keys of the map in alphabetical order
-	ko := make([]string, 0)
-	for k := range mapLabels {
-		ko = append(ko, k)
+// sets the histogram of the series to its latest distribution
+// a series without a valid distribution is logged and skipped, the other series of the metric being set
+func setHistogramSeries(histoMetric PrometheusHistoMetric, series *monitoringpb.TimeSeries) {
+	histoDetail, ok := histoMetric.ResourceTypeHistoMetricVec[series.Resource.Type]
+	if !ok {
+		return
 	}
-	sort.Strings(ko)
-	l := make([]string, 0)
-	for _, lb := range ko {
-		l = append(l, mapLabels[lb])
+	// setting distribution - getting only latest distribution to set
+	var lastPoint *monitoringpb.Point
+	for _, p := range series.GetPoints() {
+		if lastPoint == nil || p.Interval.EndTime.AsTime().After(lastPoint.Interval.EndTime.AsTime()) {
+			lastPoint = p
+		}
+	}
+	if lastPoint == nil {
+		return
+	}
+	labelValues := getSeriesLabelValues(histoDetail.Labels, series)
+	if err := histoDetail.HistoCollector.Set(labelValues, lastPoint.Value.GetDistributionValue()); err != nil {
+		collectionError(histoMetric.MetricsAndInterval.MetricType, series.GetResource().GetLabels()[utils.ProjectLabel],
+			seriesStage, fmt.Errorf("series %v skipped: %v", labelValues, err))
 	}
-	return l
 }
 
+// gets the resource label keys, always including the project id label for telling projects apart
 func getStackResourceLabelsKeys(resourceLabels []*label.LabelDescriptor) []string {
-	l := make([]string, 0)
+	l := []string{utils.ProjectLabel}
 	for _, rl := range resourceLabels {
+		if rl.Key == utils.ProjectLabel {
+			continue
+		}
 		l = append(l, rl.Key)
 	}
 	sort.Strings(l)
 	return l
 }
 
-func registerMetrics(client *stackdriverClient.StackDriverClient, metrics []utils.MetricsAndIntervalType) {
-	for _, m := range metrics {
-		stackDesc, err := client.GetMetricDescriptor(m.MetricType)
+// gets the metric descriptor from the first project returning it
+// custom metrics may exist only in some of the projects, and projects may fail on permissions
+func getMetricDescriptor(ctx context.Context, clients []*stackdriverClient.StackDriverClient,
+	metricType string) (*metricpb.MetricDescriptor, error) {
+	var lastErr error
+	for _, client := range clients {
+		descriptor, err := client.GetMetricDescriptorContext(ctx, metricType)
+		if err == nil {
+			return descriptor, nil
+		}
+		lastErr = fmt.Errorf("project %s: %v", client.ProjectID, err)
+	}
+	return nil, lastErr
+}
+
+// gets the monitored resource descriptor from the first project returning it
+func getMonitoredResourceDescriptor(ctx context.Context, clients []*stackdriverClient.StackDriverClient,
+	resourceType string) (*monitoredrespb.MonitoredResourceDescriptor, error) {
+	var lastErr error
+	for _, client := range clients {
+		descriptor, err := client.GetMonitoredResourceDescriptorContext(ctx, resourceType)
+		if err == nil {
+			return descriptor, nil
+		}
+		lastErr = fmt.Errorf("project %s: %v", client.ProjectID, err)
+	}
+	return nil, lastErr
+}
+
+// gets the label keys of the metric descriptor
+func getStackMetricLabelsKeys(metricLabels []*label.LabelDescriptor) []string {
+	l := make([]string, 0, len(metricLabels))
+	for _, ml := range metricLabels {
+		l = append(l, ml.Key)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// metric definition built from the stackdriver descriptors, shared by the poll and scrape modes
+type metricDefinition struct {
+	metric    utils.MetricsAndIntervalType
+	valueType metricpb.MetricDescriptor_ValueType
+	resources map[string]resourceDefinition
+}
+
+// prometheus name, help and labels of the metric for a monitored resource type
+type resourceDefinition struct {
+	name   string
+	help   string
+	labels []SeriesLabel
+}
+
+// builds the definition of the metric, for every monitored resource type of the metric descriptor
+// the descriptor calls are cancelled with the context, every call having the call timeout of the metric
+func buildMetricDefinition(ctx context.Context, clients []*stackdriverClient.StackDriverClient,
+	m utils.MetricsAndIntervalType, metadataLabels []MetadataLabel) (*metricDefinition, error) {
+	ctx = stackdriverClient.WithCallTimeout(ctx, m.CallTimeout)
+	stackDesc, err := getMetricDescriptor(ctx, clients, m.MetricType)
+	if err != nil {
+		return nil, err
+	}
+	def := &metricDefinition{
+		metric:    m,
+		valueType: getAggregatedValueType(stackDesc.ValueType, m.Aggregation),
+		resources: make(map[string]resourceDefinition),
+	}
+	if def.valueType == metricpb.MetricDescriptor_STRING {
+		return def, nil
+	}
+	for _, resourceType := range stackDesc.MonitoredResourceTypes {
+		resourceDesc, err := getMonitoredResourceDescriptor(ctx, clients, resourceType)
 		if err != nil {
-			prometheusLogger.Fatal(err)
+			return nil, err
 		}
-		resourceTypeGaugeMetricVec := make(map[string]PrometheusGaugeMetricDetail)
-		resourceTypeHistoMetricVec := make(map[string]PrometheusHistoMetricDetail)
-		for _, resourceType := range stackDesc.MonitoredResourceTypes {
-			resourceDesc, err := client.GetMonitoredResourceDescriptor(resourceType)
-			if err != nil {
-				prometheusLogger.Fatal(err)
-			}
-			name, err := generateMetricName(m.MetricType, resourceType)
-			if err != nil {
-				prometheusLogger.Fatal(err)
-			}
-			switch stackDesc.ValueType {
-			case metricpb.MetricDescriptor_STRING:
-				prometheusLogger.Println("no string metrics in prometheus")
-			case metricpb.MetricDescriptor_DISTRIBUTION:
-				pm := prometheus.NewHistogramVec(
-					prometheus.HistogramOpts{
-						Namespace: "stackdriver",
-						Name:      name,
-						Help:      strings.Join([]string{stackDesc.Description, resourceDesc.Description}, " "),
-					}, getStackResourceLabelsKeys(resourceDesc.Labels))
-				resourceTypeHistoMetricVec[resourceType] = PrometheusHistoMetricDetail{
-					Name:           name,
-					HistoMetricVec: pm,
-				}
-			default: // all other numeric types
-				pm := prometheus.NewGaugeVec(
-					prometheus.GaugeOpts{
-						Namespace: "stackdriver",
-						Name:      name,
-						Help:      strings.Join([]string{stackDesc.Description, resourceDesc.Description}, " "),
-					}, getStackResourceLabelsKeys(resourceDesc.Labels))
-				resourceTypeGaugeMetricVec[resourceType] = PrometheusGaugeMetricDetail{
-					Name:           name,
-					GaugeMetricVec: pm,
+		name, err := generateMetricName(m.MetricType, resourceType)
+		if err != nil {
+			return nil, err
+		}
+		def.resources[resourceType] = resourceDefinition{
+			name: name,
+			help: strings.Join([]string{stackDesc.Description, resourceDesc.Description}, " "),
+			labels: buildSeriesLabels(getStackResourceLabelsKeys(resourceDesc.Labels),
+				getStackMetricLabelsKeys(stackDesc.Labels), metadataLabels),
+		}
+	}
+	return def, nil
+}
+
+// registers the collectors by resource type, getting the collectors to use by resource type
+// a collector already registered with the same descriptors is used instead, as for a metric registered again
+// on errors (like two metric names colliding once sanitised) the collectors registered are unregistered, the metric
+// being registered for all its resource types or none
+func registerCollectors(collectors map[string]prometheus.Collector) (map[string]prometheus.Collector, error) {
+	used := make(map[string]prometheus.Collector, len(collectors))
+	for resourceType, c := range collectors {
+		err := prometheus.Register(c)
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok &&
+			reflect.TypeOf(are.ExistingCollector) == reflect.TypeOf(c) {
+			used[resourceType] = are.ExistingCollector
+			continue
+		}
+		if err != nil {
+			for rt, u := range used {
+				if u == collectors[rt] {
+					prometheus.Unregister(u)
 				}
 			}
+			return nil, err
+		}
+		used[resourceType] = c
+	}
+	return used, nil
+}
+
+// registers the gauges or histograms of the resource types, replacing them by the ones already registered
+func registerResourceCollectors(gauges map[string]PrometheusGaugeMetricDetail,
+	histograms map[string]PrometheusHistoMetricDetail) error {
+	collectors := make(map[string]prometheus.Collector, len(gauges)+len(histograms))
+	for resourceType, v := range gauges {
+		collectors[resourceType] = v.GaugeMetricVec
+	}
+	for resourceType, v := range histograms {
+		collectors[resourceType] = v.HistoCollector
+	}
+	used, err := registerCollectors(collectors)
+	if err != nil {
+		return err
+	}
+	for resourceType, c := range used {
+		if v, ok := gauges[resourceType]; ok {
+			v.GaugeMetricVec = c.(*prometheus.GaugeVec)
+			gauges[resourceType] = v
+		}
+		if v, ok := histograms[resourceType]; ok {
+			v.HistoCollector = c.(*DistributionCollector)
+			histograms[resourceType] = v
+		}
+	}
+	return nil
+}
+
+// registers the metrics not yet registered, so it can be called again for discovered metrics
+// metrics failing on their descriptors are kept as pending, and registered again on the next cycle
+// metrics whose collectors can't be registered are logged and skipped, without stopping the others
+// registered metrics are polled by the scheduler at their interval
+func registerMetrics(ctx context.Context, clients []*stackdriverClient.StackDriverClient,
+	metrics []utils.MetricsAndIntervalType, metadataLabels []MetadataLabel, scheduler *pollScheduler) {
+	for _, m := range metrics {
+		if isMetricRegistered(m.MetricType) {
+			continue
 		}
-		switch stackDesc.ValueType {
+		registerMetric(ctx, clients, m, metadataLabels, scheduler)
+	}
+}
+
+// checks if the metric is registered
+func isMetricRegistered(metricType string) bool {
+	prometheusMetricsMu.RLock()
+	defer prometheusMetricsMu.RUnlock()
+	return prometheusMetricTypes[metricType]
+}
+
+// registers the metric, the registrations and removals of the metrics being serialized
+// so the discovery, the reloads, the pending metrics and the sink never register a metric twice
+func registerMetric(ctx context.Context, clients []*stackdriverClient.StackDriverClient,
+	m utils.MetricsAndIntervalType, metadataLabels []MetadataLabel, scheduler *pollScheduler) {
+	prometheusRegisterMu.Lock()
+	defer prometheusRegisterMu.Unlock()
+	// registered while waiting for another registration
+	if isMetricRegistered(m.MetricType) {
+		return
+	}
+	def, err := buildMetricDefinition(ctx, clients, m, metadataLabels)
+	if err != nil {
+		collectionError(m.MetricType, "", registerStage, err)
+		prometheusPendingMetrics.add(m)
+		return
+	}
+	if def.valueType == metricpb.MetricDescriptor_STRING {
+		prometheusLogger.Printf("no string metrics in prometheus, skipping %s\n", m.MetricType)
+		return
+	}
+	resourceTypeGaugeMetricVec := make(map[string]PrometheusGaugeMetricDetail)
+	resourceTypeHistoMetricVec := make(map[string]PrometheusHistoMetricDetail)
+	for resourceType, r := range def.resources {
+		switch def.valueType {
 		case metricpb.MetricDescriptor_DISTRIBUTION:
-			prometheusMetricsHistoVec = append(prometheusMetricsHistoVec, PrometheusHistoMetric{
-				MetricsAndInterval:         m,
-				ResourceTypeHistoMetricVec: resourceTypeHistoMetricVec,
-				StackValueType:             stackDesc.ValueType,
-			})
-		default:
-			prometheusMetricsGaugeVec = append(prometheusMetricsGaugeVec, PrometheusGaugeMetric{
-				MetricsAndInterval:         m,
-				ResourceTypeGaugeMetricVec: resourceTypeGaugeMetricVec,
-				StackValueType:             stackDesc.ValueType,
-			})
+			pm := NewDistributionCollector(r.name, r.help, getSeriesLabelNames(r.labels))
+			resourceTypeHistoMetricVec[resourceType] = PrometheusHistoMetricDetail{
+				Name:           r.name,
+				Labels:         r.labels,
+				HistoCollector: pm,
+			}
+		default: // all other numeric types
+			pm := prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Namespace: "stackdriver",
+					Name:      r.name,
+					Help:      r.help,
+				}, getSeriesLabelNames(r.labels))
+			resourceTypeGaugeMetricVec[resourceType] = PrometheusGaugeMetricDetail{
+				Name:           r.name,
+				Labels:         r.labels,
+				GaugeMetricVec: pm,
+			}
+		}
+	}
+	if err := registerResourceCollectors(resourceTypeGaugeMetricVec, resourceTypeHistoMetricVec); err != nil {
+		collectionError(m.MetricType, "", registerStage, err)
+		return
+	}
+	prometheusMetricsMu.Lock()
+	switch def.valueType {
+	case metricpb.MetricDescriptor_DISTRIBUTION:
+		histoMetric := PrometheusHistoMetric{
+			MetricsAndInterval:         m,
+			ResourceTypeHistoMetricVec: resourceTypeHistoMetricVec,
+			StackValueType:             def.valueType,
+		}
+		prometheusMetricsHistoVec = append(prometheusMetricsHistoVec, histoMetric)
+		scheduler.scheduleHistogram(histoMetric)
+	default:
+		gaugeMetric := PrometheusGaugeMetric{
+			MetricsAndInterval:         m,
+			ResourceTypeGaugeMetricVec: resourceTypeGaugeMetricVec,
+			StackValueType:             def.valueType,
+		}
+		prometheusMetricsGaugeVec = append(prometheusMetricsGaugeVec, gaugeMetric)
+		scheduler.scheduleGauge(gaugeMetric)
+	}
+	prometheusMetricTypes[m.MetricType] = true
+	prometheusMetricsMu.Unlock()
+	prometheusLogger.Printf("registered metric %s\n", m.MetricType)
+}
+
+// expands the metric patterns in all the projects, errors on a project are logged and don't stop the others
+// the metrics of the patterns failing to be listed are registered on the next discovery
+func expandMetrics(ctx context.Context, discoveries []*utils.MetricsDiscovery) []utils.MetricsAndIntervalType {
+	metrics := make([]utils.MetricsAndIntervalType, 0)
+	for _, discovery := range discoveries {
+		expanded, err := discovery.Expand(ctx)
+		if err != nil {
+			prometheusLogger.Println(fmt.Errorf("error on discovering metrics for project %s: %v",
+				discovery.Client.ProjectID, err))
 		}
+		metrics = append(metrics, expanded...)
 	}
-	// Registering Gauge Metrics
-	for _, m := range prometheusMetricsGaugeVec {
-		for _, v := range m.ResourceTypeGaugeMetricVec {
-			prometheus.MustRegister(v.GaugeMetricVec)
+	return metrics
+}
+
+// expands the metrics list of a reload in all the projects, failing when any of the projects fails
+// as a project left out would have all its metrics removed
+func expandReloadedMetrics(ctx context.Context, discoveries []*utils.MetricsDiscovery,
+	metrics []utils.MetricsAndIntervalType) ([]utils.MetricsAndIntervalType, error) {
+	reloaded := make([]utils.MetricsAndIntervalType, 0)
+	for _, discovery := range discoveries {
+		expanded, err := discovery.ExpandMetrics(ctx, metrics)
+		if err != nil {
+			return nil, fmt.Errorf("error on discovering metrics for project %s: %v", discovery.Client.ProjectID, err)
 		}
+		reloaded = append(reloaded, expanded...)
 	}
-	// Registering Histogram Metrics
-	for _, m := range prometheusMetricsHistoVec {
-		for _, v := range m.ResourceTypeHistoMetricVec {
-			prometheus.MustRegister(v.HistoMetricVec)
+	return reloaded, nil
+}
+
+// expands again the metric patterns every discovery interval, registering the new metric types found
+// patterns are checked on every interval, as they can be added on config reloads, until the context is done
+func discoverMetricsBackground(ctx context.Context, discoveries []*utils.MetricsDiscovery, interval time.Duration,
+	register func(context.Context, []utils.MetricsAndIntervalType)) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			if discoveries[0].HasPatterns() {
+				register(ctx, expandMetrics(ctx, discoveries))
+			}
 		}
+	}()
+}
+
+// syncs the metrics with every metrics list received on reloads, the calls being cancelled with the context
+// reloads failing to be expanded in any of the projects are rejected, keeping the metrics registered
+func reloadMetricsBackground(ctx context.Context, discoveries []*utils.MetricsDiscovery,
+	reloads <-chan []utils.MetricsAndIntervalType, reload func(context.Context, []utils.MetricsAndIntervalType)) {
+	go func() {
+		for metrics := range reloads {
+			reloaded, err := expandReloadedMetrics(ctx, discoveries, metrics)
+			if err != nil {
+				prometheusLogger.Println(fmt.Errorf("reload rejected, keeping the current metrics: %v", err))
+				continue
+			}
+			for _, discovery := range discoveries {
+				discovery.SetMetrics(metrics)
+			}
+			reload(ctx, reloaded)
+			prometheusLogger.Println("metrics reloaded")
+		}
+	}()
+}
+
+// creates the clients of the projects, projects failing to create their client are logged and left out
+func newClients(projectIDs []string, options []option.ClientOption) []*stackdriverClient.StackDriverClient {
+	clients := make([]*stackdriverClient.StackDriverClient, 0, len(projectIDs))
+	for _, projectID := range projectIDs {
+		client := &stackdriverClient.StackDriverClient{
+			ProjectID: projectID,
+			Options:   options,
+		}
+		if err := client.InitClient(); err != nil {
+			prometheusLogger.Println(fmt.Errorf("error on creating client for project %s: %v", projectID, err))
+			continue
+		}
+		clients = append(clients, client)
 	}
+	return clients
 }
 
 // StartServerPrometheusMetrics : starts the http server and process to gather metrics from stackdriver
-func (p *OutputConfig) StartServerPrometheusMetrics(metrics []utils.MetricsAndIntervalType) {
-	client := stackdriverClient.StackDriverClient{
-		ProjectID: p.ProjectID,
+// metrics lists received on reloads replace the metrics, nil for no reloads
+// once the context is done the http server is shut down (waiting for the scrapes in flight up to the shutdown
+// timeout), the polls stopped (waiting for the polls running up to the shutdown timeout) and the clients closed
+func (p *OutputConfig) StartServerPrometheusMetrics(ctx context.Context, metrics []utils.MetricsAndIntervalType,
+	reloads <-chan []utils.MetricsAndIntervalType, shutdownTimeout time.Duration) error {
+	clients := newClients(p.ProjectIDs, p.ClientOptions)
+	if len(clients) == 0 {
+		return errors.New("no clients could be created for the projects")
+	}
+	defer closeClients(clients)
+	discoveries := make([]*utils.MetricsDiscovery, 0, len(clients))
+	for _, client := range clients {
+		// Expands the metric patterns into the metric types of the project
+		discoveries = append(discoveries, &utils.MetricsDiscovery{
+			Client:   client,
+			Metrics:  metrics,
+			Excludes: p.MetricExcludes,
+		})
 	}
-	if err := client.InitClient(); err != nil {
-		prometheusLogger.Fatal(err)
+	var register, reload func(context.Context, []utils.MetricsAndIntervalType)
+	switch p.Mode {
+	case ScrapeMode:
+		// Queries stackdriver when scraped
+		collector := NewScrapeCollector(ctx, clients, p.CacheTTL, p.Lookback, p.MetadataLabels)
+		if err := prometheus.Register(collector); err != nil {
+			return fmt.Errorf("error on registering the scrape collector: %v", err)
+		}
+		register = collector.AddMetrics
+		reload = collector.SyncMetrics
+	default:
+		// Polls every metric at its interval
+		scheduler := newPollScheduler(clients, p.Lookback, p.PollJitter)
+		// the clients are closed once the polls running are done, or after the shutdown timeout
+		defer func() {
+			if !scheduler.stopAll(shutdownTimeout) {
+				prometheusLogger.Println("polls still running after the shutdown timeout, closing the clients")
+			}
+		}()
+		register = func(ctx context.Context, metrics []utils.MetricsAndIntervalType) {
+			registerMetrics(ctx, clients, metrics, p.MetadataLabels, scheduler)
+		}
+		reload = func(ctx context.Context, metrics []utils.MetricsAndIntervalType) {
+			syncMetrics(ctx, clients, metrics, p.MetadataLabels, scheduler)
+		}
+		registerPendingBackground(ctx, clients, p.MetadataLabels, scheduler)
 	}
 	// Register all prometheus metrics
-	registerMetrics(&client, metrics)
-	// Adds data to the metrics
-	geMetricsBackground(&client)
-	http.Handle(p.BaseHandlerPath, promhttp.Handler())
-	if err := http.ListenAndServe(":"+strconv.Itoa(p.Port), nil); err != nil {
-		prometheusLogger.Fatal(err)
+	register(ctx, expandMetrics(ctx, discoveries))
+	if p.DiscoveryInterval > 0 {
+		discoverMetricsBackground(ctx, discoveries, p.DiscoveryInterval, register)
+	}
+	if reloads != nil {
+		reloadMetricsBackground(ctx, discoveries, reloads, reload)
+	}
+	return p.Serve(ctx, shutdownTimeout)
+}
+
+// closes the clients of the projects, errors are only logged as the clients are not used anymore
+func closeClients(clients []*stackdriverClient.StackDriverClient) {
+	for _, client := range clients {
+		if err := client.Close(); err != nil {
+			prometheusLogger.Println(fmt.Errorf("error on closing client for project %s: %v", client.ProjectID, err))
+		}
+	}
+}
+
+// Serve : serves the registered metrics on the http server until the context is done
+// the server is then shut down, waiting for the scrapes in flight up to the shutdown timeout
+func (p *OutputConfig) Serve(ctx context.Context, shutdownTimeout time.Duration) error {
+	server, err := p.newServer(promhttp.Handler())
+	if err != nil {
+		return err
+	}
+	prometheusLogger.Printf("listening on %s%s\n", server.Addr, p.BaseHandlerPath)
+	errs := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			// certificates are already loaded in the tls config
+			errs <- server.ListenAndServeTLS("", "")
+		} else {
+			errs <- server.ListenAndServe()
+		}
+	}()
+	select {
+	case err = <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	prometheusLogger.Println("shutting down the http server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// creates the http server with the metrics handler on the path, protected by the web config
+func (p *OutputConfig) newServer(metricsHandler http.Handler) (*http.Server, error) {
+	tlsConfig, err := p.WebConfig.tlsConfig()
+	if err != nil {
+		return nil, err
 	}
+	mux := http.NewServeMux()
+	mux.Handle(p.BaseHandlerPath, p.WebConfig.handler(metricsHandler))
+	return &http.Server{
+		Addr:      net.JoinHostPort(p.ListenAddress, strconv.Itoa(p.Port)),
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}, nil
 }
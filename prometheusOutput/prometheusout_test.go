@@ -1,13 +1,24 @@
 package prometheusOutput
 
 import (
+	"context"
+	"github.com/fernhtls/stackdriverExporter/fakemonitoring"
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+	"github.com/fernhtls/stackdriverExporter/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/api/label"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/grpc/codes"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestValidateConfig(t *testing.T) {
 	o := OutputConfig{
-		ProjectID:       "test",
+		ProjectIDs:      []string{"test", "test-2"},
 		BaseHandlerPath: "/metrics",
 		Port:            2100,
 	}
@@ -15,6 +26,31 @@ func TestValidateConfig(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestValidateConfigMode(t *testing.T) {
+	o := OutputConfig{
+		ProjectIDs:      []string{"test"},
+		BaseHandlerPath: "/metrics",
+		Port:            2100,
+		Mode:            ScrapeMode,
+		CacheTTL:        time.Minute,
+	}
+	assert.NoError(t, o.ValidateConfig())
+	// scrape mode needs a cache ttl
+	o.CacheTTL = 0
+	assert.Error(t, o.ValidateConfig())
+	o.Mode = "push"
+	assert.Error(t, o.ValidateConfig())
+}
+
+func TestValidateConfigEmptyProject(t *testing.T) {
+	o := OutputConfig{
+		ProjectIDs:      []string{"test", ""},
+		BaseHandlerPath: "/metrics",
+		Port:            2100,
+	}
+	assert.Error(t, o.ValidateConfig())
+}
+
 func TestValidateConfigWrongHandlerPath(t *testing.T) {
 	o := OutputConfig{
 		BaseHandlerPath: "WRONGPATH",
@@ -39,3 +75,143 @@ func TestValidateConfigPortWithZero(t *testing.T) {
 	err := o.ValidateConfig()
 	assert.Error(t, err)
 }
+
+func TestGetAggregatedValueType(t *testing.T) {
+	// no aggregation keeps the value type
+	assert.Equal(t, metricpb.MetricDescriptor_DISTRIBUTION,
+		getAggregatedValueType(metricpb.MetricDescriptor_DISTRIBUTION, nil))
+	// numeric types are kept
+	assert.Equal(t, metricpb.MetricDescriptor_INT64,
+		getAggregatedValueType(metricpb.MetricDescriptor_INT64, &stackdriverClient.Aggregation{
+			AlignmentPeriod: time.Minute, PerSeriesAligner: "ALIGN_RATE"}))
+	// delta on distribution keeps a distribution
+	assert.Equal(t, metricpb.MetricDescriptor_DISTRIBUTION,
+		getAggregatedValueType(metricpb.MetricDescriptor_DISTRIBUTION, &stackdriverClient.Aggregation{
+			AlignmentPeriod: time.Minute, PerSeriesAligner: "ALIGN_DELTA", CrossSeriesReducer: "REDUCE_SUM"}))
+	// percentiles on distribution returns numbers
+	assert.Equal(t, metricpb.MetricDescriptor_DOUBLE,
+		getAggregatedValueType(metricpb.MetricDescriptor_DISTRIBUTION, &stackdriverClient.Aggregation{
+			AlignmentPeriod: time.Minute, PerSeriesAligner: "ALIGN_PERCENTILE_99"}))
+	assert.Equal(t, metricpb.MetricDescriptor_DOUBLE,
+		getAggregatedValueType(metricpb.MetricDescriptor_DISTRIBUTION, &stackdriverClient.Aggregation{
+			AlignmentPeriod: time.Minute, PerSeriesAligner: "ALIGN_DELTA", CrossSeriesReducer: "REDUCE_PERCENTILE_50"}))
+}
+
+func TestGenerateMetricName(t *testing.T) {
+	name, err := generateMetricName("storage.googleapis.com/storage/total_bytes", "gcs_bucket")
+	assert.NoError(t, err)
+	assert.Equal(t, "storage_googleapis_storage_total_bytes_gcs_bucket", name)
+	// all the parts of the path are used
+	name, err = generateMetricName("compute.googleapis.com/instance/cpu/utilization", "gce_instance")
+	assert.NoError(t, err)
+	assert.Equal(t, "compute_googleapis_instance_cpu_utilization_gce_instance", name)
+	_, err = generateMetricName("wrongmetric", "gce_instance")
+	assert.Error(t, err)
+}
+
+func TestGetStackResourceLabelsKeys(t *testing.T) {
+	// project id label is always present
+	keys := getStackResourceLabelsKeys([]*label.LabelDescriptor{{Key: "bucket_name"}, {Key: "location"}})
+	assert.Equal(t, []string{"bucket_name", "location", "project_id"}, keys)
+	keys = getStackResourceLabelsKeys([]*label.LabelDescriptor{{Key: "project_id"}, {Key: "bucket_name"}})
+	assert.Equal(t, []string{"bucket_name", "project_id"}, keys)
+}
+
+// labels of the series of the bucket in the fixtures of the fake server
+func bucketLabels(bucketName, location, storageClass string) prometheus.Labels {
+	return prometheus.Labels{
+		"bucket_name":   bucketName,
+		"location":      location,
+		"project_id":    "deployments-metrics",
+		"storage_class": storageClass,
+	}
+}
+
+func TestPollFakeServer(t *testing.T) {
+	server, options := fakemonitoring.NewTestServer(t)
+	clients := newClients([]string{"deployments-metrics"}, options)
+	defer closeClients(clients)
+	assert.Equal(t, 1, len(clients))
+	metrics := []utils.MetricsAndIntervalType{
+		{MetricType: "storage.googleapis.com/storage/object_count", Interval: "5"},
+		{MetricType: "storage.googleapis.com/storage/total_bytes", Interval: "5"},
+	}
+	// descriptor calls cancelled with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := buildMetricDefinition(ctx, clients, metrics[0], nil)
+	assert.Error(t, err)
+	registerMetrics(context.Background(), clients, metrics, nil, nil)
+	defer unregisterMetrics([]string{metrics[0].MetricType, metrics[1].MetricType}, nil)
+	objectCount, _ := getRegisteredMetric(metrics[0].MetricType)
+	totalBytes, _ := getRegisteredMetric(metrics[1].MetricType)
+	if !assert.NotNil(t, objectCount) || !assert.NotNil(t, totalBytes) {
+		return
+	}
+	getGaugeMetric(context.Background(), clients, *objectCount, 5*time.Minute)
+	getGaugeMetric(context.Background(), clients, *totalBytes, 5*time.Minute)
+	// gauges set to the latest point in the lookback, by bucket and storage class
+	gauge := objectCount.ResourceTypeGaugeMetricVec["gcs_bucket"].GaugeMetricVec
+	g := &dto.Metric{}
+	assert.NoError(t, gauge.With(bucketLabels("prod-assets", "eu", "STANDARD")).Write(g))
+	assert.Equal(t, float64(1204), g.GetGauge().GetValue())
+	assert.NoError(t, gauge.With(bucketLabels("dev-assets", "us", "STANDARD")).Write(g))
+	assert.Equal(t, float64(12), g.GetGauge().GetValue())
+	ch := make(chan prometheus.Metric, 10)
+	totalBytes.ResourceTypeGaugeMetricVec["gcs_bucket"].GaugeMetricVec.Collect(ch)
+	assert.Equal(t, 1, len(ch))
+	// the gauges keep their values when the project fails
+	server.FailNext(codes.PermissionDenied)
+	getGaugeMetric(context.Background(), clients, *objectCount, 5*time.Minute)
+	assert.NoError(t, gauge.With(bucketLabels("prod-assets", "eu", "STANDARD")).Write(g))
+	assert.Equal(t, float64(1204), g.GetGauge().GetValue())
+}
+
+func TestRegisterCollectors(t *testing.T) {
+	newGauge := func(help string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: "stackdriver", Name: "test_register", Help: help},
+			[]string{"project_id"})
+	}
+	gauge := newGauge("test")
+	used, err := registerCollectors(map[string]prometheus.Collector{"global": gauge})
+	assert.NoError(t, err)
+	assert.Equal(t, gauge, used["global"])
+	defer prometheus.Unregister(gauge)
+	// the gauge already registered is used for the same descriptors
+	used, err = registerCollectors(map[string]prometheus.Collector{"global": newGauge("test")})
+	assert.NoError(t, err)
+	assert.Equal(t, gauge, used["global"])
+	// names colliding with other descriptors fail without registering any collector of the metric
+	other := prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: "stackdriver", Name: "test_register_other"}, nil)
+	_, err = registerCollectors(map[string]prometheus.Collector{"global": newGauge("other"), "gce_instance": other})
+	assert.Error(t, err)
+	assert.NoError(t, prometheus.Register(other))
+	prometheus.Unregister(other)
+}
+
+func TestRegisterMetricsConcurrently(t *testing.T) {
+	_, options := fakemonitoring.NewTestServer(t)
+	clients := newClients([]string{"deployments-metrics"}, options)
+	defer closeClients(clients)
+	m := utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/object_count", Interval: "5"}
+	defer unregisterMetrics([]string{m.MetricType}, nil)
+	// the discovery, the reloads and the sink registering the same metric at once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			registerMetrics(context.Background(), clients, []utils.MetricsAndIntervalType{m}, nil, nil)
+		}()
+	}
+	wg.Wait()
+	registered := 0
+	prometheusMetricsMu.RLock()
+	for _, gaugeMetric := range prometheusMetricsGaugeVec {
+		if gaugeMetric.MetricsAndInterval.MetricType == m.MetricType {
+			registered++
+		}
+	}
+	prometheusMetricsMu.RUnlock()
+	assert.Equal(t, 1, registered)
+}
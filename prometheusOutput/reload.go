@@ -0,0 +1,130 @@
+package prometheusOutput
+
+import (
+	"context"
+	"reflect"
+	"strings"
+
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+	"github.com/fernhtls/stackdriverExporter/utils"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gets the metric types to remove for syncing the current metrics with the wanted ones
+// metrics not wanted anymore or changed are removed, changed metrics being added again with the new settings
+func getRemovedMetrics(current map[string]utils.MetricsAndIntervalType,
+	wanted []utils.MetricsAndIntervalType) []string {
+	wantedMetrics := make(map[string]utils.MetricsAndIntervalType, len(wanted))
+	for _, m := range wanted {
+		wantedMetrics[m.MetricType] = m
+	}
+	removed := make([]string, 0)
+	for metricType, m := range current {
+		if w, ok := wantedMetrics[metricType]; ok && reflect.DeepEqual(w, m) {
+			continue
+		}
+		removed = append(removed, metricType)
+	}
+	return removed
+}
+
+// gets the metric types of the metrics list
+func getMetricTypes(metrics []utils.MetricsAndIntervalType) map[string]bool {
+	metricTypes := make(map[string]bool, len(metrics))
+	for _, m := range metrics {
+		metricTypes[m.MetricType] = true
+	}
+	return metricTypes
+}
+
+// gets the metrics registered in poll mode, by metric type
+func getRegisteredMetrics() map[string]utils.MetricsAndIntervalType {
+	prometheusMetricsMu.RLock()
+	defer prometheusMetricsMu.RUnlock()
+	registered := make(map[string]utils.MetricsAndIntervalType, len(prometheusMetricTypes))
+	for _, gaugeMetric := range prometheusMetricsGaugeVec {
+		registered[gaugeMetric.MetricsAndInterval.MetricType] = gaugeMetric.MetricsAndInterval
+	}
+	for _, histoMetric := range prometheusMetricsHistoVec {
+		registered[histoMetric.MetricsAndInterval.MetricType] = histoMetric.MetricsAndInterval
+	}
+	return registered
+}
+
+// unregisters the collectors of the metrics and stops polling them
+func unregisterMetrics(metricTypes []string, scheduler *pollScheduler) {
+	prometheusRegisterMu.Lock()
+	defer prometheusRegisterMu.Unlock()
+	removed := make(map[string]bool, len(metricTypes))
+	for _, metricType := range metricTypes {
+		removed[metricType] = true
+		scheduler.unschedule(metricType)
+	}
+	prometheusMetricsMu.Lock()
+	defer prometheusMetricsMu.Unlock()
+	gaugeMetrics := make([]PrometheusGaugeMetric, 0, len(prometheusMetricsGaugeVec))
+	for _, gaugeMetric := range prometheusMetricsGaugeVec {
+		if !removed[gaugeMetric.MetricsAndInterval.MetricType] {
+			gaugeMetrics = append(gaugeMetrics, gaugeMetric)
+			continue
+		}
+		for _, v := range gaugeMetric.ResourceTypeGaugeMetricVec {
+			prometheus.Unregister(v.GaugeMetricVec)
+		}
+	}
+	histoMetrics := make([]PrometheusHistoMetric, 0, len(prometheusMetricsHistoVec))
+	for _, histoMetric := range prometheusMetricsHistoVec {
+		if !removed[histoMetric.MetricsAndInterval.MetricType] {
+			histoMetrics = append(histoMetrics, histoMetric)
+			continue
+		}
+		for _, v := range histoMetric.ResourceTypeHistoMetricVec {
+			prometheus.Unregister(v.HistoCollector)
+		}
+	}
+	prometheusMetricsGaugeVec = gaugeMetrics
+	prometheusMetricsHistoVec = histoMetrics
+	for metricType := range removed {
+		delete(prometheusMetricTypes, metricType)
+	}
+}
+
+// syncs the metrics registered in poll mode with the metrics list, as on config reloads
+// the metrics not changed keep their gauges and schedule
+func syncMetrics(ctx context.Context, clients []*stackdriverClient.StackDriverClient,
+	metrics []utils.MetricsAndIntervalType, metadataLabels []MetadataLabel, scheduler *pollScheduler) {
+	removed := getRemovedMetrics(getRegisteredMetrics(), metrics)
+	unregisterMetrics(removed, scheduler)
+	prometheusPendingMetrics.retain(getMetricTypes(metrics))
+	if len(removed) > 0 {
+		prometheusLogger.Printf("removed metrics %s\n", strings.Join(removed, ", "))
+	}
+	registerMetrics(ctx, clients, metrics, metadataLabels, scheduler)
+}
+
+// RemoveMetrics : removes the metrics from the collector, they are not exported on the next scrape
+func (c *ScrapeCollector) RemoveMetrics(metricTypes []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, metricType := range metricTypes {
+		delete(c.metrics, metricType)
+	}
+}
+
+// SyncMetrics : syncs the metrics of the collector with the metrics list, as on config reloads
+// the metrics not changed keep their cached results
+func (c *ScrapeCollector) SyncMetrics(ctx context.Context, metrics []utils.MetricsAndIntervalType) {
+	c.mu.Lock()
+	current := make(map[string]utils.MetricsAndIntervalType, len(c.metrics))
+	for metricType, m := range c.metrics {
+		current[metricType] = m.def.metric
+	}
+	c.mu.Unlock()
+	removed := getRemovedMetrics(current, metrics)
+	c.RemoveMetrics(removed)
+	c.pending.retain(getMetricTypes(metrics))
+	if len(removed) > 0 {
+		prometheusLogger.Printf("removed metrics %s from the scrape collector\n", strings.Join(removed, ", "))
+	}
+	c.AddMetrics(ctx, metrics)
+}
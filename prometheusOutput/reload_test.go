@@ -0,0 +1,116 @@
+package prometheusOutput
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/fakemonitoring"
+	"github.com/fernhtls/stackdriverExporter/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+)
+
+func TestGetRemovedMetrics(t *testing.T) {
+	totalBytes := utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/total_bytes", Interval: "5"}
+	objectCount := utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/object_count", Interval: "5"}
+	current := map[string]utils.MetricsAndIntervalType{
+		totalBytes.MetricType:  totalBytes,
+		objectCount.MetricType: objectCount,
+	}
+	// not changed
+	assert.Equal(t, 0, len(getRemovedMetrics(current, []utils.MetricsAndIntervalType{totalBytes, objectCount})))
+	// changed and removed
+	changed := totalBytes
+	changed.Filter = `resource.labels.bucket_name = "prod"`
+	assert.ElementsMatch(t, []string{totalBytes.MetricType, objectCount.MetricType},
+		getRemovedMetrics(current, []utils.MetricsAndIntervalType{changed}))
+}
+
+func TestUnregisterMetrics(t *testing.T) {
+	m := utils.MetricsAndIntervalType{MetricType: "test.googleapis.com/unregister", Interval: "5"}
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: "stackdriver", Name: "test_unregister"}, nil)
+	prometheus.MustRegister(gauge)
+	prometheusMetricsMu.Lock()
+	prometheusMetricsGaugeVec = append(prometheusMetricsGaugeVec, PrometheusGaugeMetric{
+		MetricsAndInterval:         m,
+		ResourceTypeGaugeMetricVec: map[string]PrometheusGaugeMetricDetail{"global": {GaugeMetricVec: gauge}},
+	})
+	prometheusMetricTypes[m.MetricType] = true
+	prometheusMetricsMu.Unlock()
+	assert.Equal(t, m, getRegisteredMetrics()[m.MetricType])
+	scheduler := newPollScheduler(nil, 0, time.Minute)
+	defer scheduler.stopAll(time.Second)
+	scheduler.schedule(m, func() {})
+	unregisterMetrics([]string{m.MetricType}, scheduler)
+	_, registered := getRegisteredMetrics()[m.MetricType]
+	assert.False(t, registered)
+	scheduler.mu.Lock()
+	assert.Equal(t, 0, len(scheduler.stops))
+	scheduler.mu.Unlock()
+	// the collector can be registered again
+	assert.NoError(t, prometheus.Register(gauge))
+	prometheus.Unregister(gauge)
+}
+
+func TestScrapeCollectorSyncMetrics(t *testing.T) {
+	c := NewScrapeCollector(context.Background(), nil, time.Minute, 0, nil)
+	totalBytes := utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/total_bytes", Interval: "5"}
+	objectCount := utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/object_count", Interval: "5"}
+	c.metrics[totalBytes.MetricType] = &scrapeMetric{def: &metricDefinition{metric: totalBytes}}
+	c.metrics[objectCount.MetricType] = &scrapeMetric{def: &metricDefinition{metric: objectCount}}
+	c.pending.add(utils.MetricsAndIntervalType{MetricType: "bigquery.googleapis.com/query/count", Interval: "5"})
+	kept := c.metrics[totalBytes.MetricType]
+	c.SyncMetrics(context.Background(), []utils.MetricsAndIntervalType{totalBytes})
+	// metrics not changed keep their cached results, and removed metrics are not pending anymore
+	assert.Equal(t, 1, len(c.metrics))
+	assert.Equal(t, kept, c.metrics[totalBytes.MetricType])
+	assert.Equal(t, 0, len(c.pending.take()))
+}
+
+func TestPendingMetricsRetain(t *testing.T) {
+	p := newPendingMetrics()
+	p.add(utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/total_bytes", Interval: "5"})
+	p.add(utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/object_count", Interval: "5"})
+	p.retain(map[string]bool{"storage.googleapis.com/storage/total_bytes": true})
+	metrics := p.take()
+	assert.Equal(t, 1, len(metrics))
+	assert.Equal(t, "storage.googleapis.com/storage/total_bytes", metrics[0].MetricType)
+}
+
+func TestReloadMetricsRejected(t *testing.T) {
+	server, options := fakemonitoring.NewTestServer(t)
+	clients := newClients([]string{"deployments-metrics", "billing-metrics"}, options)
+	defer closeClients(clients)
+	current := []utils.MetricsAndIntervalType{{MetricType: "storage.googleapis.com/storage/object_count", Interval: "5"}}
+	discoveries := make([]*utils.MetricsDiscovery, 0, len(clients))
+	for _, client := range clients {
+		discoveries = append(discoveries, &utils.MetricsDiscovery{Client: client, Metrics: current})
+	}
+	pattern := []utils.MetricsAndIntervalType{{MetricType: "storage.googleapis.com/storage/*", Interval: "5"}}
+	// the reload is expanded in all the projects or not at all
+	server.FailNext(codes.PermissionDenied)
+	_, err := expandReloadedMetrics(context.Background(), discoveries, pattern)
+	assert.Error(t, err)
+	assert.Equal(t, current, discoveries[0].Metrics)
+	reloads := make(chan []utils.MetricsAndIntervalType, 1)
+	reloaded := make(chan []utils.MetricsAndIntervalType, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloadMetricsBackground(ctx, discoveries, reloads, func(ctx context.Context, metrics []utils.MetricsAndIntervalType) {
+		reloaded <- metrics
+	})
+	defer close(reloads)
+	// a project failing rejects the reload, keeping the metrics of all the projects
+	server.FailNext(codes.PermissionDenied)
+	reloads <- pattern
+	reloads <- pattern
+	select {
+	case metrics := <-reloaded:
+		assert.Equal(t, 4, len(metrics))
+	case <-time.After(5 * time.Second):
+		t.Fatal("reload not applied")
+	}
+	assert.Equal(t, 0, len(reloaded))
+}
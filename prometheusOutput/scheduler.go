@@ -0,0 +1,177 @@
+package prometheusOutput
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+	"github.com/fernhtls/stackdriverExporter/utils"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// pollScheduler : polls every metric in poll mode at its own interval
+// the first poll of a metric is delayed by a random jitter, so the metrics are spread instead of polled at once
+// the calls of the polls are cancelled once all the metrics are stopped
+type pollScheduler struct {
+	clients   []*stackdriverClient.StackDriverClient
+	lookback  time.Duration
+	maxJitter time.Duration
+	ctx       context.Context
+	cancel    context.CancelFunc
+	mu        sync.Mutex
+	stops     map[string]chan struct{}
+	polls     sync.WaitGroup
+}
+
+func newPollScheduler(clients []*stackdriverClient.StackDriverClient, lookback, maxJitter time.Duration) *pollScheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &pollScheduler{
+		clients:   clients,
+		lookback:  lookback,
+		maxJitter: maxJitter,
+		ctx:       ctx,
+		cancel:    cancel,
+		stops:     make(map[string]chan struct{}),
+	}
+}
+
+// scheduleGauge : polls the gauge metric every interval
+func (s *pollScheduler) scheduleGauge(gaugeMetric PrometheusGaugeMetric) {
+	s.schedule(gaugeMetric.MetricsAndInterval, func() {
+		getGaugeMetric(s.ctx, s.clients, gaugeMetric, s.lookback)
+	})
+}
+
+// scheduleHistogram : polls the histogram metric every interval
+func (s *pollScheduler) scheduleHistogram(histoMetric PrometheusHistoMetric) {
+	s.schedule(histoMetric.MetricsAndInterval, func() {
+		getHistogramMetric(s.ctx, s.clients, histoMetric, s.lookback)
+	})
+}
+
+// starts polling the metric when not yet scheduled, the poll is isolated so a panic doesn't stop the schedule
+// a nil scheduler polls nothing, as for the sink fed by the collector
+func (s *pollScheduler) schedule(m utils.MetricsAndIntervalType, poll func()) {
+	if s == nil {
+		return
+	}
+	interval, err := getMetricInterval(m)
+	if err != nil {
+		collectionError(m.MetricType, "", intervalStage, err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.stops[m.MetricType]; ok {
+		return
+	}
+	stop := make(chan struct{})
+	s.stops[m.MetricType] = stop
+	s.polls.Add(1)
+	go func() {
+		defer s.polls.Done()
+		timer := time.NewTimer(s.jitter(interval))
+		defer timer.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-timer.C:
+				isolateMetric(m.MetricType, poll)
+				timer.Reset(interval)
+			}
+		}
+	}()
+}
+
+// stops polling the metric
+func (s *pollScheduler) unschedule(metricType string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stop, ok := s.stops[metricType]; ok {
+		close(stop)
+		delete(s.stops, metricType)
+	}
+}
+
+// stopAll : stops polling all the metrics and cancels the calls of the polls running,
+// waiting up to the timeout for them to return
+// returns false when polls are still running after the timeout
+func (s *pollScheduler) stopAll(timeout time.Duration) bool {
+	s.mu.Lock()
+	for metricType, stop := range s.stops {
+		close(stop)
+		delete(s.stops, metricType)
+	}
+	s.mu.Unlock()
+	s.cancel()
+	stopped := make(chan struct{})
+	go func() {
+		s.polls.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// random delay of the first poll, never longer than the interval of the metric
+func (s *pollScheduler) jitter(interval time.Duration) time.Duration {
+	max := s.maxJitter
+	if interval < max {
+		max = interval
+	}
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// gets the interval in minutes of the metric as a duration
+func getMetricInterval(m utils.MetricsAndIntervalType) (time.Duration, error) {
+	interval, err := strconv.Atoi(m.Interval)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(interval) * time.Minute, nil
+}
+
+// gets the lookback of the metric, never shorter than its interval so no point is missed between two polls
+// the lookback of the metric overrides the lookback of the output, and covers the windows re-fetched
+// so the values are updated when late points show up
+func getMetricLookback(m utils.MetricsAndIntervalType, lookback time.Duration) (time.Duration, error) {
+	interval, err := getMetricInterval(m)
+	if err != nil {
+		return 0, err
+	}
+	if m.Lookback > 0 {
+		lookback = m.Lookback
+	}
+	if minLookback := interval * time.Duration(1+m.RefetchWindows); lookback < minLookback {
+		return minLookback, nil
+	}
+	return lookback, nil
+}
+
+// gets the start and end time from the lookback of the metric, rounded up to minutes
+// the end is shifted back by the ingestion delay of the metric, so the latest points are complete
+func getMinuteIntervalTimes(m utils.MetricsAndIntervalType, lookback time.Duration) (*timestamp.Timestamp,
+	*timestamp.Timestamp, error) {
+	metricLookback, err := getMetricLookback(m, lookback)
+	if err != nil {
+		return nil, nil, err
+	}
+	end := time.Now().Add(-m.IngestionDelay).Truncate(time.Second)
+	start := end.Add(-(metricLookback + time.Minute - 1) / time.Minute * time.Minute)
+	return timestamppb.New(start), timestamppb.New(end), nil
+}
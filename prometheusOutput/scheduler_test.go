@@ -0,0 +1,104 @@
+package prometheusOutput
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetMetricLookback(t *testing.T) {
+	m := utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/total_bytes", Interval: "5"}
+	lookback, err := getMetricLookback(m, 10*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, lookback)
+	// never shorter than the interval
+	m.Interval = "60"
+	lookback, err = getMetricLookback(m, 10*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, lookback)
+	m.Interval = "*/5 * * * *"
+	_, err = getMetricLookback(m, 10*time.Minute)
+	assert.Error(t, err)
+	// rounded up to minutes
+	m.Interval = "1"
+	startTime, endTime, err := getMinuteIntervalTimes(m, 90*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Minute, endTime.AsTime().Sub(startTime.AsTime()))
+	// covering the windows re-fetched
+	m.Interval = "5"
+	m.RefetchWindows = 3
+	lookback, err = getMetricLookback(m, 10*time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 20*time.Minute, lookback)
+	// ending before now by the ingestion delay
+	m.IngestionDelay = 4 * time.Minute
+	_, endTime, err = getMinuteIntervalTimes(m, 10*time.Minute)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(-4*time.Minute), endTime.AsTime(), 2*time.Second)
+}
+
+func TestPollSchedulerJitter(t *testing.T) {
+	s := newPollScheduler(nil, 0, time.Minute)
+	for i := 0; i < 100; i++ {
+		// never longer than the interval or the max jitter
+		assert.True(t, s.jitter(10*time.Second) < 10*time.Second)
+		assert.True(t, s.jitter(time.Hour) < time.Minute)
+	}
+	s = newPollScheduler(nil, 0, 0)
+	assert.Equal(t, time.Duration(0), s.jitter(time.Hour))
+}
+
+func TestPollSchedulerSchedule(t *testing.T) {
+	s := newPollScheduler(nil, 0, 0)
+	defer s.stopAll(time.Second)
+	var polls int32
+	m := utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/total_bytes", Interval: "1"}
+	s.schedule(m, func() { atomic.AddInt32(&polls, 1) })
+	// scheduled once per metric type
+	s.schedule(m, func() { atomic.AddInt32(&polls, 100) })
+	// wrong intervals are not scheduled
+	s.schedule(utils.MetricsAndIntervalType{MetricType: "wrong", Interval: "x"}, func() {})
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&polls) == 1 }, time.Second, 10*time.Millisecond)
+	s.mu.Lock()
+	assert.Equal(t, 1, len(s.stops))
+	s.mu.Unlock()
+	assert.True(t, s.stopAll(time.Second))
+	s.mu.Lock()
+	assert.Equal(t, 0, len(s.stops))
+	s.mu.Unlock()
+}
+
+func TestPollSchedulerStopAllWaits(t *testing.T) {
+	s := newPollScheduler(nil, 0, 0)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var done int32
+	m := utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/total_bytes", Interval: "1"}
+	s.schedule(m, func() {
+		close(started)
+		<-release
+		atomic.StoreInt32(&done, 1)
+	})
+	<-started
+	// the poll running is not done within the timeout
+	assert.False(t, s.stopAll(10*time.Millisecond))
+	close(release)
+	assert.True(t, s.stopAll(time.Second))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&done))
+}
+
+func TestPollSchedulerStopAllCancels(t *testing.T) {
+	s := newPollScheduler(nil, 0, 0)
+	started := make(chan struct{})
+	m := utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/total_bytes", Interval: "1"}
+	s.schedule(m, func() {
+		close(started)
+		// a call of the poll, returning once cancelled
+		<-s.ctx.Done()
+	})
+	<-started
+	assert.True(t, s.stopAll(time.Second))
+}
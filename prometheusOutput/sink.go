@@ -0,0 +1,97 @@
+package prometheusOutput
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+	"github.com/fernhtls/stackdriverExporter/utils"
+)
+
+// Sink : sets the gauges and histograms from the series fetched by the collector, instead of polling them
+// metrics are registered on their first write, the http server being started with Serve
+type Sink struct {
+	clients        []*stackdriverClient.StackDriverClient
+	metadataLabels []MetadataLabel
+}
+
+// NewSink : creates the sink of the output, the clients of the projects being used only for the metric descriptors
+// the clients are shared with the jobs of the projects, the sink never closing them
+func (p *OutputConfig) NewSink(clients []*stackdriverClient.StackDriverClient) (*Sink, error) {
+	if len(clients) == 0 {
+		return nil, errors.New("no clients for the projects")
+	}
+	return &Sink{
+		clients:        clients,
+		metadataLabels: p.MetadataLabels,
+	}, nil
+}
+
+// gets the registered gauge or histogram of the metric type, nil when not registered
+func getRegisteredMetric(metricType string) (*PrometheusGaugeMetric, *PrometheusHistoMetric) {
+	prometheusMetricsMu.RLock()
+	defer prometheusMetricsMu.RUnlock()
+	for i := range prometheusMetricsGaugeVec {
+		if prometheusMetricsGaugeVec[i].MetricsAndInterval.MetricType == metricType {
+			return &prometheusMetricsGaugeVec[i], nil
+		}
+	}
+	for i := range prometheusMetricsHistoVec {
+		if prometheusMetricsHistoVec[i].MetricsAndInterval.MetricType == metricType {
+			return nil, &prometheusMetricsHistoVec[i]
+		}
+	}
+	return nil, nil
+}
+
+// Write : sets the gauges or histograms of the metric to the latest points of the series of the batch
+// the metric is registered first when needed, string metrics being skipped
+// re-fetched windows are skipped, as their points are older than the values set by the last window
+func (s *Sink) Write(ctx context.Context, batch utils.Batch) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if batch.Refetch {
+		return nil
+	}
+	m := batch.Metric
+	registerMetrics(ctx, s.clients, []utils.MetricsAndIntervalType{m}, s.metadataLabels, nil)
+	gaugeMetric, histoMetric := getRegisteredMetric(m.MetricType)
+	switch {
+	case gaugeMetric != nil:
+		for _, ts := range batch.Series {
+			setGaugeSeries(*gaugeMetric, ts)
+		}
+	case histoMetric != nil:
+		for _, ts := range batch.Series {
+			setHistogramSeries(*histoMetric, ts)
+		}
+	default:
+		if prometheusPendingMetrics.has(m.MetricType) {
+			return fmt.Errorf("metric %s is not registered", m.MetricType)
+		}
+	}
+	return nil
+}
+
+// Flush : nothing to flush, the values being set on every write
+func (s *Sink) Flush(ctx context.Context) error {
+	return nil
+}
+
+// Close : unregisters all the metrics of the sink, the endpoint not serving them anymore
+func (s *Sink) Close() error {
+	metricTypes := make([]string, 0)
+	for metricType := range getRegisteredMetrics() {
+		metricTypes = append(metricTypes, metricType)
+	}
+	unregisterMetrics(metricTypes, nil)
+	return nil
+}
+
+// SyncMetrics : syncs the metrics registered with the metrics list, as on config reloads
+// the descriptor calls of the metrics added are cancelled with the context
+func (s *Sink) SyncMetrics(ctx context.Context, metrics []utils.MetricsAndIntervalType) {
+	syncMetrics(ctx, s.clients, metrics, s.metadataLabels, nil)
+}
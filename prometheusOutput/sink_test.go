@@ -0,0 +1,68 @@
+package prometheusOutput
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/internal/testutil"
+	"github.com/fernhtls/stackdriverExporter/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+)
+
+func TestSinkWrite(t *testing.T) {
+	m := utils.MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/object_count", Interval: "*/5 * * * *"}
+	labels := buildSeriesLabels([]string{"bucket_name", "project_id"}, []string{"storage_class"}, nil)
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: "stackdriver", Name: "test_sink"},
+		getSeriesLabelNames(labels))
+	prometheusMetricsMu.Lock()
+	prometheusMetricsGaugeVec = append(prometheusMetricsGaugeVec, PrometheusGaugeMetric{
+		MetricsAndInterval: m,
+		ResourceTypeGaugeMetricVec: map[string]PrometheusGaugeMetricDetail{
+			"gcs_bucket": {GaugeMetricVec: gauge, Labels: labels},
+		},
+		StackValueType: metricpb.MetricDescriptor_INT64,
+	})
+	prometheusMetricTypes[m.MetricType] = true
+	prometheusMetricsMu.Unlock()
+	start := time.Date(2020, 10, 1, 10, 0, 0, 0, time.UTC)
+	batch := utils.Batch{
+		ProjectID: "deployments-metrics",
+		Metric:    m,
+		Start:     start,
+		End:       start.Add(5 * time.Minute),
+		Series:    testutil.ReadSeries(t),
+	}
+	s := &Sink{}
+	assert.NoError(t, s.Write(context.Background(), batch))
+	assert.NoError(t, s.Flush(context.Background()))
+	// gauges set to the latest point of every series, whatever the order of the points
+	g := &dto.Metric{}
+	assert.NoError(t, gauge.WithLabelValues("prod-assets", "deployments-metrics", "STANDARD").Write(g))
+	assert.Equal(t, float64(1204), g.GetGauge().GetValue())
+	assert.NoError(t, gauge.WithLabelValues("prod-backups", "deployments-metrics", "NEARLINE").Write(g))
+	assert.Equal(t, float64(87), g.GetGauge().GetValue())
+	// re-fetched windows don't move the gauges back to older points
+	refetch := batch
+	refetch.Refetch = true
+	refetch.Series = testutil.ReadSeries(t)[:1]
+	refetch.Series[0].Points = refetch.Series[0].Points[1:]
+	assert.NoError(t, s.Write(context.Background(), refetch))
+	assert.NoError(t, gauge.WithLabelValues("prod-assets", "deployments-metrics", "STANDARD").Write(g))
+	assert.Equal(t, float64(1204), g.GetGauge().GetValue())
+	// series of resources not registered are skipped
+	ch := make(chan prometheus.Metric, 10)
+	gauge.Collect(ch)
+	assert.Equal(t, 3, len(ch))
+	// nothing set once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, s.Write(ctx, batch))
+	// metrics are unregistered on close
+	assert.NoError(t, s.Close())
+	_, registered := getRegisteredMetrics()[m.MetricType]
+	assert.False(t, registered)
+}
@@ -0,0 +1,191 @@
+package prometheusOutput
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// checks of the basic auth passwords kept, bcrypt being slow on purpose
+const authCacheSize = 100
+
+// bcrypt hash the passwords of the unknown users are checked against, so they take as long as the known users
+const dummyPasswordHash = "$2y$10$QOauhQNbBCuQDKes6eFzPeMqBSjb7Mr5DUmpZ/VcEd00UAV/LDeSi"
+
+// WebConfig : tls and authentication of the prometheus endpoint, loaded from the web config file
+// TLSServerConfig	- certificate and key of the server, and optional client ca to verify the clients
+// BasicAuthUsers	- users allowed with basic auth, with the bcrypt hash of their password
+// BearerToken	- token allowed as "Authorization: Bearer <token>", or read from BearerTokenFile
+// when basic auth users and a bearer token are set, any of them is accepted
+type WebConfig struct {
+	TLSServerConfig *TLSServerConfig  `yaml:"tls_server_config"`
+	BasicAuthUsers  map[string]string `yaml:"basic_auth_users"`
+	BearerToken     string            `yaml:"bearer_token"`
+	BearerTokenFile string            `yaml:"bearer_token_file"`
+	authMu          sync.Mutex
+	authCache       map[string]bool
+}
+
+// TLSServerConfig : tls of the prometheus endpoint
+// ClientCAFile	- when set, clients should present a certificate signed by the ca
+type TLSServerConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+}
+
+// LoadWebConfig : loads and validates the web config file, reading the bearer token file
+func LoadWebConfig(path string) (*WebConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error on reading web config file: %v", err)
+	}
+	w := &WebConfig{}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(w); err != nil {
+		return nil, fmt.Errorf("error on parsing web config file: %v", err)
+	}
+	if w.BearerTokenFile != "" {
+		if w.BearerToken != "" {
+			return nil, errors.New("use either bearer_token or bearer_token_file")
+		}
+		token, err := ioutil.ReadFile(w.BearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("error on reading bearer token file: %v", err)
+		}
+		w.BearerToken = strings.TrimSpace(string(token))
+		if w.BearerToken == "" {
+			return nil, errors.New("bearer token file is empty")
+		}
+	}
+	if err = w.Validate(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Validate : validates the tls files are set and the password hashes
+func (w *WebConfig) Validate() error {
+	if w.TLSServerConfig != nil {
+		if w.TLSServerConfig.CertFile == "" || w.TLSServerConfig.KeyFile == "" {
+			return errors.New("tls needs both cert_file and key_file")
+		}
+	}
+	for user, hash := range w.BasicAuthUsers {
+		if user == "" {
+			return errors.New("basic auth user can't be empty")
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("password of basic auth user %s should be a bcrypt hash", user)
+		}
+	}
+	return nil
+}
+
+// builds the tls config of the server, nil when tls is not configured
+func (w *WebConfig) tlsConfig() (*tls.Config, error) {
+	if w == nil || w.TLSServerConfig == nil {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(w.TLSServerConfig.CertFile, w.TLSServerConfig.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error on loading tls certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if w.TLSServerConfig.ClientCAFile != "" {
+		ca, err := ioutil.ReadFile(w.TLSServerConfig.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error on reading client ca file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found in client ca file")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// checks the password of the basic auth user, the checks being cached by user, hash and password
+// unknown users are checked against a dummy hash, not to tell the users apart by the response time
+func (w *WebConfig) checkPassword(user, password string) bool {
+	hash, found := w.BasicAuthUsers[user]
+	if !found {
+		hash = dummyPasswordHash
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		hex.EncodeToString([]byte(user)), hex.EncodeToString([]byte(hash)), hex.EncodeToString([]byte(password)),
+	}, ":")))
+	key := string(sum[:])
+	w.authMu.Lock()
+	ok, cached := w.authCache[key]
+	w.authMu.Unlock()
+	if cached {
+		return ok
+	}
+	ok = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil && found
+	w.authMu.Lock()
+	defer w.authMu.Unlock()
+	if w.authCache == nil {
+		w.authCache = make(map[string]bool)
+	}
+	// a random check is dropped when full, so clients trying many passwords can't grow the cache
+	for k := range w.authCache {
+		if len(w.authCache) < authCacheSize {
+			break
+		}
+		delete(w.authCache, k)
+	}
+	w.authCache[key] = ok
+	return ok
+}
+
+// checks the basic auth user or bearer token of the request
+func (w *WebConfig) authorized(r *http.Request) bool {
+	if len(w.BasicAuthUsers) == 0 && w.BearerToken == "" {
+		return true
+	}
+	if user, password, ok := r.BasicAuth(); ok {
+		return w.checkPassword(user, password)
+	}
+	authorization := r.Header.Get("Authorization")
+	if w.BearerToken == "" || !strings.HasPrefix(authorization, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(w.BearerToken)) == 1
+}
+
+// wraps the handler, answering unauthorized to the requests without valid credentials
+func (w *WebConfig) handler(next http.Handler) http.Handler {
+	if w == nil {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !w.authorized(r) {
+			if len(w.BasicAuthUsers) > 0 {
+				rw.Header().Set("WWW-Authenticate", `Basic realm="stackdriverExporter"`)
+			}
+			http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
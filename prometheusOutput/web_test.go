@@ -0,0 +1,162 @@
+package prometheusOutput
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+// writes a self signed certificate and its key
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	certFile := writeTestFile(t, dir, "cert.pem", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyFile := writeTestFile(t, dir, "key.pem", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})))
+	return certFile, keyFile
+}
+
+func passwordHash(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	assert.NoError(t, err)
+	return string(hash)
+}
+
+func TestValidateHandlerPath(t *testing.T) {
+	for _, path := range []string{"/metrics", "/metrics/gcp", "/stack_metrics/v1"} {
+		m, err := validateHandlerPath(path)
+		assert.NoError(t, err)
+		assert.True(t, m, path)
+	}
+	for _, path := range []string{"metrics", "/", "/metrics/", "/metrics//gcp", "/metrics?x=1"} {
+		m, err := validateHandlerPath(path)
+		assert.NoError(t, err)
+		assert.False(t, m, path)
+	}
+}
+
+func TestLoadWebConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "web")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := writeTestFile(t, dir, "token", "secret-token\n")
+	path := writeTestFile(t, dir, "web.yml", "basic_auth_users:\n  prometheus: "+passwordHash(t, "pass")+
+		"\nbearer_token_file: "+tokenFile+"\n")
+	w, err := LoadWebConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret-token", w.BearerToken)
+	assert.Equal(t, 1, len(w.BasicAuthUsers))
+	// unknown fields are not allowed
+	path = writeTestFile(t, dir, "unknown.yml", "basic_auth:\n  prometheus: pass\n")
+	_, err = LoadWebConfig(path)
+	assert.Error(t, err)
+	// passwords should be hashed
+	path = writeTestFile(t, dir, "plain.yml", "basic_auth_users:\n  prometheus: pass\n")
+	_, err = LoadWebConfig(path)
+	assert.Error(t, err)
+	// tls needs cert and key
+	path = writeTestFile(t, dir, "tls.yml", "tls_server_config:\n  cert_file: cert.pem\n")
+	_, err = LoadWebConfig(path)
+	assert.Error(t, err)
+	_, err = LoadWebConfig(filepath.Join(dir, "missing.yml"))
+	assert.Error(t, err)
+}
+
+func TestWebConfigHandler(t *testing.T) {
+	w := &WebConfig{
+		BasicAuthUsers: map[string]string{"prometheus": passwordHash(t, "pass")},
+		BearerToken:    "secret-token",
+	}
+	handler := w.handler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	request := func(setAuth func(r *http.Request)) int {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		setAuth(r)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, r)
+		return rw.Code
+	}
+	assert.Equal(t, http.StatusOK, request(func(r *http.Request) { r.SetBasicAuth("prometheus", "pass") }))
+	assert.Equal(t, http.StatusOK, request(func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret-token") }))
+	assert.Equal(t, http.StatusUnauthorized, request(func(r *http.Request) {}))
+	assert.Equal(t, http.StatusUnauthorized, request(func(r *http.Request) { r.SetBasicAuth("prometheus", "wrong") }))
+	assert.Equal(t, http.StatusUnauthorized, request(func(r *http.Request) { r.SetBasicAuth("other", "pass") }))
+	assert.Equal(t, http.StatusUnauthorized, request(func(r *http.Request) { r.Header.Set("Authorization", "Bearer wrong") }))
+	assert.Equal(t, http.StatusUnauthorized, request(func(r *http.Request) { r.Header.Set("Authorization", "secret-token") }))
+	// the password checks are cached, unknown users included
+	assert.Equal(t, 3, len(w.authCache))
+	assert.Equal(t, http.StatusOK, request(func(r *http.Request) { r.SetBasicAuth("prometheus", "pass") }))
+	assert.Equal(t, http.StatusUnauthorized, request(func(r *http.Request) { r.SetBasicAuth("prometheus", "wrong") }))
+	_, err := bcrypt.Cost([]byte(dummyPasswordHash))
+	assert.NoError(t, err)
+	// no web config leaves the endpoint open
+	var noConfig *WebConfig
+	open := noConfig.handler(http.NotFoundHandler())
+	rw := httptest.NewRecorder()
+	open.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+}
+
+func TestNewServerTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "web")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCertificate(t, dir)
+	p := OutputConfig{
+		ListenAddress:   "127.0.0.1",
+		BaseHandlerPath: "/metrics/gcp",
+		Port:            2100,
+		WebConfig: &WebConfig{TLSServerConfig: &TLSServerConfig{
+			CertFile:     certFile,
+			KeyFile:      keyFile,
+			ClientCAFile: certFile,
+		}},
+	}
+	server, err := p.newServer(http.NotFoundHandler())
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:2100", server.Addr)
+	assert.Equal(t, 1, len(server.TLSConfig.Certificates))
+	assert.Equal(t, tls.RequireAndVerifyClientCert, server.TLSConfig.ClientAuth)
+	// the client ca should have certificates
+	p.WebConfig.TLSServerConfig.ClientCAFile = keyFile
+	_, err = p.newServer(http.NotFoundHandler())
+	assert.Error(t, err)
+	// without web config there is no tls
+	p.WebConfig = nil
+	server, err = p.newServer(http.NotFoundHandler())
+	assert.NoError(t, err)
+	assert.Nil(t, server.TLSConfig)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/query"
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+)
+
+// runs the query subcommand, printing the time series of a metric of a project
+func runQuery(args []string) error {
+	var projectID, align, reduce string
+	var alignmentPeriod time.Duration
+	var groupBy metricsListType
+	q := query.Query{}
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	fs.StringVar(&projectID, "project_id", "", "gcp project id to query")
+	fs.StringVar(&q.MetricType, "metric", "", "metric type to query")
+	fs.StringVar(&q.Filter, "filter", "", "optional cloud monitoring filter added to the metric type filter")
+	fs.DurationVar(&q.Since, "since", time.Hour, "window queried before now")
+	fs.StringVar(&align, "align", "", "optional per series aligner, like ALIGN_MEAN (raw points when empty)")
+	fs.DurationVar(&alignmentPeriod, "alignment_period", time.Minute, "alignment period of the aligner")
+	fs.StringVar(&reduce, "reduce", "", "optional cross series reducer, like REDUCE_SUM")
+	fs.Var(&groupBy, "group_by", "field preserved by the reducer (pass --group_by multiple times for multiple fields)")
+	fs.StringVar(&q.Format, "format", query.TableFormat, "output format: table, json (as the json files) or csv")
+	fs.Parse(args)
+	if align != "" || reduce != "" {
+		q.Aggregation = &stackdriverClient.Aggregation{
+			AlignmentPeriod:    alignmentPeriod,
+			PerSeriesAligner:   align,
+			CrossSeriesReducer: reduce,
+			GroupByFields:      groupBy,
+		}
+	}
+	if err := q.Validate(); err != nil {
+		return err
+	}
+	client, err := newProjectClient(projectID)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return q.Run(client, os.Stdout, log.New(os.Stderr, "query: ", log.LstdFlags))
+}
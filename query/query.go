@@ -0,0 +1,170 @@
+package query
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/jsonoutput"
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+	"github.com/fernhtls/stackdriverExporter/utils"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// formats of the query output
+const (
+	TableFormat = "table"
+	JSONFormat  = "json"
+	CSVFormat   = "csv"
+)
+
+// Query : one time series request of a metric, printed instead of exported
+// Since	- window queried before now
+// Aggregation	- optional server side aggregation, nil for the raw points
+// Format	- table or csv with one line by point, or json with one series by line as in the json files
+type Query struct {
+	MetricType  string
+	Filter      string
+	Aggregation *stackdriverClient.Aggregation
+	Since       time.Duration
+	Format      string
+}
+
+// row : point of a series, as printed in the table and csv formats
+type row struct {
+	resourceType string
+	labels       string
+	start        string
+	end          string
+	value        string
+}
+
+// Validate : validates the query before calling the api
+func (q *Query) Validate() error {
+	if q.MetricType == "" {
+		return errors.New("metric is mandatory")
+	}
+	if q.Since < time.Minute {
+		return errors.New("since should be at least 1m")
+	}
+	if q.Aggregation != nil {
+		if err := q.Aggregation.Validate(); err != nil {
+			return err
+		}
+	}
+	switch q.Format {
+	case TableFormat, JSONFormat, CSVFormat:
+		return nil
+	}
+	return fmt.Errorf("format %q is not valid, should be table, json or csv", q.Format)
+}
+
+// Run : runs the query on the project, writing the results in the format
+func (q *Query) Run(client *stackdriverClient.StackDriverClient, w io.Writer, logger *log.Logger) error {
+	if err := q.Validate(); err != nil {
+		return err
+	}
+	end := time.Now()
+	m := utils.MetricsAndIntervalType{
+		MetricType:  q.MetricType,
+		Filter:      q.Filter,
+		Aggregation: q.Aggregation,
+	}
+	series, err := utils.FetchSeries(context.Background(), client, m, end.Add(-q.Since), end)
+	if err != nil {
+		return err
+	}
+	if q.Format == JSONFormat {
+		return jsonoutput.MarshalSeries(w, series, logger)
+	}
+	rows := make([]row, 0)
+	for _, s := range series {
+		rows = append(rows, getSeriesRows(s)...)
+	}
+	if q.Format == CSVFormat {
+		return writeCSV(w, rows)
+	}
+	return writeTable(w, rows)
+}
+
+// gets the resource and metric labels of the series as "key=value", sorted
+func getSeriesLabels(series *monitoringpb.TimeSeries) string {
+	labels := make([]string, 0)
+	for k, v := range series.GetResource().GetLabels() {
+		labels = append(labels, "resource."+k+"="+v)
+	}
+	for k, v := range series.GetMetric().GetLabels() {
+		labels = append(labels, "metric."+k+"="+v)
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
+
+// gets the value of the point as text, distributions as their count and mean
+func getPointValue(p *monitoringpb.Point) string {
+	switch v := p.GetValue().GetValue().(type) {
+	case *monitoringpb.TypedValue_BoolValue:
+		return strconv.FormatBool(v.BoolValue)
+	case *monitoringpb.TypedValue_Int64Value:
+		return strconv.FormatInt(v.Int64Value, 10)
+	case *monitoringpb.TypedValue_DoubleValue:
+		return strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+	case *monitoringpb.TypedValue_StringValue:
+		return v.StringValue
+	case *monitoringpb.TypedValue_DistributionValue:
+		return fmt.Sprintf("count=%d mean=%s", v.DistributionValue.GetCount(),
+			strconv.FormatFloat(v.DistributionValue.GetMean(), 'g', -1, 64))
+	}
+	return ""
+}
+
+// gets the rows of the points of the series, oldest first
+func getSeriesRows(series *monitoringpb.TimeSeries) []row {
+	labels := getSeriesLabels(series)
+	points := series.GetPoints()
+	rows := make([]row, 0, len(points))
+	// the api returns the points newest first
+	for i := len(points) - 1; i >= 0; i-- {
+		p := points[i]
+		r := row{
+			resourceType: series.GetResource().GetType(),
+			labels:       labels,
+			end:          p.GetInterval().GetEndTime().AsTime().Format(time.RFC3339),
+			value:        getPointValue(p),
+		}
+		if p.GetInterval().GetStartTime() != nil {
+			r.start = p.GetInterval().GetStartTime().AsTime().Format(time.RFC3339)
+		}
+		rows = append(rows, r)
+	}
+	return rows
+}
+
+// writes the rows as a table
+func writeTable(w io.Writer, rows []row) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "RESOURCE TYPE\tLABELS\tSTART\tEND\tVALUE")
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.resourceType, r.labels, r.start, r.end, r.value)
+	}
+	return tw.Flush()
+}
+
+// writes the rows as csv, with a header
+func writeCSV(w io.Writer, rows []row) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"resource_type", "labels", "start_time", "end_time", "value"})
+	for _, r := range rows {
+		cw.Write([]string{r.resourceType, r.labels, r.start, r.end, r.value})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,92 @@
+package query
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/api/distribution"
+	"google.golang.org/genproto/googleapis/api/metric"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func getTestSeries() *monitoringpb.TimeSeries {
+	end := time.Date(2020, 10, 1, 10, 0, 0, 0, time.UTC)
+	point := func(end time.Time, value float64) *monitoringpb.Point {
+		return &monitoringpb.Point{
+			Interval: &monitoringpb.TimeInterval{EndTime: timestamppb.New(end)},
+			Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: value}},
+		}
+	}
+	return &monitoringpb.TimeSeries{
+		Metric: &metric.Metric{
+			Type:   "storage.googleapis.com/storage/total_bytes",
+			Labels: map[string]string{"storage_class": "REGIONAL"},
+		},
+		Resource: &monitoredrespb.MonitoredResource{
+			Type:   "gcs_bucket",
+			Labels: map[string]string{"bucket_name": "prod-logs", "project_id": "test"},
+		},
+		// newest first, as returned by the api
+		Points: []*monitoringpb.Point{point(end, 2.5), point(end.Add(-time.Minute), 1)},
+	}
+}
+
+func TestQueryValidate(t *testing.T) {
+	q := Query{MetricType: "storage.googleapis.com/storage/total_bytes", Since: time.Hour, Format: TableFormat}
+	assert.NoError(t, q.Validate())
+	q.Format = "xml"
+	assert.Error(t, q.Validate())
+	q.Format = CSVFormat
+	q.Since = time.Second
+	assert.Error(t, q.Validate())
+	q.Since = time.Hour
+	q.Aggregation = &stackdriverClient.Aggregation{AlignmentPeriod: time.Minute, PerSeriesAligner: "ALIGN_WRONG"}
+	assert.Error(t, q.Validate())
+	q.Aggregation.PerSeriesAligner = "ALIGN_MEAN"
+	assert.NoError(t, q.Validate())
+	q.MetricType = ""
+	assert.Error(t, q.Validate())
+}
+
+func TestGetSeriesRows(t *testing.T) {
+	rows := getSeriesRows(getTestSeries())
+	assert.Equal(t, 2, len(rows))
+	// oldest first
+	assert.Equal(t, "2020-10-01T09:59:00Z", rows[0].end)
+	assert.Equal(t, "1", rows[0].value)
+	assert.Equal(t, "2.5", rows[1].value)
+	assert.Equal(t, "gcs_bucket", rows[1].resourceType)
+	assert.Equal(t, "metric.storage_class=REGIONAL,resource.bucket_name=prod-logs,resource.project_id=test", rows[1].labels)
+}
+
+func TestGetPointValue(t *testing.T) {
+	value := func(v *monitoringpb.TypedValue) *monitoringpb.Point {
+		return &monitoringpb.Point{Value: v}
+	}
+	assert.Equal(t, "42", getPointValue(value(&monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: 42}})))
+	assert.Equal(t, "true", getPointValue(value(&monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_BoolValue{BoolValue: true}})))
+	assert.Equal(t, "up", getPointValue(value(&monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_StringValue{StringValue: "up"}})))
+	assert.Equal(t, "count=3 mean=1.5", getPointValue(value(&monitoringpb.TypedValue{
+		Value: &monitoringpb.TypedValue_DistributionValue{DistributionValue: &distribution.Distribution{Count: 3, Mean: 1.5}}})))
+}
+
+func TestWriteRows(t *testing.T) {
+	rows := getSeriesRows(getTestSeries())
+	var b bytes.Buffer
+	assert.NoError(t, writeCSV(&b, rows))
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, "resource_type,labels,start_time,end_time,value", lines[0])
+	assert.Equal(t, `gcs_bucket,"metric.storage_class=REGIONAL,resource.bucket_name=prod-logs,resource.project_id=test",,2020-10-01T09:59:00Z,1`, lines[1])
+	b.Reset()
+	assert.NoError(t, writeTable(&b, rows))
+	lines = strings.Split(strings.TrimSpace(b.String()), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.True(t, strings.HasPrefix(lines[0], "RESOURCE TYPE"))
+}
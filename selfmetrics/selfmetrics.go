@@ -0,0 +1,186 @@
+package selfmetrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/status"
+)
+
+const namespace = "stackdriver_exporter"
+
+var (
+	apiCalls = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "api_calls_total",
+			Help:      "Calls to the cloud monitoring api, by method and metric type.",
+		}, []string{"method", "metric_type"})
+	apiErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "api_errors_total",
+			Help:      "Errors from the cloud monitoring api, by method and grpc code.",
+		}, []string{"method", "code"})
+	apiRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "api_retries_total",
+			Help:      "Calls to the cloud monitoring api made again after transient errors, by method and grpc code.",
+		}, []string{"method", "code"})
+	apiThrottled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "api_throttled_total",
+			Help:      "Calls to the cloud monitoring api delayed by the read limit, by method.",
+		}, []string{"method"})
+	apiThrottledSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "api_throttled_seconds_total",
+			Help:      "Time the calls to the cloud monitoring api waited for the read limit, by method.",
+		}, []string{"method"})
+	collectionErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "collection_errors_total",
+			Help:      "Errors collecting the stackdriver metrics, by metric type, project and stage.",
+		}, []string{"metric_type", "project_id", "stage"})
+	collectionDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "collection_duration_seconds",
+			Help:      "Duration of the collection of a metric, by output and metric type.",
+			Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+		}, []string{"output", "metric_type"})
+	seriesFetched = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "series_fetched_total",
+			Help:      "Time series fetched from the cloud monitoring api, by metric type.",
+		}, []string{"metric_type"})
+	pointsFetched = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "points_fetched_total",
+			Help:      "Points fetched from the cloud monitoring api, by metric type.",
+		}, []string{"metric_type"})
+	clientReconnects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_reconnects_total",
+			Help:      "Connections to the cloud monitoring api created again after transport errors, by project and result.",
+		}, []string{"project_id", "result"})
+	jobsCancelled = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "jobs_cancelled_total",
+			Help:      "Runs of the metric jobs cancelled on their deadline, by metric type, project and reason.",
+		}, []string{"metric_type", "project_id", "reason"})
+	newestPoints = &newestPointCollector{
+		desc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "newest_point_age_seconds"),
+			"Age of the newest point fetched, by metric type.", []string{"metric_type"}, nil),
+		newest: make(map[string]time.Time),
+	}
+)
+
+func init() {
+	prometheus.MustRegister(apiCalls, apiErrors, apiRetries, apiThrottled, apiThrottledSeconds, collectionErrors,
+		collectionDuration, seriesFetched, pointsFetched, clientReconnects, jobsCancelled, newestPoints)
+}
+
+// newestPointCollector : collector with the age of the newest point of every metric type
+// the age is computed when collected, so a metric not fetched anymore has an increasing age
+type newestPointCollector struct {
+	desc   *prometheus.Desc
+	mu     sync.Mutex
+	newest map[string]time.Time
+}
+
+// Describe : implements prometheus.Collector
+func (c *newestPointCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect : implements prometheus.Collector
+func (c *newestPointCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for metricType, newest := range c.newest {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue,
+			time.Since(newest).Seconds(), metricType)
+	}
+}
+
+// sets the newest point time of the metric type, when newer than the current one
+func (c *newestPointCollector) set(metricType string, endTime time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if endTime.After(c.newest[metricType]) {
+		c.newest[metricType] = endTime
+	}
+}
+
+// APICall : counts a call to the cloud monitoring api, and its error when not nil
+func APICall(method, metricType string, err error) {
+	apiCalls.WithLabelValues(method, metricType).Inc()
+	APIError(method, err)
+}
+
+// APIError : counts the error of the cloud monitoring api by grpc code, nil errors are not counted
+func APIError(method string, err error) {
+	if err == nil {
+		return
+	}
+	apiErrors.WithLabelValues(method, status.Code(err).String()).Inc()
+}
+
+// APIRetry : counts a call to the cloud monitoring api made again after a transient error, by grpc code
+func APIRetry(method, code string) {
+	apiRetries.WithLabelValues(method, code).Inc()
+}
+
+// APIThrottled : counts a call to the cloud monitoring api delayed by the read limit, and the time waited
+func APIThrottled(method string, waited time.Duration) {
+	apiThrottled.WithLabelValues(method).Inc()
+	apiThrottledSeconds.WithLabelValues(method).Add(waited.Seconds())
+}
+
+// ClientReconnect : counts a connection of the project created again, failed when err is not nil
+func ClientReconnect(projectID string, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	clientReconnects.WithLabelValues(projectID, result).Inc()
+}
+
+// JobCancelled : counts a run of the metric job cancelled on its deadline, the reason being the metric timeout
+// or the next run of the job
+func JobCancelled(metricType, projectID, reason string) {
+	jobsCancelled.WithLabelValues(metricType, projectID, reason).Inc()
+}
+
+// CollectionError : counts an error collecting the metric
+func CollectionError(metricType, projectID, stage string) {
+	collectionErrors.WithLabelValues(metricType, projectID, stage).Inc()
+}
+
+// ObserveCollectionDuration : observes the duration of the collection started at start
+// meant to be deferred as defer ObserveCollectionDuration(output, metricType, time.Now())
+func ObserveCollectionDuration(output, metricType string, start time.Time) {
+	collectionDuration.WithLabelValues(output, metricType).Observe(time.Since(start).Seconds())
+}
+
+// SeriesFetched : counts the series and its points, keeping the time of the newest point
+func SeriesFetched(metricType string, series *monitoringpb.TimeSeries) {
+	seriesFetched.WithLabelValues(metricType).Inc()
+	pointsFetched.WithLabelValues(metricType).Add(float64(len(series.GetPoints())))
+	for _, p := range series.GetPoints() {
+		if p.GetInterval().GetEndTime() != nil {
+			newestPoints.set(metricType, p.Interval.EndTime.AsTime())
+		}
+	}
+}
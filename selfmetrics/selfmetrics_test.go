@@ -0,0 +1,89 @@
+package selfmetrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAPICall(t *testing.T) {
+	metricType := "storage.googleapis.com/storage/total_bytes"
+	APICall("GetMetricDescriptor", metricType, nil)
+	APICall("GetMetricDescriptor", metricType, status.Error(codes.Unavailable, "unavailable"))
+	APIError("ListTimeSeries", status.Error(codes.ResourceExhausted, "quota"))
+	APIError("ListTimeSeries", errors.New("not a grpc error"))
+	APIError("ListTimeSeries", nil)
+	assert.Equal(t, float64(2), testutil.ToFloat64(apiCalls.WithLabelValues("GetMetricDescriptor", metricType)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(apiErrors.WithLabelValues("GetMetricDescriptor", "Unavailable")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(apiErrors.WithLabelValues("ListTimeSeries", "ResourceExhausted")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(apiErrors.WithLabelValues("ListTimeSeries", "Unknown")))
+}
+
+func TestAPIRetryAndThrottled(t *testing.T) {
+	APIRetry("ListTimeSeries", "ResourceExhausted")
+	APIThrottled("ListTimeSeries", 1500*time.Millisecond)
+	APIThrottled("ListTimeSeries", 500*time.Millisecond)
+	assert.Equal(t, float64(1), testutil.ToFloat64(apiRetries.WithLabelValues("ListTimeSeries", "ResourceExhausted")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(apiThrottled.WithLabelValues("ListTimeSeries")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(apiThrottledSeconds.WithLabelValues("ListTimeSeries")))
+}
+
+func TestClientReconnect(t *testing.T) {
+	ClientReconnect("deployments-metrics", nil)
+	ClientReconnect("deployments-metrics", errors.New("no credentials"))
+	assert.Equal(t, float64(1), testutil.ToFloat64(clientReconnects.WithLabelValues("deployments-metrics", "success")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(clientReconnects.WithLabelValues("deployments-metrics", "error")))
+}
+
+func TestJobCancelled(t *testing.T) {
+	metricType := "storage.googleapis.com/storage/total_bytes"
+	JobCancelled(metricType, "deployments-metrics", "next_run")
+	assert.Equal(t, float64(1), testutil.ToFloat64(jobsCancelled.WithLabelValues(metricType, "deployments-metrics", "next_run")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(jobsCancelled.WithLabelValues(metricType, "deployments-metrics", "timeout")))
+}
+
+func TestSeriesFetched(t *testing.T) {
+	metricType := "storage.googleapis.com/storage/object_count"
+	newest := time.Now().Add(-2 * time.Minute)
+	newestProto, err := ptypes.TimestampProto(newest)
+	assert.NoError(t, err)
+	olderProto, err := ptypes.TimestampProto(newest.Add(-time.Minute))
+	assert.NoError(t, err)
+	SeriesFetched(metricType, &monitoringpb.TimeSeries{
+		Points: []*monitoringpb.Point{
+			{Interval: &monitoringpb.TimeInterval{EndTime: newestProto}},
+			{Interval: &monitoringpb.TimeInterval{EndTime: olderProto}},
+		},
+	})
+	assert.Equal(t, float64(1), testutil.ToFloat64(seriesFetched.WithLabelValues(metricType)))
+	assert.Equal(t, float64(2), testutil.ToFloat64(pointsFetched.WithLabelValues(metricType)))
+	newestPoints.mu.Lock()
+	assert.True(t, newestPoints.newest[metricType].Equal(newest))
+	newestPoints.mu.Unlock()
+}
+
+func TestGetStatus(t *testing.T) {
+	CollectionError("bigquery.googleapis.com/query/count", "test", "query")
+	ObserveCollectionDuration("json", "bigquery.googleapis.com/query/count", time.Now().Add(-time.Second))
+	status, err := GetStatus(prometheus.DefaultGatherer)
+	assert.NoError(t, err)
+	// only the self metrics are in the status
+	for name := range status.Metrics {
+		assert.Contains(t, name, "stackdriver_exporter_")
+	}
+	errorsSamples := status.Metrics["stackdriver_exporter_collection_errors_total"]
+	assert.Equal(t, 1, len(errorsSamples))
+	assert.Equal(t, float64(1), errorsSamples[0].Value)
+	assert.Equal(t, "test", errorsSamples[0].Labels["project_id"])
+	durationSamples := status.Metrics["stackdriver_exporter_collection_duration_seconds"]
+	assert.Equal(t, 1, len(durationSamples))
+	assert.Equal(t, uint64(1), durationSamples[0].Count)
+}
@@ -0,0 +1,80 @@
+package selfmetrics
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/atomicfile"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Status : status of the exporter written to the json status file
+type Status struct {
+	UpdatedAt time.Time                 `json:"updated_at"`
+	Metrics   map[string][]StatusSample `json:"metrics"`
+}
+
+// StatusSample : value of a self metric, histograms have the count and sum of the observations
+type StatusSample struct {
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value,omitempty"`
+	Count  uint64            `json:"count,omitempty"`
+	Sum    float64           `json:"sum,omitempty"`
+}
+
+// GetStatus : gets the current values of the self metrics of the exporter
+func GetStatus(gatherer prometheus.Gatherer) (*Status, error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+	status := &Status{
+		UpdatedAt: time.Now(),
+		Metrics:   make(map[string][]StatusSample),
+	}
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), namespace+"_") {
+			continue
+		}
+		samples := make([]StatusSample, 0, len(family.Metric))
+		for _, m := range family.Metric {
+			samples = append(samples, getStatusSample(family.GetType(), m))
+		}
+		status.Metrics[family.GetName()] = samples
+	}
+	return status, nil
+}
+
+func getStatusSample(metricType dto.MetricType, m *dto.Metric) StatusSample {
+	sample := StatusSample{
+		Labels: make(map[string]string, len(m.Label)),
+	}
+	for _, l := range m.Label {
+		sample.Labels[l.GetName()] = l.GetValue()
+	}
+	switch metricType {
+	case dto.MetricType_COUNTER:
+		sample.Value = m.GetCounter().GetValue()
+	case dto.MetricType_GAUGE:
+		sample.Value = m.GetGauge().GetValue()
+	case dto.MetricType_HISTOGRAM:
+		sample.Count = m.GetHistogram().GetSampleCount()
+		sample.Sum = m.GetHistogram().GetSampleSum()
+	}
+	return sample
+}
+
+// WriteStatusFile : writes the status of the exporter to the file
+func WriteStatusFile(path string) error {
+	status, err := GetStatus(prometheus.DefaultGatherer)
+	if err != nil {
+		return err
+	}
+	statusJSON, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, statusJSON)
+}
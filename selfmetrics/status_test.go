@@ -0,0 +1,32 @@
+package selfmetrics
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteStatusFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "status")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	APICall("ListTimeSeries", "compute.googleapis.com/instance/cpu/utilization", nil)
+	path := filepath.Join(dir, "status.json")
+	assert.NoError(t, WriteStatusFile(path))
+	statusJSON, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	status := Status{}
+	assert.NoError(t, json.Unmarshal(statusJSON, &status))
+	assert.False(t, status.UpdatedAt.IsZero())
+	assert.NotEmpty(t, status.Metrics["stackdriver_exporter_api_calls_total"])
+	// no temporary files left
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+	// not existing directory
+	assert.Error(t, WriteStatusFile(filepath.Join(dir, "missing", "status.json")))
+}
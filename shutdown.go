@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/collector"
+	"github.com/fernhtls/stackdriverExporter/utils"
+)
+
+// exit codes of the exporter once stopped by SIGINT or SIGTERM
+const (
+	// all the jobs finished and the outputs were closed
+	exitClean = 0
+	// closing the clients, the outputs or the http server failed
+	exitShutdownError = 1
+	// jobs were still running after the shutdown timeout, and were cancelled
+	exitShutdownTimeout = 3
+)
+
+// time the jobs cancelled after the shutdown timeout have to return, before the outputs are closed
+const cancelledJobsTimeout = 5 * time.Second
+
+// notifies SIGINT and SIGTERM, stopping the exporter
+func notifyStop() <-chan os.Signal {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	return stop
+}
+
+// stops scheduling new runs and waits for the runs in flight and the catch ups to finish, up to the timeout
+// returns false when the jobs were still running after the timeout
+func drainJobs(catchUps *sync.WaitGroup, timeout time.Duration) bool {
+	cronLogger.Println("stopping scheduling, waiting up to", timeout, "for the running jobs")
+	if waitJobs(catchUps, timeout) {
+		cronLogger.Println("running jobs finished")
+		return true
+	}
+	return false
+}
+
+// waits for the jobs cancelled to return, up to cancelledJobsTimeout, so they don't write in the outputs closed
+// returns false when the jobs were still running after the timeout
+func waitCancelledJobs(catchUps *sync.WaitGroup) bool {
+	if waitJobs(catchUps, cancelledJobsTimeout) {
+		cronLogger.Println("cancelled jobs returned")
+		return true
+	}
+	cronLogger.Println("cancelled jobs still running after", cancelledJobsTimeout, "closing the outputs anyway")
+	return false
+}
+
+// stops the cron server and waits for its runs and the catch ups to return, up to the timeout
+// stopping the cron server again only waits for its runs
+func waitJobs(catchUps *sync.WaitGroup, timeout time.Duration) bool {
+	cronDone := cronServer.Stop()
+	drained := make(chan struct{})
+	go func() {
+		<-cronDone.Done()
+		catchUps.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// closes the sinks, flushing the files written, and then the clients of the projects
+// returns false when any of them failed to close
+func closeJobs(projectsJobs []*utils.CronJobs, c *collector.Collector) bool {
+	closed := true
+	cronLogger.Println("closing outputs")
+	if err := c.Close(); err != nil {
+		cronLogger.Println(err)
+		closed = false
+	}
+	// the clients are shared by the jobs and the outputs, closed once both are done
+	for _, jobs := range projectsJobs {
+		if err := jobs.Close(); err != nil {
+			cronLogger.Println(fmt.Errorf("error on closing client for project %s: %v", jobs.Client().ProjectID, err))
+			closed = false
+		}
+	}
+	return closed
+}
+
+// shuts down the http server, waiting for its Serve to return
+// returns false when the server failed to shut down
+func stopServer(cancel func(), serverDone <-chan error) bool {
+	cronLogger.Println("shutting down the http server")
+	cancel()
+	if err := <-serverDone; err != nil && err != http.ErrServerClosed {
+		cronLogger.Println(fmt.Errorf("error on shutting down the http server: %v", err))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,59 @@
+package stackdriverClient
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+// Aggregation : server side aggregation settings for the time series requests
+// AlignmentPeriod	- period used to align the points of every series
+// PerSeriesAligner	- aligner applied to each series (ALIGN_RATE, ALIGN_MEAN, ALIGN_DELTA, ...)
+// CrossSeriesReducer	- optional reducer combining the aligned series (REDUCE_SUM, REDUCE_MEAN, ...)
+// GroupByFields	- optional fields preserved when reducing (resource.labels.bucket_name, ...)
+type Aggregation struct {
+	AlignmentPeriod    time.Duration
+	PerSeriesAligner   string
+	CrossSeriesReducer string
+	GroupByFields      []string
+}
+
+// Validate : validates the aggregation settings against the monitoring api values
+func (a *Aggregation) Validate() error {
+	if _, ok := monitoringpb.Aggregation_Aligner_value[a.PerSeriesAligner]; !ok {
+		return fmt.Errorf("per series aligner %q is not valid", a.PerSeriesAligner)
+	}
+	if a.CrossSeriesReducer != "" {
+		if _, ok := monitoringpb.Aggregation_Reducer_value[a.CrossSeriesReducer]; !ok {
+			return fmt.Errorf("cross series reducer %q is not valid", a.CrossSeriesReducer)
+		}
+		if a.CrossSeriesReducer != "REDUCE_NONE" && a.PerSeriesAligner == "ALIGN_NONE" {
+			return errors.New("cross series reducer needs a per series aligner other than ALIGN_NONE")
+		}
+	}
+	if a.PerSeriesAligner != "ALIGN_NONE" && a.AlignmentPeriod < time.Minute {
+		return errors.New("alignment period should be at least 60s when using an aligner")
+	}
+	if len(a.GroupByFields) > 0 && (a.CrossSeriesReducer == "" || a.CrossSeriesReducer == "REDUCE_NONE") {
+		return errors.New("group by fields need a cross series reducer")
+	}
+	return nil
+}
+
+// toProto : converts the aggregation settings into the monitoring api message
+func (a *Aggregation) toProto() *monitoringpb.Aggregation {
+	agg := &monitoringpb.Aggregation{
+		PerSeriesAligner: monitoringpb.Aggregation_Aligner(monitoringpb.Aggregation_Aligner_value[a.PerSeriesAligner]),
+		GroupByFields:    a.GroupByFields,
+	}
+	if a.AlignmentPeriod > 0 {
+		agg.AlignmentPeriod = ptypes.DurationProto(a.AlignmentPeriod)
+	}
+	if a.CrossSeriesReducer != "" {
+		agg.CrossSeriesReducer = monitoringpb.Aggregation_Reducer(monitoringpb.Aggregation_Reducer_value[a.CrossSeriesReducer])
+	}
+	return agg
+}
@@ -0,0 +1,48 @@
+package stackdriverClient
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func TestAggregationValidate(t *testing.T) {
+	a := Aggregation{
+		AlignmentPeriod:    5 * time.Minute,
+		PerSeriesAligner:   "ALIGN_RATE",
+		CrossSeriesReducer: "REDUCE_SUM",
+		GroupByFields:      []string{"resource.labels.bucket_name"},
+	}
+	assert.NoError(t, a.Validate())
+	// unknown aligner
+	a = Aggregation{AlignmentPeriod: time.Minute, PerSeriesAligner: "ALIGN_WRONG"}
+	assert.Error(t, a.Validate())
+	// unknown reducer
+	a = Aggregation{AlignmentPeriod: time.Minute, PerSeriesAligner: "ALIGN_MEAN", CrossSeriesReducer: "REDUCE_WRONG"}
+	assert.Error(t, a.Validate())
+	// alignment period too short
+	a = Aggregation{AlignmentPeriod: 10 * time.Second, PerSeriesAligner: "ALIGN_MEAN"}
+	assert.Error(t, a.Validate())
+	// group by without reducer
+	a = Aggregation{AlignmentPeriod: time.Minute, PerSeriesAligner: "ALIGN_MEAN", GroupByFields: []string{"resource.labels.zone"}}
+	assert.Error(t, a.Validate())
+	// reducer without aligner
+	a = Aggregation{PerSeriesAligner: "ALIGN_NONE", CrossSeriesReducer: "REDUCE_SUM"}
+	assert.Error(t, a.Validate())
+}
+
+func TestAggregationToProto(t *testing.T) {
+	a := Aggregation{
+		AlignmentPeriod:    2 * time.Minute,
+		PerSeriesAligner:   "ALIGN_DELTA",
+		CrossSeriesReducer: "REDUCE_SUM",
+		GroupByFields:      []string{"resource.labels.bucket_name"},
+	}
+	p := a.toProto()
+	assert.Equal(t, int64(120), p.AlignmentPeriod.Seconds)
+	assert.Equal(t, monitoringpb.Aggregation_ALIGN_DELTA, p.PerSeriesAligner)
+	assert.Equal(t, monitoringpb.Aggregation_REDUCE_SUM, p.CrossSeriesReducer)
+	assert.Equal(t, []string{"resource.labels.bucket_name"}, p.GroupByFields)
+}
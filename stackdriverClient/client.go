@@ -5,18 +5,65 @@ import (
 	"errors"
 	"fmt"
 	"google.golang.org/genproto/googleapis/api/metric"
+	"strings"
+	"sync"
+	"time"
 
 	monitoring "cloud.google.com/go/monitoring/apiv3"
+	"github.com/fernhtls/stackdriverExporter/selfmetrics"
 	"github.com/golang/protobuf/ptypes/timestamp"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
 	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // StackDriverClient : struct with the client and all the definitions for accessing stackdriver
+// the client is created once by InitClient and shared by all the calls, safe for concurrent use, until Close
 // ProjectID	- project id for the connection and extraction of metrics
+// Options	- optional settings of the connection, like InsecureEndpoint for a local server
 type StackDriverClient struct {
 	ProjectID  string
+	Options     []option.ClientOption
 	client     *monitoring.MetricClient
+	mu          sync.RWMutex
+	closed      bool
+	unavailable int
+}
+
+// ErrClientClosed : error of the calls on a closed client
+var ErrClientClosed = errors.New("client is closed")
+
+// InsecureEndpoint : options connecting to the endpoint without credentials nor tls, as to a local fake server
+func InsecureEndpoint(endpoint string) []option.ClientOption {
+	return []option.ClientOption{
+		option.WithEndpoint(endpoint),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+	}
+}
+
+// unavailable errors in a row before creating the connection again
+const reconnectAfterUnavailable = 3
+
+// key of the call timeout in the context
+type callTimeoutKey struct{}
+
+// WithCallTimeout : sets the timeout of every api call made with the context, as every page of the time series
+// the context deadline still bounds all the calls, 0 for no timeout
+func WithCallTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, callTimeoutKey{}, timeout)
+}
+
+// gets the context of a single api call, with the call timeout of the context when set
+func callContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout, ok := ctx.Value(callTimeoutKey{}).(time.Duration); ok && timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
 }
 
 func noMetricTypeError() error {
@@ -49,8 +96,8 @@ func (st *StackDriverClient) createClient() error {
 		return err
 	}
 	// Creates a new stackdriver client
-	// Depends on setting GOOGLE_APPLICATION_CREDENTIALS
-	client, err := monitoring.NewMetricClient(context.Background())
+	// Depends on setting GOOGLE_APPLICATION_CREDENTIALS, unless the options connect without authentication
+	client, err := monitoring.NewMetricClient(context.Background(), st.Options...)
 	if err != nil {
 		return err
 	}
@@ -58,49 +105,261 @@ func (st *StackDriverClient) createClient() error {
 	return nil
 }
 
-// InitClient : Initiates a new stackdriver client - only sets client for the project
+// InitClient : Initiates the stackdriver client of the project, once - calling it again keeps the client created
 func (st *StackDriverClient) InitClient() error {
-	if err := st.createClient(); err != nil {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return ErrClientClosed
+	}
+	if st.client != nil {
+		return nil
+	}
+	return st.createClient()
+}
+
+// Reconnect : creates the client again, closing the previous one once replaced
+// the previous client is kept when the new one can't be created
+func (st *StackDriverClient) Reconnect() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return ErrClientClosed
+	}
+	return st.reconnect()
+}
+
+func (st *StackDriverClient) reconnect() error {
+	previous := st.client
+	err := st.createClient()
+	selfmetrics.ClientReconnect(st.ProjectID, err)
+	if err != nil {
 		return err
 	}
+	st.unavailable = 0
+	if previous != nil {
+		// calls in flight on the previous client are cancelled
+		previous.Close()
+	}
 	return nil
 }
 
+// Close : closes the client and its connection, the calls after failing with ErrClientClosed
+func (st *StackDriverClient) Close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed {
+		return nil
+	}
+	st.closed = true
+	if st.client == nil {
+		return nil
+	}
+	err := st.client.Close()
+	st.client = nil
+	return err
+}
+
+// gets the client for a call
+func (st *StackDriverClient) getClient() (*monitoring.MetricClient, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if st.closed {
+		return nil, ErrClientClosed
+	}
+	if st.client == nil {
+		return nil, errors.New("client is not initialized")
+	}
+	return st.client, nil
+}
+
+// checks if the error means the connection can't be used anymore
+// a closing connection is fatal, unavailable errors only when repeated as the connection retries by itself
+func isConnectionClosing(err error) bool {
+	s, ok := status.FromError(err)
+	return ok && s.Code() == codes.Canceled && strings.Contains(s.Message(), "client connection is closing")
+}
+
+// checks the result of a call made with the client, creating the client again on fatal transport errors
+// the client is not created again when already replaced, as by a concurrent call
+func (st *StackDriverClient) checkConnection(client *monitoring.MetricClient, err error) {
+	if err == iterator.Done {
+		err = nil
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.closed || st.client != client {
+		return
+	}
+	switch {
+	case err == nil:
+		st.unavailable = 0
+		return
+	case status.Code(err) == codes.Unavailable:
+		st.unavailable++
+		if st.unavailable < reconnectAfterUnavailable {
+			return
+		}
+	case !isConnectionClosing(err):
+		return
+	}
+	st.reconnect()
+}
+
 // GetMetricDescriptor : Gets the descriptor of the metric
 func (st *StackDriverClient) GetMetricDescriptor(metricType string) (*metric.MetricDescriptor, error) {
+	return st.GetMetricDescriptorContext(context.Background(), metricType)
+}
+
+// GetMetricDescriptorContext : Gets the descriptor of the metric, the call being cancelled with the context
+func (st *StackDriverClient) GetMetricDescriptorContext(ctx context.Context,
+	metricType string) (*metric.MetricDescriptor, error) {
 	if metricType == "" {
 		return nil, noMetricTypeError()
 	}
-	descriptor , err := st.client.GetMetricDescriptor(
-		context.Background(),
-		&monitoringpb.GetMetricDescriptorRequest{
-			Name:   "projects/" + st.ProjectID + "/metricDescriptors/" + metricType,
-		})
+	var descriptor *metric.MetricDescriptor
+	err := st.call(ctx, "GetMetricDescriptor", metricType, func(ctx context.Context, client *monitoring.MetricClient) error {
+		var err error
+		descriptor, err = client.GetMetricDescriptor(
+			ctx,
+			&monitoringpb.GetMetricDescriptorRequest{
+				Name: "projects/" + st.ProjectID + "/metricDescriptors/" + metricType,
+			})
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return descriptor, nil
 }
 
+// ListMetricDescriptors : Lists the descriptors of the metrics available in the project
+// filter is an optional cloud monitoring filter, like metric.type = starts_with("storage.googleapis.com/")
+// the descriptors are fetched one page per call, a page failing being fetched again with the retry policy
+// the calls are cancelled with the context, every page having the call timeout of the context when set
+func (st *StackDriverClient) ListMetricDescriptors(ctx context.Context, filter string) ([]*metric.MetricDescriptor, error) {
+	req := &monitoringpb.ListMetricDescriptorsRequest{
+		Name:   "projects/" + st.ProjectID,
+		Filter: filter,
+	}
+	descriptors := make([]*metric.MetricDescriptor, 0)
+	pageToken := ""
+	for {
+		var page []*metric.MetricDescriptor
+		err := st.call(ctx, "ListMetricDescriptors", "", func(ctx context.Context, client *monitoring.MetricClient) error {
+			var err error
+			page, pageToken, err = client.ListMetricDescriptors(ctx, req).InternalFetch(0, pageToken)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		descriptors = append(descriptors, page...)
+		if pageToken == "" {
+			return descriptors, nil
+		}
+	}
+}
+
 // GetMonitoredResourceDescriptor : Gets the Resource descriptor of the metric
 func (st *StackDriverClient) GetMonitoredResourceDescriptor(resourceType string) (*monitoredrespb.MonitoredResourceDescriptor, error) {
+	return st.GetMonitoredResourceDescriptorContext(context.Background(), resourceType)
+}
+
+// GetMonitoredResourceDescriptorContext : Gets the Resource descriptor of the metric, the call being cancelled
+// with the context
+func (st *StackDriverClient) GetMonitoredResourceDescriptorContext(ctx context.Context,
+	resourceType string) (*monitoredrespb.MonitoredResourceDescriptor, error) {
 	if resourceType == "" {
 		return nil, noMetricTypeError()
 	}
-	resourceDescriptor , err := st.client.GetMonitoredResourceDescriptor(
-		context.Background(),
-		&monitoringpb.GetMonitoredResourceDescriptorRequest{
-			Name:   "projects/" + st.ProjectID + "/monitoredResourceDescriptors/" + resourceType,
-		})
+	var resourceDescriptor *monitoredrespb.MonitoredResourceDescriptor
+	err := st.call(ctx, "GetMonitoredResourceDescriptor", "", func(ctx context.Context, client *monitoring.MetricClient) error {
+		var err error
+		resourceDescriptor, err = client.GetMonitoredResourceDescriptor(
+			ctx,
+			&monitoringpb.GetMonitoredResourceDescriptorRequest{
+				Name: "projects/" + st.ProjectID + "/monitoredResourceDescriptors/" + resourceType,
+			})
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 	return resourceDescriptor, nil
 }
 
+// buildTimeSeriesFilter : builds the monitoring filter for the metric type,
+// adding the optional filter expression (resource / metric labels) for the metric
+func buildTimeSeriesFilter(metricType, filter string) string {
+	metricFilter := "metric.type = \"" + metricType + "\""
+	if strings.TrimSpace(filter) == "" {
+		return metricFilter
+	}
+	return metricFilter + " AND (" + filter + ")"
+}
+
+// TimeSeriesIterator : iterator of the time series returned by stackdriver
+// the series are fetched one page per call, every call with the call timeout of the context
+// a page failing is fetched again with the retry policy, resuming from its page token
+// counts the series, points and errors of the metric type in the self metrics
+type TimeSeriesIterator struct {
+	ctx        context.Context
+	req        *monitoringpb.ListTimeSeriesRequest
+	metricType string
+	st         *StackDriverClient
+	page       []*monitoringpb.TimeSeries
+	pageToken  string
+	lastPage   bool
+}
+
+// fetches the next page of series, with one call to the api
+func (t *TimeSeriesIterator) fetchPage() error {
+	var page []*monitoringpb.TimeSeries
+	var nextToken string
+	err := t.st.call(t.ctx, "ListTimeSeries", t.metricType, func(ctx context.Context, client *monitoring.MetricClient) error {
+		var err error
+		// the page size of the request is kept, 0 for the default page size of the api
+		page, nextToken, err = client.ListTimeSeries(ctx, t.req).InternalFetch(int(t.req.PageSize), t.pageToken)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	t.page = page
+	t.pageToken = nextToken
+	t.lastPage = nextToken == ""
+	return nil
+}
+
+// Next : returns the next time series, or iterator.Done when there are no more series
+func (t *TimeSeriesIterator) Next() (*monitoringpb.TimeSeries, error) {
+	for len(t.page) == 0 {
+		if t.lastPage {
+			return nil, iterator.Done
+		}
+		if err := t.fetchPage(); err != nil {
+			return nil, err
+		}
+	}
+	series := t.page[0]
+	t.page = t.page[1:]
+	selfmetrics.SeriesFetched(t.metricType, series)
+	return series, nil
+}
+
 // GetTimeSeriesMetric : Gets the timeseries metrics from stackdriver
-func (st *StackDriverClient) GetTimeSeriesMetric(metricType string,
-	startTime *timestamp.Timestamp, endTime *timestamp.Timestamp)(*monitoring.TimeSeriesIterator, error) {
+// filter is an optional cloud monitoring filter expression added to the metric type filter
+// aggregation is optional, when nil the raw points are returned
+func (st *StackDriverClient) GetTimeSeriesMetric(metricType, filter string, aggregation *Aggregation,
+	startTime *timestamp.Timestamp, endTime *timestamp.Timestamp) (*TimeSeriesIterator, error) {
+	return st.GetTimeSeriesMetricContext(context.Background(), metricType, filter, aggregation, startTime, endTime)
+}
+
+// GetTimeSeriesMetricContext : Gets the timeseries metrics from stackdriver, the calls of the iterator being
+// cancelled with the context
+func (st *StackDriverClient) GetTimeSeriesMetricContext(ctx context.Context, metricType, filter string,
+	aggregation *Aggregation, startTime *timestamp.Timestamp, endTime *timestamp.Timestamp) (*TimeSeriesIterator, error) {
 	if metricType == "" {
 		return nil, noMetricTypeError()
 	}
@@ -113,15 +372,23 @@ func (st *StackDriverClient) GetTimeSeriesMetric(metricType string,
 	if endTime.AsTime().Before(startTime.AsTime()) || endTime.AsTime().Equal(startTime.AsTime()) {
 		return nil, invalidIntervalError(startTime, endTime)
 	}
-	it := st.client.ListTimeSeries(context.Background(),
-		&monitoringpb.ListTimeSeriesRequest{
-			Name:   "projects/" + st.ProjectID,
-			Filter: "metric.type = \"" + metricType + "\"",
-			Interval: &monitoringpb.TimeInterval{
-				StartTime: startTime,
-				EndTime:   endTime,
-			},
-			View: monitoringpb.ListTimeSeriesRequest_FULL,
-		})
-	return it, nil
+	req := &monitoringpb.ListTimeSeriesRequest{
+		Name:   "projects/" + st.ProjectID,
+		Filter: buildTimeSeriesFilter(metricType, filter),
+		Interval: &monitoringpb.TimeInterval{
+			StartTime: startTime,
+			EndTime:   endTime,
+		},
+		View: monitoringpb.ListTimeSeriesRequest_FULL,
+	}
+	if aggregation != nil {
+		if err := aggregation.Validate(); err != nil {
+			return nil, err
+		}
+		req.Aggregation = aggregation.toProto()
+	}
+	if _, err := st.getClient(); err != nil {
+		return nil, err
+	}
+	return &TimeSeriesIterator{ctx: ctx, req: req, metricType: metricType, st: st}, nil
 }
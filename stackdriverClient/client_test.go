@@ -1,60 +1,174 @@
 package stackdriverClient
 
 import (
-	"fmt"
-	"github.com/gogo/protobuf/jsonpb"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fernhtls/stackdriverExporter/fakemonitoring"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/api/iterator"
-	"testing"
-	"time"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-func TestCreateClient(t *testing.T) {
-	// Raises an error as timestamp are equal
-	client := StackDriverClient{
-		ProjectID:  "deployments-metrics",
+// starts the fake server with the fixtures, returning a client connected to it
+// the points of the fixtures are moved to end one minute ago
+func newFakeClient(t *testing.T) (*fakemonitoring.Server, *StackDriverClient) {
+	server, options := fakemonitoring.NewTestServer(t)
+	client := &StackDriverClient{
+		ProjectID: "deployments-metrics",
+		Options:   options,
 	}
 	assert.NoError(t, client.InitClient())
+	return server, client
+}
+
+// reads all the series of the iterator
+func readAllSeries(t *testing.T, it *TimeSeriesIterator) int {
+	count := 0
+	for {
+		_, err := it.Next()
+		if err == iterator.Done {
+			return count
+		}
+		if !assert.NoError(t, err) {
+			return count
+		}
+		count++
+	}
 }
 
+func TestCreateClient(t *testing.T) {
+	_, client := newFakeClient(t)
+	defer client.Close()
+	// calling it again keeps the client
+	assert.NoError(t, client.InitClient())
+	assert.Error(t, (&StackDriverClient{}).InitClient())
+}
 
 func TestGetTimeSeriesMetric(t *testing.T) {
-	// Depends on setting GOOGLE_APPLICATION_CREDENTIALS
-	// or gcloud auth application-default login
+	_, client := newFakeClient(t)
+	defer client.Close()
 	et := ptypes.TimestampNow()
 	st, err := ptypes.TimestampProto(time.Now().Add(-15 * time.Minute))
-	if err != nil {
-		t.Error(err)
-	}
+	assert.NoError(t, err)
+	it, err := client.GetTimeSeriesMetric("storage.googleapis.com/storage/object_count", "", nil, st, et)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, readAllSeries(t, it))
+	// filtered on the resource labels
+	it, err = client.GetTimeSeriesMetric("storage.googleapis.com/storage/object_count",
+		"resource.labels.bucket_name = starts_with(\"prod-\")", nil, st, et)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, readAllSeries(t, it))
+	// equal or inverted timestamps are refused
+	_, err = client.GetTimeSeriesMetric("storage.googleapis.com/storage/object_count", "", nil, et, st)
+	assert.Error(t, err)
+}
+
+func TestGetDescriptors(t *testing.T) {
+	server, client := newFakeClient(t)
+	defer client.Close()
+	descriptor, err := client.GetMetricDescriptor("storage.googleapis.com/storage/total_bytes")
+	assert.NoError(t, err)
+	assert.Equal(t, "By", descriptor.Unit)
+	_, err = client.GetMetricDescriptor("storage.googleapis.com/storage/unknown")
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	resourceDescriptor, err := client.GetMonitoredResourceDescriptorContext(context.Background(), "gcs_bucket")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(resourceDescriptor.Labels))
+	// one descriptor by page
+	server.PageSize = 1
+	filter := "metric.type = starts_with(\"storage.googleapis.com/\")"
+	descriptors, err := client.ListMetricDescriptors(context.Background(), filter)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(descriptors))
+	assert.Equal(t, 2, server.Calls("ListMetricDescriptors"))
+	// listing cancelled with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.ListMetricDescriptors(ctx, filter)
+	assert.Equal(t, codes.Canceled, status.Code(err))
+}
+
+func TestTimeSeriesPagesRetried(t *testing.T) {
+	SetRetryPolicy(RetryPolicy{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer SetRetryPolicy(DefaultRetryPolicy)
+	server, client := newFakeClient(t)
+	defer client.Close()
+	server.PageSize = 1
+	et := ptypes.TimestampNow()
+	st, err := ptypes.TimestampProto(time.Now().Add(-15 * time.Minute))
+	assert.NoError(t, err)
+	it, err := client.GetTimeSeriesMetric("storage.googleapis.com/storage/object_count", "", nil, st, et)
+	assert.NoError(t, err)
+	_, err = it.Next()
+	assert.NoError(t, err)
+	// the second page fails twice, fetched again from its page token
+	server.FailNext(codes.Unavailable, codes.ResourceExhausted)
+	assert.Equal(t, 2, readAllSeries(t, it))
+	assert.Equal(t, 5, server.Calls("ListTimeSeries"))
+	// errors not transient are not retried
+	server.FailNext(codes.PermissionDenied)
+	_, err = client.GetMetricDescriptor("storage.googleapis.com/storage/total_bytes")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Equal(t, 1, server.Calls("GetMetricDescriptor"))
+}
+
+func TestBuildTimeSeriesFilter(t *testing.T) {
+	assert.Equal(t, "metric.type = \"storage.googleapis.com/storage/total_bytes\"",
+		buildTimeSeriesFilter("storage.googleapis.com/storage/total_bytes", ""))
+	assert.Equal(t, "metric.type = \"storage.googleapis.com/storage/total_bytes\" AND "+
+		"(resource.labels.bucket_name = starts_with(\"prod-\"))",
+		buildTimeSeriesFilter("storage.googleapis.com/storage/total_bytes",
+			"resource.labels.bucket_name = starts_with(\"prod-\")"))
+}
+
+func TestClientLifecycle(t *testing.T) {
 	client := StackDriverClient{
-		ProjectID:  "deployments-metrics",
-	}
-	err = client.InitClient()
-	if err != nil {
-		t.Error(err)
-	}
-	it, err := client.GetTimeSeriesMetric("storage.googleapis.com/storage/total_bytes",
-		st, et)
-	if err != nil {
-		t.Error(err)
+		ProjectID: "deployments-metrics",
 	}
-	respsJSON := make([]string, 0)
-	for {
-		resp, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			fmt.Println(fmt.Errorf("could not read time series value: %v", err))
-		}
-		jm := jsonpb.Marshaler{}
-		respJSON, err := jm.MarshalToString(resp)
-		if err != nil {
-			t.Error(err)
-		}
-		respsJSON = append(respsJSON, respJSON)
-	}
-	assert.GreaterOrEqual(t, len(respsJSON), 0)
-	fmt.Println(respsJSON)
+	// calls before InitClient fail instead of panicking
+	_, err := client.GetMetricDescriptor("storage.googleapis.com/storage/total_bytes")
+	assert.Error(t, err)
+	// unavailable errors below the threshold keep the client
+	client.checkConnection(nil, status.Error(codes.Unavailable, "unavailable"))
+	client.checkConnection(nil, status.Error(codes.Unavailable, "unavailable"))
+	assert.Equal(t, 2, client.unavailable)
+	client.checkConnection(nil, nil)
+	assert.Equal(t, 0, client.unavailable)
+	// closed clients can't be used anymore
+	assert.NoError(t, client.Close())
+	assert.NoError(t, client.Close())
+	assert.Equal(t, ErrClientClosed, client.InitClient())
+	assert.Equal(t, ErrClientClosed, client.Reconnect())
+	_, err = client.GetMonitoredResourceDescriptor("gcs_bucket")
+	assert.Equal(t, ErrClientClosed, err)
+}
+
+func TestIsConnectionClosing(t *testing.T) {
+	assert.True(t, isConnectionClosing(status.Error(codes.Canceled, "grpc: the client connection is closing")))
+	assert.False(t, isConnectionClosing(status.Error(codes.Canceled, "context canceled")))
+	assert.False(t, isConnectionClosing(status.Error(codes.Unavailable, "unavailable")))
+	assert.False(t, isConnectionClosing(nil))
+}
+
+func TestCallContext(t *testing.T) {
+	// no timeout without call timeout
+	ctx, cancel := callContext(context.Background())
+	_, ok := ctx.Deadline()
+	assert.False(t, ok)
+	cancel()
+	ctx, cancel = callContext(WithCallTimeout(context.Background(), time.Minute))
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+	cancel()
+	// the call is still cancelled with the context
+	parent, cancelParent := context.WithCancel(WithCallTimeout(context.Background(), time.Minute))
+	ctx, cancel = callContext(parent)
+	defer cancel()
+	cancelParent()
+	assert.Equal(t, context.Canceled, ctx.Err())
 }
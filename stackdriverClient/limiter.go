@@ -0,0 +1,75 @@
+package stackdriverClient
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter : token bucket of the requests to the api, refilled at the requests per minute
+// the bucket holds a tenth of the requests per minute, so the jobs starting together are spread over a few seconds
+// instead of spending the quota of the minute at once
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter : creates a limiter of the requests per minute, with a full bucket
+func NewLimiter(requestsPerMinute int) *Limiter {
+	burst := float64(requestsPerMinute) / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:   float64(requestsPerMinute) / float64(time.Minute),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// takes a token at now, returning the time to wait for it when the bucket is empty
+func (l *Limiter) reserve(now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.After(l.last) {
+		l.tokens += float64(now.Sub(l.last)) * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+	}
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate)
+}
+
+// gives back a token reserved and not used
+func (l *Limiter) cancel() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens++
+}
+
+// Wait : waits for a token of the limiter, returning the time waited
+// the token is given back when the context is done before, returning the error of the context
+func (l *Limiter) Wait(ctx context.Context) (time.Duration, error) {
+	wait := l.reserve(time.Now())
+	if wait <= 0 {
+		return 0, nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		l.cancel()
+		return 0, ctx.Err()
+	case <-timer.C:
+		return wait, nil
+	}
+}
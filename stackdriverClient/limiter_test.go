@@ -0,0 +1,39 @@
+package stackdriverClient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterReserve(t *testing.T) {
+	// 600 requests per minute, 10 per second with a bucket of 60
+	l := NewLimiter(600)
+	now := l.last
+	for i := 0; i < 60; i++ {
+		assert.Equal(t, time.Duration(0), l.reserve(now))
+	}
+	// bucket empty, waiting for the next tokens
+	assert.Equal(t, 100*time.Millisecond, l.reserve(now))
+	assert.Equal(t, 200*time.Millisecond, l.reserve(now))
+	// refilled after a second, the tokens reserved being paid first
+	assert.Equal(t, time.Duration(0), l.reserve(now.Add(time.Second)))
+	// never refilled above the bucket
+	l.reserve(now.Add(time.Hour))
+	assert.Equal(t, float64(59), l.tokens)
+}
+
+func TestLimiterWaitCancelled(t *testing.T) {
+	l := NewLimiter(1)
+	waited, err := l.Wait(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), waited)
+	// next token in a minute, the token is given back when cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.Wait(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.InDelta(t, 0, l.tokens, 0.01)
+}
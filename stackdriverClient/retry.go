@@ -0,0 +1,139 @@
+package stackdriverClient
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3"
+	"github.com/fernhtls/stackdriverExporter/selfmetrics"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy : retries of the api calls failing with transient errors, with exponential backoff and jitter
+// MaxRetries	- times a call is made again, 0 for no retries
+// InitialBackoff	- backoff before the first retry, doubled on every retry
+// MaxBackoff	- longest backoff between two retries
+type RetryPolicy struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy : retry policy of the clients, when not set
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries:     4,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+var (
+	clientLogger = log.New(os.Stdout, "stackdriver_client: ", log.LstdFlags)
+	// retry policy and read limiter shared by all the clients
+	policyMu    sync.RWMutex
+	retryPolicy = DefaultRetryPolicy
+	readLimiter *Limiter
+)
+
+// SetRetryPolicy : sets the retry policy of all the clients
+func SetRetryPolicy(policy RetryPolicy) {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	retryPolicy = policy
+}
+
+// SetReadLimit : limits the read requests of all the clients, all the jobs sharing the same requests per minute
+// 0 for no limit
+func SetReadLimit(requestsPerMinute int) {
+	policyMu.Lock()
+	defer policyMu.Unlock()
+	readLimiter = nil
+	if requestsPerMinute > 0 {
+		readLimiter = NewLimiter(requestsPerMinute)
+	}
+}
+
+// gets the retry policy and the read limiter of the calls
+func getCallPolicy() (RetryPolicy, *Limiter) {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	return retryPolicy, readLimiter
+}
+
+// checks if the call failed with a transient error, worth calling again
+func isRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// gets the backoff before the retry, starting at 0, doubling the initial backoff up to the max backoff
+// jitter picks a random backoff between half of it and all of it, so the jobs failing together don't retry together
+func (r RetryPolicy) backoff(retry int) time.Duration {
+	backoff := r.InitialBackoff
+	for i := 0; i < retry && backoff < r.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if r.MaxBackoff > 0 && backoff > r.MaxBackoff {
+		backoff = r.MaxBackoff
+	}
+	if backoff <= 1 {
+		return backoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+}
+
+// waits for the read limiter, logging and counting the calls throttled
+func waitReadLimit(ctx context.Context, limiter *Limiter, method, metricType string) error {
+	if limiter == nil {
+		return nil
+	}
+	waited, err := limiter.Wait(ctx)
+	if waited > 0 {
+		selfmetrics.APIThrottled(method, waited)
+		if waited >= time.Second {
+			clientLogger.Printf("%s of %s throttled for %s by the read limit\n", method, metricType, waited)
+		}
+	}
+	return err
+}
+
+// calls the api with the client, every attempt waiting for the read limiter and with the call timeout of the context
+// calls failing with transient errors are made again with the retry policy, resuming where they failed
+// the api calls and errors are counted, and the client created again on fatal transport errors
+func (st *StackDriverClient) call(ctx context.Context, method, metricType string,
+	fn func(ctx context.Context, client *monitoring.MetricClient) error) error {
+	policy, limiter := getCallPolicy()
+	for retry := 0; ; retry++ {
+		if err := waitReadLimit(ctx, limiter, method, metricType); err != nil {
+			return err
+		}
+		client, err := st.getClient()
+		if err != nil {
+			return err
+		}
+		callCtx, cancel := callContext(ctx)
+		err = fn(callCtx, client)
+		cancel()
+		selfmetrics.APICall(method, metricType, err)
+		st.checkConnection(client, err)
+		if err == nil || !isRetryable(err) || retry >= policy.MaxRetries || ctx.Err() != nil {
+			return err
+		}
+		backoff := policy.backoff(retry)
+		selfmetrics.APIRetry(method, status.Code(err).String())
+		clientLogger.Printf("retrying %s of %s for project %s in %s (%d/%d): %v\n", method, metricType,
+			st.ProjectID, backoff, retry+1, policy.MaxRetries, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package stackdriverClient
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIsRetryable(t *testing.T) {
+	assert.True(t, isRetryable(status.Error(codes.Unavailable, "unavailable")))
+	assert.True(t, isRetryable(status.Error(codes.DeadlineExceeded, "deadline exceeded")))
+	assert.True(t, isRetryable(status.Error(codes.ResourceExhausted, "quota exceeded")))
+	assert.False(t, isRetryable(status.Error(codes.PermissionDenied, "permission denied")))
+	assert.False(t, isRetryable(errors.New("not a grpc error")))
+	assert.False(t, isRetryable(nil))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 5, InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	// doubled on every retry, with jitter between half and all of it
+	for retry, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		backoff := policy.backoff(retry)
+		assert.True(t, backoff >= max/2 && backoff <= max, "retry %d backoff %s", retry, backoff)
+	}
+	assert.Equal(t, time.Duration(0), RetryPolicy{}.backoff(3))
+}
+
+func TestSetReadLimit(t *testing.T) {
+	defer SetReadLimit(0)
+	SetReadLimit(120)
+	_, limiter := getCallPolicy()
+	assert.NotNil(t, limiter)
+	SetReadLimit(0)
+	_, limiter = getCallPolicy()
+	assert.Nil(t, limiter)
+}
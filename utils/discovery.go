@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+)
+
+// MetricsDiscovery : expands the metric type patterns (like "storage.googleapis.com/*")
+// into the metric types found in the project
+// Metrics	- metrics as passed on the command line, with exact types and patterns
+// Excludes	- regular expressions of the metric types to leave out of the expanded list
+// Metrics are replaced with SetMetrics once the discovery is in use, as on config reloads
+type MetricsDiscovery struct {
+	Client   *stackdriverClient.StackDriverClient
+	Metrics  []MetricsAndIntervalType
+	Excludes []*regexp.Regexp
+	mu       sync.RWMutex
+}
+
+// IsMetricPattern : checks if the metric type is a glob pattern instead of an exact type
+func IsMetricPattern(metricType string) bool {
+	return strings.ContainsAny(metricType, "*?")
+}
+
+// CompileMetricExcludes : compiles the regular expressions of the metric types to exclude
+func CompileMetricExcludes(excludes []string) ([]*regexp.Regexp, error) {
+	r := make([]*regexp.Regexp, 0, len(excludes))
+	for _, e := range excludes {
+		exp, err := regexp.Compile(e)
+		if err != nil {
+			return nil, fmt.Errorf("exclude expression %q is not valid: %v", e, err)
+		}
+		r = append(r, exp)
+	}
+	return r, nil
+}
+
+// builds the regular expression from the glob pattern, "*" matches any characters (including "/")
+// and "?" matches a single character
+func metricPatternToRegexp(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// builds the filter for listing the descriptors - prefix of the pattern before the first wildcard
+func metricPatternFilter(pattern string) string {
+	prefix := pattern[:strings.IndexAny(pattern, "*?")]
+	if prefix == "" {
+		return ""
+	}
+	return "metric.type = starts_with(\"" + prefix + "\")"
+}
+
+// gets the metric types matching the pattern and not matching any of the excludes
+func matchMetricTypes(pattern string, excludes []*regexp.Regexp, metricTypes []string) ([]string, error) {
+	exp, err := metricPatternToRegexp(pattern)
+	if err != nil {
+		return nil, err
+	}
+	matched := make([]string, 0)
+	for _, metricType := range metricTypes {
+		if !exp.MatchString(metricType) || isExcluded(metricType, excludes) {
+			continue
+		}
+		matched = append(matched, metricType)
+	}
+	return matched, nil
+}
+
+// checks if the metric type matches one of the excludes
+func isExcluded(metricType string, excludes []*regexp.Regexp) bool {
+	for _, e := range excludes {
+		if e.MatchString(metricType) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetMetrics : replaces the metrics to expand
+func (d *MetricsDiscovery) SetMetrics(metrics []MetricsAndIntervalType) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Metrics = metrics
+}
+
+// gets the metrics to expand
+func (d *MetricsDiscovery) getMetrics() []MetricsAndIntervalType {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.Metrics
+}
+
+// HasPatterns : checks if any of the metrics needs to be expanded
+func (d *MetricsDiscovery) HasPatterns() bool {
+	for _, m := range d.getMetrics() {
+		if IsMetricPattern(m.MetricType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand : returns the metrics list with the patterns replaced by the metric types found in the project
+// expanded metrics keep the interval, filter and aggregation of the pattern, the listing being cancelled with the context
+// patterns failing to be listed are left out, the other metrics being returned with the error
+func (d *MetricsDiscovery) Expand(ctx context.Context) ([]MetricsAndIntervalType, error) {
+	return d.ExpandMetrics(ctx, d.getMetrics())
+}
+
+// ExpandMetrics : expands the metrics list in the project, without replacing the metrics of the discovery
+// as on config reloads, the metrics being set only once expanded in all the projects
+func (d *MetricsDiscovery) ExpandMetrics(ctx context.Context,
+	metrics []MetricsAndIntervalType) ([]MetricsAndIntervalType, error) {
+	expanded := make([]MetricsAndIntervalType, 0, len(metrics))
+	failed := make([]string, 0)
+	for _, m := range metrics {
+		if !IsMetricPattern(m.MetricType) {
+			if !checkIfNotInMetricsList(m.MetricType, expanded) {
+				expanded = append(expanded, m)
+			}
+			continue
+		}
+		descriptors, err := d.Client.ListMetricDescriptors(ctx, metricPatternFilter(m.MetricType))
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("error on listing metrics for pattern %s: %v", m.MetricType, err))
+			continue
+		}
+		metricTypes := make([]string, 0, len(descriptors))
+		for _, descriptor := range descriptors {
+			metricTypes = append(metricTypes, descriptor.Type)
+		}
+		matched, err := matchMetricTypes(m.MetricType, d.Excludes, metricTypes)
+		if err != nil {
+			failed = append(failed, err.Error())
+			continue
+		}
+		for _, metricType := range matched {
+			if checkIfNotInMetricsList(metricType, expanded) {
+				continue
+			}
+			metric := m
+			metric.MetricType = metricType
+			expanded = append(expanded, metric)
+		}
+	}
+	if len(failed) > 0 {
+		return expanded, errors.New(strings.Join(failed, "; "))
+	}
+	return expanded, nil
+}
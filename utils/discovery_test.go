@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"context"
+	"testing"
+
+	"github.com/fernhtls/stackdriverExporter/fakemonitoring"
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+)
+
+func TestIsMetricPattern(t *testing.T) {
+	assert.True(t, IsMetricPattern("storage.googleapis.com/*"))
+	assert.True(t, IsMetricPattern("storage.googleapis.com/storage/object_?ount"))
+	assert.False(t, IsMetricPattern("storage.googleapis.com/storage/object_count"))
+}
+
+func TestMetricPatternFilter(t *testing.T) {
+	assert.Equal(t, "metric.type = starts_with(\"storage.googleapis.com/\")",
+		metricPatternFilter("storage.googleapis.com/*"))
+	assert.Equal(t, "", metricPatternFilter("*/storage/total_bytes"))
+}
+
+func TestMatchMetricTypes(t *testing.T) {
+	metricTypes := []string{
+		"storage.googleapis.com/storage/total_bytes",
+		"storage.googleapis.com/storage/object_count",
+		"storage.googleapis.com/api/request_count",
+		"bigquery.googleapis.com/storage/stored_bytes",
+	}
+	matched, err := matchMetricTypes("storage.googleapis.com/*", nil, metricTypes)
+	assert.NoError(t, err)
+	assert.Equal(t, metricTypes[:3], matched)
+	// "." is not a wildcard
+	matched, err = matchMetricTypes("storage?googleapis.com/storage/*", nil, metricTypes)
+	assert.NoError(t, err)
+	assert.Equal(t, metricTypes[:2], matched)
+	matched, err = matchMetricTypes("*/storage/*_bytes", nil, metricTypes)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{metricTypes[0], metricTypes[3]}, matched)
+	// excluding metrics
+	excludes, err := CompileMetricExcludes([]string{"/api/", "object_count$"})
+	assert.NoError(t, err)
+	matched, err = matchMetricTypes("storage.googleapis.com/*", excludes, metricTypes)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{metricTypes[0]}, matched)
+}
+
+func TestCompileMetricExcludesError(t *testing.T) {
+	_, err := CompileMetricExcludes([]string{"storage.googleapis.com/(api"})
+	assert.Error(t, err)
+}
+
+func TestExpandWithoutPatterns(t *testing.T) {
+	// exact metric types don't call the api
+	d := MetricsDiscovery{
+		Metrics: []MetricsAndIntervalType{
+			{MetricType: "storage.googleapis.com/storage/total_bytes", Interval: "*/5 * * * *"},
+			{MetricType: "storage.googleapis.com/storage/object_count", Interval: "*/5 * * * *"},
+		},
+	}
+	assert.False(t, d.HasPatterns())
+	expanded, err := d.Expand(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, d.Metrics, expanded)
+}
+
+func TestExpandPatternFailing(t *testing.T) {
+	server, options := fakemonitoring.NewTestServer(t)
+	client := &stackdriverClient.StackDriverClient{ProjectID: "deployments-metrics", Options: options}
+	assert.NoError(t, client.InitClient())
+	defer client.Close()
+	d := MetricsDiscovery{
+		Client: client,
+		Metrics: []MetricsAndIntervalType{
+			{MetricType: "compute.googleapis.com/instance/cpu/utilization", Interval: "*/5 * * * *"},
+			{MetricType: "storage.googleapis.com/storage/*", Interval: "*/5 * * * *"},
+		},
+	}
+	// the exact metric types are still returned with the error
+	server.FailNext(codes.PermissionDenied)
+	expanded, err := d.Expand(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, d.Metrics[:1], expanded)
+	expanded, err = d.Expand(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(expanded))
+}
@@ -1,61 +1,81 @@
 package utils
 
 import (
-	"errors"
+	"context"
+	"fmt"
+	"github.com/fernhtls/stackdriverExporter/selfmetrics"
 	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/gorhill/cronexpr"
+	"google.golang.org/api/iterator"
 	cron "github.com/robfig/cron/v3"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
 	"google.golang.org/protobuf/types/known/timestamppb"
-	"strings"
+	"log"
+	"reflect"
+	"sync"
 	"time"
 )
 
-//OutputMethod : interface for the several output methods
-type OutputMethod interface {
-	GetTimeSeriesMetric(*stackdriverClient.StackDriverClient, string, string)
+// Batch : time series of a metric fetched in the window from Start to End, written to the sinks
+// Refetch	- window of a previous run fetched again for the late points, older than the last window written
+type Batch struct {
+	ProjectID string
+	Metric    MetricsAndIntervalType
+	Start     time.Time
+	End       time.Time
+	Series    []*monitoringpb.TimeSeries
+	Refetch   bool
 }
 
-const (
-	PrometheusOutput = iota
-	JSONOutput
-)
+// Sink : output writing the batches fetched by the collector, which owns the windows, the queries and the retries
+// Write returns once the batch is written or buffered, Flush writes the buffered batches (the collector flushing
+// before moving the watermark of the window) and Close flushes and releases the sink
+type Sink interface {
+	Write(ctx context.Context, batch Batch) error
+	Flush(ctx context.Context) error
+	Close() error
+}
+
+// Collector : collects the metric of the project on every run of its job, feeding the sinks
+type Collector interface {
+	Collect(ctx context.Context, client *stackdriverClient.StackDriverClient, m MetricsAndIntervalType)
+}
 
 // MetricsAndIntervalType : struct with the metric type + the interval
+// Filter	- optional cloud monitoring filter expression for the metric (resource / metric labels)
+// Aggregation	- optional server side aggregation for the metric, nil for raw points
+// Lookback	- optional window queried for the latest points in prometheus output, 0 for the output lookback
+// IngestionDelay	- optional time the points take to be ingested, the query window ending that long before now
+// RefetchWindows	- optional number of previous windows queried again for the points ingested late
+// Outputs	- optional output types receiving the metric, all the outputs when empty
+// CallTimeout	- optional timeout of every api call of the metric, 0 for no timeout
+// Timeout	- optional deadline of a whole run of the metric job, the run being cancelled on its next cron tick anyway
 type MetricsAndIntervalType struct {
-	MetricType string
-	Interval   string
-}
-
-// building metric and interval list
-func getMetricAndInterval(metricAndIntervalSlice []string, outputType int) (string, string, error) {
-	var metricType string
-	var intervalMetric string
-	if len(metricAndIntervalSlice) > 2 {
-		return metricType, intervalMetric, errors.New("more than two arguments passed to generate the metric and interval")
-	}
-	if len(metricAndIntervalSlice) == 1 {
-		switch outputType {
-		case PrometheusOutput:
-			intervalMetric = "600"
-		default:
-			intervalMetric = "*/10 * * * *"
-		}
-	} else {
-		switch outputType {
-		case PrometheusOutput:
-			intervalMetric = metricAndIntervalSlice[1]
-		default:
-			// checking the cron expression if its valid
-			_, err := cronexpr.Parse(metricAndIntervalSlice[1])
-			if err != nil {
-				return metricType, intervalMetric, err
-			}
-			intervalMetric = metricAndIntervalSlice[1]
+	MetricType     string
+	Interval       string
+	Filter         string
+	Aggregation    *stackdriverClient.Aggregation
+	Lookback       time.Duration
+	IngestionDelay time.Duration
+	RefetchWindows int
+	Outputs        []string
+	CallTimeout    time.Duration
+	Timeout        time.Duration
+}
+
+// RoutedTo : checks if the metric is sent to the output type, metrics without outputs being sent to all of them
+func (m MetricsAndIntervalType) RoutedTo(outputType string) bool {
+	if len(m.Outputs) == 0 {
+		return true
+	}
+	for _, o := range m.Outputs {
+		if o == outputType {
+			return true
 		}
 	}
-	metricType = metricAndIntervalSlice[0]
-	return metricType, intervalMetric, nil
+	return false
 }
 
 // check if metrics are not already in the slice
@@ -70,43 +90,171 @@ func checkIfNotInMetricsList(metricType string, metricTypeList []MetricsAndInter
 	return found
 }
 
-// SetMetricsAndIntervalList : settting metrics and interval list
-func SetMetricsAndIntervalList(metrics []string, outputType int) ([]MetricsAndIntervalType, error) {
-	metricsAndInterval := make([]MetricsAndIntervalType, 0)
-	for _, metric := range metrics {
-		metricType, intervalMetric, err := getMetricAndInterval(strings.Split(metric, "|"), outputType)
+// CronJobs : jobs added to the cron server for a project, by metric type
+// the runs of the jobs are cancelled once the context is done, on their next cron tick or after the metric timeout
+type CronJobs struct {
+	ctx        context.Context
+	logger     *log.Logger
+	cronServer *cron.Cron
+	client     *stackdriverClient.StackDriverClient
+	collector  Collector
+	mu         sync.Mutex
+	entries    map[string]cronJob
+}
+
+// entry of the job in the cron server, with the metric it runs
+type cronJob struct {
+	id     cron.EntryID
+	metric MetricsAndIntervalType
+}
+
+// NewCronJobs : creates the jobs of the project for adding the metric jobs to the cron server, with the client of
+// the project shared with the outputs, closed with Close on exit
+// the context is passed to the runs of the jobs, the runs cancelled being reported in the logger
+func NewCronJobs(ctx context.Context, cronServer *cron.Cron, client *stackdriverClient.StackDriverClient,
+	collector Collector, logger *log.Logger) *CronJobs {
+	return &CronJobs{
+		ctx:        ctx,
+		logger:     logger,
+		cronServer: cronServer,
+		client:     client,
+		collector:  collector,
+		entries:    make(map[string]cronJob),
+	}
+}
+
+// Client : returns the stackdriver client used by the jobs
+func (c *CronJobs) Client() *stackdriverClient.StackDriverClient {
+	return c.client
+}
+
+// Close : closes the client of the project, the runs of the jobs after failing
+func (c *CronJobs) Close() error {
+	return c.client.Close()
+}
+
+// AddJobs : adds jobs for the metrics not yet scheduled, returning the metric types added
+func (c *CronJobs) AddJobs(metricList []MetricsAndIntervalType) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.addJobs(metricList)
+}
+
+func (c *CronJobs) addJobs(metricList []MetricsAndIntervalType) ([]string, error) {
+	added := make([]string, 0)
+	for _, metricType := range metricList {
+		if _, ok := c.entries[metricType.MetricType]; ok {
+			continue
+		}
+		// not passing directly as it passes only the last value to the function calls
+		jobMetric := metricType
+		schedule, err := cron.ParseStandard(jobMetric.Interval)
 		if err != nil {
-			return nil, err
+			return added, err
 		}
-		if !checkIfNotInMetricsList(metricType, metricsAndInterval) {
-			metricsAndInterval = append(metricsAndInterval, MetricsAndIntervalType{
-				MetricType: metricType,
-				Interval:   intervalMetric,
-			})
+		id := c.cronServer.Schedule(schedule, cron.FuncJob(func() {
+			c.runJob(schedule, jobMetric)
+		}))
+		c.entries[jobMetric.MetricType] = cronJob{id: id, metric: jobMetric}
+		added = append(added, jobMetric.MetricType)
+	}
+	return added, nil
+}
+
+// reasons of the runs cancelled on their deadline
+const (
+	jobTimeoutReason = "timeout"
+	jobNextRunReason = "next_run"
+)
+
+// gets the deadline of a run started at now, its next cron tick or the timeout of the metric when shorter
+// returns as well the reason of the deadline, for reporting the runs cancelled
+func getJobDeadline(schedule cron.Schedule, timeout time.Duration, now time.Time) (time.Time, string) {
+	deadline := schedule.Next(now)
+	if timeout > 0 && now.Add(timeout).Before(deadline) {
+		return now.Add(timeout), jobTimeoutReason
+	}
+	return deadline, jobNextRunReason
+}
+
+// runs the job of the metric until its deadline, so a run never overlaps the next one
+// runs cancelled on their deadline are logged and counted in the self metrics
+func (c *CronJobs) runJob(schedule cron.Schedule, m MetricsAndIntervalType) {
+	deadline, reason := getJobDeadline(schedule, m.Timeout, time.Now())
+	ctx, cancel := context.WithDeadline(c.ctx, deadline)
+	defer cancel()
+	c.collector.Collect(ctx, c.client, m)
+	if ctx.Err() != context.DeadlineExceeded || c.ctx.Err() != nil {
+		return
+	}
+	selfmetrics.JobCancelled(m.MetricType, c.client.ProjectID, reason)
+	if c.logger != nil {
+		c.logger.Println(fmt.Errorf("run of metric %s for project %s cancelled on its deadline (%s)",
+			m.MetricType, c.client.ProjectID, reason))
+	}
+}
+
+// SyncJobs : syncs the jobs with the metrics list, as on config reloads
+// removes the jobs of the metrics not in the list anymore, replaces the jobs of the metrics changed
+// and adds the new metrics, the jobs of the metrics not changed are left alone
+func (c *CronJobs) SyncJobs(metricList []MetricsAndIntervalType) ([]string, []string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	wanted := make(map[string]MetricsAndIntervalType, len(metricList))
+	for _, m := range metricList {
+		wanted[m.MetricType] = m
+	}
+	removed := make([]string, 0)
+	for metricType, job := range c.entries {
+		if m, ok := wanted[metricType]; ok && reflect.DeepEqual(m, job.metric) {
+			continue
 		}
+		c.cronServer.Remove(job.id)
+		delete(c.entries, metricType)
+		removed = append(removed, metricType)
 	}
-	return metricsAndInterval, nil
+	added, err := c.addJobs(metricList)
+	return added, removed, err
 }
 
-// AddJobs : adds jobs to the cron server
-func AddJobs(cronServer *cron.Cron, metricList []MetricsAndIntervalType, projectID string, output OutputMethod) error {
-	client := stackdriverClient.StackDriverClient{
-		ProjectID:  projectID,
+// ProjectLabel : label with the project id of the series
+const ProjectLabel = "project_id"
+
+// TagProjectID : sets the project id label in the resource of the series when not present
+// series queried from a metrics scope host project already have the project id of the monitored project
+func TagProjectID(series *monitoringpb.TimeSeries, projectID string) {
+	if series.Resource == nil {
+		series.Resource = &monitoredrespb.MonitoredResource{}
 	}
-	if err := client.InitClient(); err != nil {
-		return err
+	if series.Resource.Labels == nil {
+		series.Resource.Labels = make(map[string]string)
 	}
-	for _, metricType := range metricList {
-		// not passing directly as it passes only the last value to the function calls
-		metricTypeMetricType := metricType.MetricType
-		metricTypeInterval := metricType.Interval
-		_, err := cronServer.AddFunc(metricTypeInterval, func() {
-			output.GetTimeSeriesMetric(&client, metricTypeMetricType, metricTypeInterval) })
+	if series.Resource.Labels[ProjectLabel] == "" {
+		series.Resource.Labels[ProjectLabel] = projectID
+	}
+}
+
+// FetchSeries : fetches all the time series of the metric in the window, tagged with the project id
+// the calls are cancelled with the context, every call with the call timeout of the metric
+func FetchSeries(ctx context.Context, client *stackdriverClient.StackDriverClient, m MetricsAndIntervalType,
+	start, end time.Time) ([]*monitoringpb.TimeSeries, error) {
+	it, err := client.GetTimeSeriesMetricContext(stackdriverClient.WithCallTimeout(ctx, m.CallTimeout),
+		m.MetricType, m.Filter, m.Aggregation, timestamppb.New(start), timestamppb.New(end))
+	if err != nil {
+		return nil, err
+	}
+	series := make([]*monitoringpb.TimeSeries, 0)
+	for {
+		s, err := it.Next()
+		if err == iterator.Done {
+			return series, nil
+		}
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("error retrieving timeseries values for project %s: %v", client.ProjectID, err)
 		}
+		TagProjectID(s, client.ProjectID)
+		series = append(series, s)
 	}
-	return nil
 }
 
 // GetStartAndEndTimeCronJobs : Returns the start and end time for running a time series
@@ -129,6 +277,19 @@ func GetStartAndEndTimeCronJobs(cronInterval string) (*timestamppb.Timestamp, *t
 	return startTime, endTime, nil
 }
 
+// GetCronPeriod : Returns the time between the next two runs of the crontab expression after t
+func GetCronPeriod(cronInterval string, t time.Time) (time.Duration, error) {
+	e, err := cronexpr.Parse(cronInterval)
+	if err != nil {
+		return 0, err
+	}
+	next := e.NextN(t, 2)
+	if len(next) < 2 {
+		return 0, fmt.Errorf("crontab expression %s has no next runs", cronInterval)
+	}
+	return next[1].Sub(next[0]), nil
+}
+
 // GetStartAndEndTimeMinuteInterval : Returns the start / end time for an interval from the crontab expression
 func GetStartAndEndTimeMinuteInterval(interval int64) (*timestamppb.Timestamp, *timestamppb.Timestamp, error) {
 	timeStartFunc := time.Now().Truncate(time.Second)
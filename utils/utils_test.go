@@ -1,56 +1,124 @@
 package utils
 
 import (
+	"context"
 	"testing"
+	"time"
 
+	"github.com/fernhtls/stackdriverExporter/stackdriverClient"
+	cron "github.com/robfig/cron/v3"
 	"github.com/stretchr/testify/assert"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoringpb "google.golang.org/genproto/googleapis/monitoring/v3"
 )
 
-func TestGetMetricAndInterval(t *testing.T) {
-	metricType, interval, err := getMetricAndInterval([]string{"metrictype", "*/1 * * * *"}, JSONOutput)
-	assert.Equal(t, "metrictype", metricType)
-	assert.Equal(t, "*/1 * * * *", interval)
-	assert.NoError(t, err)
+func TestTagProjectID(t *testing.T) {
+	series := &monitoringpb.TimeSeries{}
+	TagProjectID(series, "project-a")
+	assert.Equal(t, "project-a", series.Resource.Labels[ProjectLabel])
+	// keeps the project id of series from a metrics scope
+	series = &monitoringpb.TimeSeries{
+		Resource: &monitoredrespb.MonitoredResource{
+			Type:   "gcs_bucket",
+			Labels: map[string]string{ProjectLabel: "project-b", "bucket_name": "bucket"},
+		},
+	}
+	TagProjectID(series, "project-a")
+	assert.Equal(t, "project-b", series.Resource.Labels[ProjectLabel])
 }
 
-func TestGetMetricAndIntervalErrorMoreArguments(t *testing.T) {
-	_, _, err := getMetricAndInterval([]string{"metrictype", "*/1 * * * *", "dummy"}, JSONOutput)
-	assert.Error(t, err)
+// collector doing nothing, for adding the jobs
+type noCollector struct{}
+
+func (c *noCollector) Collect(context.Context, *stackdriverClient.StackDriverClient, MetricsAndIntervalType) {
 }
 
-func TestGetMetricAndIntervalCronError(t *testing.T) {
-	_, _, err := getMetricAndInterval([]string{"metrictype", "*/99 * * * *"}, JSONOutput)
-	assert.Error(t, err)
+func TestSyncJobs(t *testing.T) {
+	cronServer := cron.New()
+	jobs := &CronJobs{
+		ctx:        context.Background(),
+		cronServer: cronServer,
+		client:     &stackdriverClient.StackDriverClient{ProjectID: "test"},
+		collector:  &noCollector{},
+		entries:    make(map[string]cronJob),
+	}
+	totalBytes := MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/total_bytes", Interval: "*/5 * * * *"}
+	objectCount := MetricsAndIntervalType{MetricType: "storage.googleapis.com/storage/object_count", Interval: "*/5 * * * *"}
+	added, err := jobs.AddJobs([]MetricsAndIntervalType{totalBytes, objectCount})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(added))
+	totalBytesID := jobs.entries[totalBytes.MetricType].id
+	// object count changed, and query count added
+	objectCount.Interval = "*/10 * * * *"
+	queryCount := MetricsAndIntervalType{MetricType: "bigquery.googleapis.com/query/count", Interval: "*/5 * * * *"}
+	added, removed, err := jobs.SyncJobs([]MetricsAndIntervalType{totalBytes, objectCount, queryCount})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{objectCount.MetricType, queryCount.MetricType}, added)
+	assert.Equal(t, []string{objectCount.MetricType}, removed)
+	assert.Equal(t, 3, len(cronServer.Entries()))
+	// jobs of the metrics not changed are left alone
+	assert.Equal(t, totalBytesID, jobs.entries[totalBytes.MetricType].id)
+	assert.Equal(t, "*/10 * * * *", jobs.entries[objectCount.MetricType].metric.Interval)
+	// metrics removed
+	added, removed, err = jobs.SyncJobs([]MetricsAndIntervalType{queryCount})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(added))
+	assert.ElementsMatch(t, []string{totalBytes.MetricType, objectCount.MetricType}, removed)
+	assert.Equal(t, 1, len(cronServer.Entries()))
 }
 
-func TestSetMetricsAndIntervalList(t *testing.T) {
-	metricsList := make([]string, 0)
-	metricsList = append(metricsList, "storage.googleapis.com/storage/total_bytes|*/10 * * * *")
-	metricsList = append(metricsList, "storage.googleapis.com/storage/object_count|*/5 * * * *")
-	metricsList = append(metricsList, "storage.googleapis.com/storage/object_count|*/5 * * * *") // not including repeting metrics
-	metricsType, err := SetMetricsAndIntervalList(metricsList, JSONOutput)
-	assert.Greater(t, len(metricsType), 0)
-	assert.Equal(t, len(metricsType), 2)
+func TestGetCronPeriod(t *testing.T) {
+	now := time.Date(2020, 10, 1, 10, 2, 0, 0, time.UTC)
+	period, err := GetCronPeriod("*/5 * * * *", now)
 	assert.NoError(t, err)
-	//
-	assert.Equal(t, metricsType[0].MetricType, "storage.googleapis.com/storage/total_bytes")
-	assert.Equal(t, metricsType[1].MetricType, "storage.googleapis.com/storage/object_count")
-	assert.Equal(t, metricsType[0].Interval, "*/10 * * * *")
-	assert.Equal(t, metricsType[1].Interval, "*/5 * * * *")
-}
-
-func TestSetMetricsAndIntervalListErrorMoreElements(t *testing.T) {
-	metricsList := make([]string, 0)
-	metricsList = append(metricsList, "storage.googleapis.com/storage/total_bytes|*/10 * * * *")
-	metricsList = append(metricsList, "storage.googleapis.com/storage/object_count|*/5 * * * *|Dummy")
-	_, err := SetMetricsAndIntervalList(metricsList, JSONOutput)
+	assert.Equal(t, 5*time.Minute, period)
+	period, err = GetCronPeriod("0 */2 * * *", now)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Hour, period)
+	_, err = GetCronPeriod("every minute", now)
 	assert.Error(t, err)
 }
 
-func TestSetMetricsAndIntervalListErrorCronExpression(t *testing.T) {
-	metricsList := make([]string, 0)
-	metricsList = append(metricsList, "storage.googleapis.com/storage/total_bytes|*/5 * * * *")
-	metricsList = append(metricsList, "storage.googleapis.com/storage/object_count|*/99 * * * *")
-	_, err := SetMetricsAndIntervalList(metricsList, JSONOutput)
-	assert.Error(t, err)
+func TestGetJobDeadline(t *testing.T) {
+	schedule, err := cron.ParseStandard("*/5 * * * *")
+	assert.NoError(t, err)
+	now := time.Date(2020, 10, 1, 10, 2, 0, 0, time.UTC)
+	// cancelled on the next cron tick without timeout, or with a longer one
+	deadline, reason := getJobDeadline(schedule, 0, now)
+	assert.Equal(t, time.Date(2020, 10, 1, 10, 5, 0, 0, time.UTC), deadline)
+	assert.Equal(t, jobNextRunReason, reason)
+	deadline, reason = getJobDeadline(schedule, 10*time.Minute, now)
+	assert.Equal(t, time.Date(2020, 10, 1, 10, 5, 0, 0, time.UTC), deadline)
+	assert.Equal(t, jobNextRunReason, reason)
+	deadline, reason = getJobDeadline(schedule, time.Minute, now)
+	assert.Equal(t, now.Add(time.Minute), deadline)
+	assert.Equal(t, jobTimeoutReason, reason)
+}
+
+// collector blocking until the run is cancelled, keeping the error of its context
+type blockingCollector struct {
+	err error
+}
+
+func (c *blockingCollector) Collect(ctx context.Context, _ *stackdriverClient.StackDriverClient, _ MetricsAndIntervalType) {
+	<-ctx.Done()
+	c.err = ctx.Err()
+}
+
+func TestRunJobTimeout(t *testing.T) {
+	collector := &blockingCollector{}
+	jobs := &CronJobs{
+		ctx:       context.Background(),
+		client:    &stackdriverClient.StackDriverClient{ProjectID: "test"},
+		collector: collector,
+		entries:   make(map[string]cronJob),
+	}
+	schedule, err := cron.ParseStandard("*/5 * * * *")
+	assert.NoError(t, err)
+	jobs.runJob(schedule, MetricsAndIntervalType{
+		MetricType: "storage.googleapis.com/storage/total_bytes",
+		Interval:   "*/5 * * * *",
+		Timeout:    10 * time.Millisecond,
+	})
+	assert.Equal(t, context.DeadlineExceeded, collector.err)
 }